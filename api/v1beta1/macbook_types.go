@@ -17,7 +17,10 @@ limitations under the License.
 package v1beta1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -31,6 +34,469 @@ type MacBookSpec struct {
 	// DisPlay is an example field of MacBook. Edit macbook_types.go to remove/update
 	// todo code 添加spec的字段
 	DisPlay string `json:"display,omitempty"`
+
+	// Image is the container image run by the MacBook's Deployment.
+	// +kubebuilder:default="nginx:1.12"
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// ClassName is the MacBookClass whose defaults apply to the MacBook. When empty the
+	// class annotated mock.dong.com/is-default-class=true is used, if any.
+	// +optional
+	ClassName string `json:"className,omitempty"`
+
+	// Resources are the compute resources of the web container, overriding the class default.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// LivenessProbe overrides the class's liveness probe of the web container.
+	// +optional
+	LivenessProbe *corev1.Probe `json:"livenessProbe,omitempty"`
+
+	// ReadinessProbe overrides the class's readiness probe of the web container.
+	// +optional
+	ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+
+	// SecurityContext overrides the class's security context of the web container.
+	// +optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+
+	// Replicas is the desired number of pods.
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// ProgressDeadlineSeconds is the maximum time a rollout may take before it is
+	// considered failed and rolled back to the last known-good revision.
+	// Defaults to the Deployment default of 600 seconds.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ProgressDeadlineSeconds *int32 `json:"progressDeadlineSeconds,omitempty"`
+
+	// RevisionHistoryLimit is the number of MacBookRevisions to keep.
+	// +kubebuilder:default=10
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+
+	// RollbackTo restores the spec stored in the MacBookRevision with this revision number.
+	// The controller clears the field once the spec has been restored.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	RollbackTo *int64 `json:"rollbackTo,omitempty"`
+
+	// Strategy describes how a new pod template replaces the running one.
+	// Without a strategy the Deployment's RollingUpdate is used. At most one of
+	// canary and blueGreen may be set.
+	// +optional
+	Strategy *RolloutStrategy `json:"strategy,omitempty"`
+
+	// Schedules change the replica count at given times. The schedule that fired
+	// most recently overrides spec.replicas until another schedule fires.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Schedules []ScalingSchedule `json:"schedules,omitempty"`
+
+	// Hibernation scales the MacBook to zero after it has been idle for a while.
+	// It is woken up by the manager's wake-up endpoint or the mock.dong.com/last-access annotation.
+	// +optional
+	Hibernation *HibernationSpec `json:"hibernation,omitempty"`
+
+	// TTLSecondsAfterCreation deletes the MacBook this many seconds after it was created.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TTLSecondsAfterCreation *int64 `json:"ttlSecondsAfterCreation,omitempty"`
+
+	// ExpiresAt deletes the MacBook at the given time. When both this and
+	// ttlSecondsAfterCreation are set the earlier one applies. The
+	// mock.dong.com/extend-by annotation pushes the expiry back by a duration.
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// Adopt lets the MacBook take over existing Deployments and Services with its names that
+	// have no controller: their owner reference is set and they converge onto the desired state.
+	// Without it such objects are reported as conflicts. The mock.dong.com/adopt=true
+	// annotation has the same effect.
+	// +optional
+	Adopt bool `json:"adopt,omitempty"`
+
+	// DeletionPolicy decides what happens to the workload when the MacBook is deleted.
+	// Delete removes everything; Orphan releases the Deployments, Services and
+	// PersistentVolumeClaims so they keep running; Retain-Storage deletes the workload but
+	// releases the PersistentVolumeClaims. Only objects with an owner reference to the
+	// MacBook are released. The controller creates no PersistentVolumeClaims, so a claim
+	// is only kept when its owner reference was set to the MacBook, e.g. by the user.
+	// Released objects get the mock.dong.com/released-by annotation.
+	// +kubebuilder:validation:Enum=Delete;Orphan;Retain-Storage
+	// +kubebuilder:default=Delete
+	// +optional
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+
+	// MaintenanceWindows are the only times at which changes that restart serving pods
+	// roll out. Outside a window such changes are held and reported by the PendingChanges
+	// condition, while scaling still proceeds. When empty, the cluster-wide windows
+	// configured on the manager apply.
+	// +optional
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+
+	// Components run next to the MacBook's own Deployment, e.g. the api and worker of a
+	// frontend. Each gets a Deployment and, when it has ports, a Service named
+	// <macbook>-<component>. Removed components are deleted.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Components []Component `json:"components,omitempty"`
+
+	// DependsOn lists MacBooks that must be Ready before the MacBook's workload is created
+	// or updated. While one is not, the WaitingForDependencies condition is True and the
+	// running workload is left as it is.
+	// +optional
+	DependsOn []MacBookReference `json:"dependsOn,omitempty"`
+
+	// Consumes lists MacBooks whose Service the pods talk to. Every container gets
+	// <NAME>_HOST, <NAME>_PORT and <NAME>_URL environment variables for each of them,
+	// NAME being the upper-cased MacBook name with dashes turned into underscores.
+	// Variables set explicitly on a container take precedence. The pods are rolled when
+	// a Service's port changes. Two MacBooks mapping to the same NAME are rejected. While
+	// a Service does not exist, the WaitingForServices condition is True and the running
+	// workload is left as it is.
+	// +optional
+	Consumes []MacBookReference `json:"consumes,omitempty"`
+
+	// WaitFor lists states of other cluster objects that must hold before the MacBook's
+	// Deployment is created, replacing init containers that poll for them. Once the
+	// Deployment exists they are only reported in status.waitFor.
+	// +optional
+	WaitFor []WaitForCondition `json:"waitFor,omitempty"`
+
+	// Hooks are Jobs run around each rollout of a new pod template.
+	// +optional
+	Hooks *MacBookHooks `json:"hooks,omitempty"`
+}
+
+// MacBookHooks are Jobs run around each rollout of a new pod template.
+type MacBookHooks struct {
+	// PreDeploy runs to completion before the Deployment is created or its pod template
+	// updated, e.g. a database migration. When it fails the new template is not rolled out.
+	// +optional
+	PreDeploy *Hook `json:"preDeploy,omitempty"`
+
+	// PostDeploy runs after the rollout of a new pod template completed, e.g. a smoke test.
+	// When it fails the Deployment is rolled back to the last known-good revision. Only
+	// supported with the default rolling update strategy.
+	// +optional
+	PostDeploy *Hook `json:"postDeploy,omitempty"`
+}
+
+// Hook is the template of a hook Job, either a single container given by image, command,
+// args and env, or a full Job template.
+type Hook struct {
+	// Template is a full Job template (a JobTemplateSpec with metadata and a batch/v1 Job
+	// spec) for hooks that need more than one container, volumes or a service account. It is
+	// mutually exclusive with image, command, args and env. Containers without an image use
+	// the MacBook's image, the restart policy defaults to Never, and backoffLimit and
+	// activeDeadlineSeconds apply unless set in the template. The CRD keeps the template
+	// schemaless to stay within the size limit of CRDs; unknown fields are reported by the
+	// controller and the API server validates the created Job.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +optional
+	Template *runtime.RawExtension `json:"template,omitempty"`
+
+	// Image of the hook container. Defaults to the MacBook's image.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Command of the hook container.
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// Args of the hook container.
+	// +optional
+	Args []string `json:"args,omitempty"`
+
+	// Env of the hook container. The variables of spec.consumes are added as well.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// BackoffLimit is the number of retries before the hook is considered failed.
+	// +kubebuilder:default=0
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+
+	// ActiveDeadlineSeconds is how long the hook may run before it is considered failed.
+	// +kubebuilder:default=600
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+}
+
+// WaitForCondition is a state of a cluster object. Exactly one field must be set.
+type WaitForCondition struct {
+	// ConfigMapKey waits for a key in a ConfigMap of the MacBook's namespace.
+	// +optional
+	ConfigMapKey *ConfigMapKeyReference `json:"configMapKey,omitempty"`
+
+	// Secret waits for a Secret of the MacBook's namespace to exist.
+	// +optional
+	Secret *corev1.LocalObjectReference `json:"secret,omitempty"`
+
+	// JobComplete waits for a Job of the MacBook's namespace to complete.
+	// +optional
+	JobComplete *corev1.LocalObjectReference `json:"jobComplete,omitempty"`
+
+	// Condition waits for an object of any kind to report a status condition.
+	// +optional
+	Condition *ObjectCondition `json:"condition,omitempty"`
+}
+
+// ConfigMapKeyReference refers to a key of a ConfigMap.
+type ConfigMapKeyReference struct {
+	// Name of the ConfigMap.
+	Name string `json:"name"`
+
+	// Key that must be present in data or binaryData.
+	Key string `json:"key"`
+}
+
+// ObjectCondition is a condition in status.conditions of an object.
+type ObjectCondition struct {
+	// APIVersion of the object, e.g. postgres-operator.example.com/v1.
+	APIVersion string `json:"apiVersion"`
+
+	// Kind of the object.
+	Kind string `json:"kind"`
+
+	// Name of the object.
+	Name string `json:"name"`
+
+	// Namespace of the object. Defaults to the namespace of the MacBook, ignored for
+	// cluster-scoped kinds.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Type of the condition, e.g. Ready.
+	Type string `json:"type"`
+
+	// Status the condition must have.
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	// +kubebuilder:default=True
+	// +optional
+	Status metav1.ConditionStatus `json:"status,omitempty"`
+}
+
+// MacBookReference refers to another MacBook.
+type MacBookReference struct {
+	// Name of the MacBook.
+	Name string `json:"name"`
+
+	// Namespace of the MacBook. Defaults to the namespace of the referring MacBook.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Component is a separately deployed part of a MacBook.
+type Component struct {
+	// Name of the component, appended to the MacBook's name. canary, green and preview
+	// are reserved for the objects of canary and blue/green rollouts.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=40
+	Name string `json:"name"`
+
+	// Image is the container image of the component.
+	Image string `json:"image"`
+
+	// Replicas is the desired number of pods. Hibernation scales components to zero too.
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Ports of the container, exposed by the component's Service.
+	// +optional
+	Ports []corev1.ContainerPort `json:"ports,omitempty"`
+
+	// Env of the container.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// Resources of the container.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// MaintenanceWindow is a recurring period in which disruptive changes may roll out.
+type MaintenanceWindow struct {
+	// Schedule is a standard five-field cron expression of when the window opens, e.g. "0 2 * * 6".
+	Schedule string `json:"schedule"`
+
+	// TimeZone is the IANA name of the time zone of Schedule. Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Duration is how long the window stays open, e.g. 4h.
+	Duration metav1.Duration `json:"duration"`
+}
+
+// HibernationSpec configures idle hibernation.
+type HibernationSpec struct {
+	// IdleAfter is how long the MacBook may go without activity before it is scaled to zero, e.g. 30m.
+	IdleAfter metav1.Duration `json:"idleAfter"`
+
+	// Metric reports activity from a request-count query. Without a metric only
+	// the last-access annotation, the wake-up endpoint and spec changes count as activity.
+	// +optional
+	Metric *IdleMetric `json:"metric,omitempty"`
+}
+
+// IdleMetric is a request-count query against a Prometheus compatible HTTP API.
+type IdleMetric struct {
+	// Address is the base URL of the HTTP API, e.g. http://prometheus.monitoring:9090.
+	Address string `json:"address"`
+
+	// Query is a PromQL instant query returning the number of recent requests.
+	// A value above zero counts as activity. {{namespace}} and {{name}} are replaced
+	// with the namespace and the MacBook name.
+	Query string `json:"query"`
+
+	// Interval is the time between queries. Defaults to 1m.
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+}
+
+// ScalingSchedule sets the replica count when its cron expression fires.
+type ScalingSchedule struct {
+	// Name identifies the schedule in status.
+	Name string `json:"name"`
+
+	// Schedule is a standard five-field cron expression, e.g. "0 8 * * 1-5".
+	Schedule string `json:"schedule"`
+
+	// TimeZone is the IANA name of the time zone of Schedule, e.g. Asia/Shanghai. Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Replicas is the replica count from the time the schedule fires.
+	// +kubebuilder:validation:Minimum=0
+	Replicas int32 `json:"replicas"`
+}
+
+// RolloutStrategy describes how a new pod template is rolled out.
+type RolloutStrategy struct {
+	// Canary shifts replicas from the stable to the new template step by step.
+	// +optional
+	Canary *CanaryStrategy `json:"canary,omitempty"`
+
+	// BlueGreen brings up the new pod template next to the active one and switches the Service over.
+	// +optional
+	BlueGreen *BlueGreenStrategy `json:"blueGreen,omitempty"`
+}
+
+// BlueGreenStrategy runs the new pod template in a full preview Deployment of the other color,
+// exposed on the <name>-preview Service, and switches the MacBook's Service to it once it is ready.
+type BlueGreenStrategy struct {
+	// AutoPromote switches the Service as soon as the preview is ready.
+	// Otherwise the switch waits for the mock.dong.com/promote annotation.
+	// +optional
+	AutoPromote bool `json:"autoPromote,omitempty"`
+
+	// ScaleDownDelay is how long the previous color keeps running after the switch,
+	// so rolling back to it is instant. Defaults to 30s.
+	// +optional
+	ScaleDownDelay *metav1.Duration `json:"scaleDownDelay,omitempty"`
+}
+
+// CanaryStrategy runs the new pod template in a canary Deployment next to the stable one,
+// both selected by the MacBook's Service.
+type CanaryStrategy struct {
+	// Steps are executed in order. When every step is done the canary is promoted.
+	// Defaults to a single setWeight of 20.
+	// +optional
+	Steps []CanaryStep `json:"steps,omitempty"`
+
+	// Analysis configures the metric checks run by analysis steps. When it is set and no
+	// step is an analysis step, an analysis step with the default settings runs after the
+	// last step, so every change of the pod template is analyzed before it is promoted.
+	// Analysis is only available with the canary strategy: the default rolling update and
+	// blue/green rollouts are not analyzed.
+	// +optional
+	Analysis *CanaryAnalysis `json:"analysis,omitempty"`
+}
+
+// CanaryAnalysis queries a Prometheus compatible HTTP API to decide whether the canary is healthy.
+type CanaryAnalysis struct {
+	// Address is the base URL of the HTTP API, e.g. http://prometheus.monitoring:9090.
+	Address string `json:"address"`
+
+	// Metrics are evaluated at every measurement. A measurement is successful
+	// when every metric is within its thresholds.
+	// +kubebuilder:validation:MinItems=1
+	Metrics []AnalysisMetric `json:"metrics"`
+}
+
+// AnalysisMetric is a PromQL query and the range of values it must stay in.
+type AnalysisMetric struct {
+	// Name identifies the metric in status, e.g. success-rate.
+	Name string `json:"name"`
+
+	// Query is a PromQL instant query returning a scalar or a single sample.
+	// {{namespace}}, {{name}} and {{canary}} are replaced with the namespace,
+	// the MacBook name and the canary Deployment name.
+	Query string `json:"query"`
+
+	// Min is the lowest acceptable value, e.g. "0.99" for a success rate.
+	// +optional
+	Min *resource.Quantity `json:"min,omitempty"`
+
+	// Max is the highest acceptable value, e.g. "500m" for a latency of half a second.
+	// +optional
+	Max *resource.Quantity `json:"max,omitempty"`
+}
+
+// CanaryStep is a single step of a canary rollout. Exactly one field should be set.
+type CanaryStep struct {
+	// SetWeight is the percentage of replicas that run the new pod template.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	SetWeight *int32 `json:"setWeight,omitempty"`
+
+	// Pause holds the rollout for a duration, or until it is promoted when no duration is set.
+	// +optional
+	Pause *CanaryPause `json:"pause,omitempty"`
+
+	// Analysis holds the rollout at the current weight and measures the metrics of
+	// strategy.canary.analysis until enough measurements succeed. The canary is
+	// aborted when too many measurements fail.
+	// +optional
+	Analysis *AnalysisStep `json:"analysis,omitempty"`
+}
+
+// AnalysisStep runs the canary analysis a number of times.
+type AnalysisStep struct {
+	// Interval is the time between measurements. Defaults to 1m.
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+
+	// Count is the number of successful measurements needed to pass. Defaults to 3.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Count *int32 `json:"count,omitempty"`
+
+	// FailureLimit is the number of failed measurements tolerated before the canary is aborted. Defaults to 0.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	FailureLimit *int32 `json:"failureLimit,omitempty"`
+}
+
+// CanaryPause holds a canary rollout.
+type CanaryPause struct {
+	// Duration is how long to pause, e.g. 5m. Without a duration the rollout
+	// waits for the mock.dong.com/promote annotation.
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
 }
 
 // MacBookStatus defines the observed state of MacBook
@@ -39,12 +505,541 @@ type MacBookStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	// todo code 添加status的字段
 	Mod string `json:"mod,omitempty"`
+
+	// ObservedGeneration is the most recent generation observed by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions represent the latest available observations of the MacBook's state.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// LastError is the last error the controller hit while reconciling the MacBook.
+	// It is cleared by the next successful reconcile.
+	// +optional
+	LastError *ReconcileError `json:"lastError,omitempty"`
+
+	// Pods summarizes the pods of the MacBook's Deployment.
+	// +optional
+	Pods PodSummary `json:"pods,omitempty"`
+
+	// LastKnownGood is the most recent revision whose rollout completed successfully.
+	// +optional
+	LastKnownGood *KnownGoodRevision `json:"lastKnownGood,omitempty"`
+
+	// CurrentRevision is the number of the MacBookRevision holding the current spec.
+	// +optional
+	CurrentRevision int64 `json:"currentRevision,omitempty"`
+
+	// FailedRevision is the revision that failed to become healthy and was rolled back.
+	// The controller does not retry it until the pod template changes again.
+	// +optional
+	FailedRevision *FailedRevision `json:"failedRevision,omitempty"`
+
+	// Canary is the state of the running canary rollout.
+	// +optional
+	Canary *CanaryStatus `json:"canary,omitempty"`
+
+	// BlueGreen is the state of the blue/green rollout.
+	// +optional
+	BlueGreen *BlueGreenStatus `json:"blueGreen,omitempty"`
+
+	// Schedule shows which of spec.schedules sets the replica count.
+	// +optional
+	Schedule *ScheduleStatus `json:"schedule,omitempty"`
+
+	// Hibernation is the state of idle hibernation.
+	// +optional
+	Hibernation *HibernationStatus `json:"hibernation,omitempty"`
+
+	// Expiry is the state of the MacBook's TTL.
+	// +optional
+	Expiry *ExpiryStatus `json:"expiry,omitempty"`
+
+	// Maintenance is the state of the maintenance windows.
+	// +optional
+	Maintenance *MaintenanceStatus `json:"maintenance,omitempty"`
+
+	// Components is the state of each of spec.components.
+	// +optional
+	Components []ComponentStatus `json:"components,omitempty"`
+
+	// WaitFor is the state of each of spec.waitFor.
+	// +optional
+	WaitFor []WaitForStatus `json:"waitFor,omitempty"`
+
+	// Hooks are the results of the hook Jobs of the current pod template.
+	// +optional
+	Hooks []HookStatus `json:"hooks,omitempty"`
+}
+
+// hook 的阶段和结果
+const (
+	// HookPreDeploy is the phase of spec.hooks.preDeploy.
+	HookPreDeploy = "PreDeploy"
+	// HookPostDeploy is the phase of spec.hooks.postDeploy.
+	HookPostDeploy = "PostDeploy"
+
+	// HookRunning means the hook Job has not finished.
+	HookRunning = "Running"
+	// HookSucceeded means the hook Job completed.
+	HookSucceeded = "Succeeded"
+	// HookFailed means the hook Job failed.
+	HookFailed = "Failed"
+)
+
+// HookStatus is the result of a hook Job.
+type HookStatus struct {
+	// Phase of the hook.
+	// +kubebuilder:validation:Enum=PreDeploy;PostDeploy
+	Phase string `json:"phase"`
+
+	// Job is the name of the hook Job.
+	Job string `json:"job"`
+
+	// TemplateHash is the hash of the pod template the hook ran for.
+	TemplateHash string `json:"templateHash"`
+
+	// HookHash is the hash of the hook spec the Job ran. Editing the hook runs a new Job.
+	// +optional
+	HookHash string `json:"hookHash,omitempty"`
+
+	// Result of the hook Job.
+	// +kubebuilder:validation:Enum=Running;Succeeded;Failed
+	Result string `json:"result"`
+
+	// Message explains a failure.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// StartTime is when the hook Job was created.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the hook Job finished.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// WaitForStatus is the state of one of spec.waitFor.
+type WaitForStatus struct {
+	// Description of what is waited for, e.g. ConfigMap app-config key db-url.
+	Description string `json:"description"`
+
+	// Met is true when the state holds.
+	Met bool `json:"met"`
+
+	// Message explains why the state does not hold.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ComponentStatus is the state of a component's Deployment.
+type ComponentStatus struct {
+	// Name of the component.
+	Name string `json:"name"`
+
+	// Replicas is the desired number of pods.
+	Replicas int32 `json:"replicas"`
+
+	// ReadyReplicas is the number of ready pods at the current template.
+	ReadyReplicas int32 `json:"readyReplicas"`
+
+	// Ready is true when every desired pod is updated and ready.
+	Ready bool `json:"ready"`
+}
+
+// MaintenanceStatus is the state of the maintenance windows.
+type MaintenanceStatus struct {
+	// InWindow is true while a maintenance window is open.
+	InWindow bool `json:"inWindow"`
+
+	// WindowEnd is when the open window closes.
+	// +optional
+	WindowEnd *metav1.Time `json:"windowEnd,omitempty"`
+
+	// NextWindow is when the next window opens.
+	// +optional
+	NextWindow *metav1.Time `json:"nextWindow,omitempty"`
+
+	// Pending lists the changes held until the next window.
+	// +optional
+	Pending []string `json:"pending,omitempty"`
+}
+
+// ExpiryStatus is the state of the MacBook's TTL.
+type ExpiryStatus struct {
+	// ExpiresAt is when the MacBook is deleted, including any extension.
+	ExpiresAt metav1.Time `json:"expiresAt"`
+
+	// WarnedAt is when the latest expiry warning event was emitted.
+	// +optional
+	WarnedAt *metav1.Time `json:"warnedAt,omitempty"`
+
+	// Message reports a problem with the extension annotation.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// HibernationStatus is the state of idle hibernation.
+type HibernationStatus struct {
+	// Hibernated is true while the MacBook is scaled to zero for being idle.
+	Hibernated bool `json:"hibernated"`
+
+	// LastActivity is the latest activity seen by the controller.
+	// +optional
+	LastActivity *metav1.Time `json:"lastActivity,omitempty"`
+
+	// HibernatedAt is when the MacBook was scaled to zero.
+	// +optional
+	HibernatedAt *metav1.Time `json:"hibernatedAt,omitempty"`
+
+	// LastMetricCheck is when the request-count metric was last queried.
+	// +optional
+	LastMetricCheck *metav1.Time `json:"lastMetricCheck,omitempty"`
+
+	// LastMetricError is the error of the latest request-count query. While it is set
+	// the MacBook is not hibernated, so that a monitoring outage does not scale it to zero.
+	// It is cleared by the next successful query.
+	// +optional
+	LastMetricError string `json:"lastMetricError,omitempty"`
+
+	// Message describes the latest decision or metric error.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ScheduleStatus is the state of the scaling schedules.
+type ScheduleStatus struct {
+	// Active is the name of the schedule that fired most recently.
+	// Empty when no schedule has fired and spec.replicas applies.
+	// +optional
+	Active string `json:"active,omitempty"`
+
+	// ActiveSince is when the active schedule fired.
+	// +optional
+	ActiveSince *metav1.Time `json:"activeSince,omitempty"`
+
+	// Replicas is the replica count set by the active schedule.
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Next is the name of the next schedule to fire.
+	// +optional
+	Next string `json:"next,omitempty"`
+
+	// NextTime is when the next schedule fires.
+	// +optional
+	NextTime *metav1.Time `json:"nextTime,omitempty"`
+}
+
+// spec.deletionPolicy 的取值
+const (
+	// DeletionPolicyDelete deletes the workload together with the MacBook.
+	DeletionPolicyDelete = "Delete"
+	// DeletionPolicyOrphan keeps the Deployments, Services and PersistentVolumeClaims.
+	DeletionPolicyOrphan = "Orphan"
+	// DeletionPolicyRetainStorage deletes the workload but keeps the PersistentVolumeClaims.
+	DeletionPolicyRetainStorage = "Retain-Storage"
+)
+
+// canary 发布的阶段
+const (
+	// CanaryPhaseProgressing means the canary is moving through its steps.
+	CanaryPhaseProgressing = "Progressing"
+	// CanaryPhasePaused means the canary waits for a manual promote.
+	CanaryPhasePaused = "Paused"
+	// CanaryPhaseCompleted means the canary was promoted to stable.
+	CanaryPhaseCompleted = "Completed"
+	// CanaryPhaseAborted means the canary was aborted and the stable template restored.
+	CanaryPhaseAborted = "Aborted"
+)
+
+// CanaryStatus is the state of a canary rollout.
+type CanaryStatus struct {
+	// TemplateHash is the hash of the pod template being rolled out.
+	TemplateHash string `json:"templateHash"`
+
+	// Phase is one of Progressing, Paused, Completed or Aborted.
+	Phase string `json:"phase"`
+
+	// CurrentStep is the index of the step being executed.
+	CurrentStep int32 `json:"currentStep"`
+
+	// StepStartedAt is when the current step started.
+	// +optional
+	StepStartedAt *metav1.Time `json:"stepStartedAt,omitempty"`
+
+	// Weight is the current percentage of replicas running the new template.
+	Weight int32 `json:"weight"`
+
+	// StableReplicas is the desired replica count of the stable Deployment.
+	StableReplicas int32 `json:"stableReplicas"`
+
+	// CanaryReplicas is the desired replica count of the canary Deployment.
+	CanaryReplicas int32 `json:"canaryReplicas"`
+
+	// Message describes what the rollout is waiting for.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Analysis is the state of the latest analysis step.
+	// +optional
+	Analysis *AnalysisStatus `json:"analysis,omitempty"`
+}
+
+// 分析和单个指标的结果
+const (
+	// AnalysisPhaseRunning means the analysis needs more measurements.
+	AnalysisPhaseRunning = "Running"
+	// AnalysisPhaseSuccessful means enough measurements succeeded, or a metric is within its thresholds.
+	AnalysisPhaseSuccessful = "Successful"
+	// AnalysisPhaseFailed means too many measurements failed, or a metric is out of its thresholds.
+	AnalysisPhaseFailed = "Failed"
+	// AnalysisPhaseError means a metric could not be queried.
+	AnalysisPhaseError = "Error"
+)
+
+// AnalysisStatus is the state of an analysis step.
+type AnalysisStatus struct {
+	// Step is the index of the analysis step.
+	Step int32 `json:"step"`
+
+	// Phase is one of Running, Successful or Failed.
+	Phase string `json:"phase"`
+
+	// Successful is the number of successful measurements.
+	Successful int32 `json:"successful"`
+
+	// Failed is the number of failed measurements.
+	Failed int32 `json:"failed"`
+
+	// ConsecutiveErrors is the number of measurements in a row that could not query every metric.
+	// +optional
+	ConsecutiveErrors int32 `json:"consecutiveErrors,omitempty"`
+
+	// LastMeasuredAt is when the latest measurement was taken.
+	// +optional
+	LastMeasuredAt *metav1.Time `json:"lastMeasuredAt,omitempty"`
+
+	// Metrics are the results of the latest measurement.
+	// +optional
+	Metrics []MetricResult `json:"metrics,omitempty"`
+
+	// Message describes the outcome.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// MetricResult is the value of a metric in a measurement.
+type MetricResult struct {
+	// Name is the name of the metric.
+	Name string `json:"name"`
+
+	// Value is the value returned by the query.
+	// +optional
+	Value string `json:"value,omitempty"`
+
+	// Phase is one of Successful, Failed or Error.
+	Phase string `json:"phase"`
+
+	// Message explains a failure or an error.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// blue/green 发布的阶段
+const (
+	// BlueGreenPhaseProgressing means the preview Deployment is rolling out.
+	BlueGreenPhaseProgressing = "Progressing"
+	// BlueGreenPhasePaused means the preview is ready and waits for a manual promote.
+	BlueGreenPhasePaused = "Paused"
+	// BlueGreenPhaseActive means the Service points at the current pod template.
+	BlueGreenPhaseActive = "Active"
+	// BlueGreenPhaseAborted means the preview was aborted and the active color kept.
+	BlueGreenPhaseAborted = "Aborted"
+)
+
+// BlueGreenStatus is the state of a blue/green rollout.
+type BlueGreenStatus struct {
+	// ActiveColor is the color selected by the MacBook's Service, blue or green.
+	ActiveColor string `json:"activeColor"`
+
+	// ActiveTemplateHash is the hash of the pod template of the active color.
+	ActiveTemplateHash string `json:"activeTemplateHash"`
+
+	// PreviewTemplateHash is the hash of the pod template being previewed.
+	// +optional
+	PreviewTemplateHash string `json:"previewTemplateHash,omitempty"`
+
+	// PreviousTemplateHash is the hash of the pod template that was active before the last switch.
+	// Switching back to it does not wait for a promote while the previous color is still running.
+	// +optional
+	PreviousTemplateHash string `json:"previousTemplateHash,omitempty"`
+
+	// Phase is one of Progressing, Paused, Active or Aborted.
+	Phase string `json:"phase"`
+
+	// SwitchedAt is when the Service was last switched.
+	// +optional
+	SwitchedAt *metav1.Time `json:"switchedAt,omitempty"`
+
+	// ScaleDownAt is when the previous color is deleted.
+	// +optional
+	ScaleDownAt *metav1.Time `json:"scaleDownAt,omitempty"`
+
+	// Message describes what the rollout is waiting for.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// KnownGoodRevision is a revision whose rollout completed successfully.
+type KnownGoodRevision struct {
+	// TemplateHash is the hash of the pod template generated from Spec.
+	TemplateHash string `json:"templateHash"`
+
+	// Spec is the MacBook spec that produced the revision.
+	Spec MacBookSpec `json:"spec"`
+
+	// Time is when the rollout completed.
+	Time metav1.Time `json:"time"`
+}
+
+// FailedRevision is a revision that failed to become healthy.
+type FailedRevision struct {
+	// TemplateHash is the hash of the pod template that failed.
+	TemplateHash string `json:"templateHash"`
+
+	// Reason is why the revision was considered failed, e.g. ProgressDeadlineExceeded or CrashLoopBackOff.
+	Reason string `json:"reason"`
+
+	// Message is a human readable description of the failure.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// HookHash is the hash of the failed hook when Reason is PreDeployHookFailed or PostDeployHookFailed.
+	// Editing the hook retries the revision.
+	// +optional
+	HookHash string `json:"hookHash,omitempty"`
+
+	// Time is when the revision was rolled back.
+	Time metav1.Time `json:"time"`
+}
+
+// PodSummary aggregates the state of the pods selected by the MacBook's pod label.
+type PodSummary struct {
+	// Total is the number of pods.
+	Total int32 `json:"total"`
+
+	// Ready is the number of ready pods.
+	Ready int32 `json:"ready"`
+
+	// Restarts is the sum of container restart counts across all pods.
+	Restarts int32 `json:"restarts"`
+
+	// Waiting lists containers stuck in a waiting state such as CrashLoopBackOff or ImagePullBackOff.
+	// +optional
+	Waiting []ContainerWaiting `json:"waiting,omitempty"`
+
+	// LastTermination is the most recent container termination across all pods.
+	// +optional
+	LastTermination *ContainerTermination `json:"lastTermination,omitempty"`
+}
+
+// ContainerWaiting describes a container that is waiting to run.
+type ContainerWaiting struct {
+	// Pod is the name of the pod.
+	Pod string `json:"pod"`
+
+	// Container is the name of the container.
+	Container string `json:"container"`
+
+	// Reason is the waiting reason, e.g. CrashLoopBackOff.
+	Reason string `json:"reason"`
+
+	// Message is the waiting message.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ContainerTermination describes the last termination of a container.
+type ContainerTermination struct {
+	// Pod is the name of the pod.
+	Pod string `json:"pod"`
+
+	// Container is the name of the container.
+	Container string `json:"container"`
+
+	// Reason is the termination reason, e.g. Error or OOMKilled.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// ExitCode is the exit code of the container.
+	ExitCode int32 `json:"exitCode"`
+
+	// Message is the termination message of the container.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// FinishedAt is when the container terminated.
+	// +optional
+	FinishedAt metav1.Time `json:"finishedAt,omitempty"`
+}
+
+// 错误分类，与控制器中的分类一致
+const (
+	// ErrorClassTransient errors are retried with backoff.
+	ErrorClassTransient = "Transient"
+	// ErrorClassTerminal errors are not retried until the MacBook changes.
+	ErrorClassTerminal = "Terminal"
+)
+
+// condition 类型
+const (
+	// ConditionDegraded is True when the last reconcile failed with a terminal error.
+	ConditionDegraded = "Degraded"
+	// ConditionPendingChanges is True while changes are held until the next maintenance window.
+	ConditionPendingChanges = "PendingChanges"
+	// ConditionReady is True when every desired pod is ready.
+	ConditionReady = "Ready"
+	// ConditionWaitingForDependencies is True while a MacBook of spec.dependsOn is not Ready.
+	ConditionWaitingForDependencies = "WaitingForDependencies"
+	// ConditionWaitingForObjects is True while the creation of the Deployment waits for spec.waitFor.
+	ConditionWaitingForObjects = "WaitingForObjects"
+	// ConditionWaitingForServices is True while the Service of a MacBook of spec.consumes does not exist.
+	ConditionWaitingForServices = "WaitingForServices"
+)
+
+// ReconcileError records an error returned by a reconcile step.
+type ReconcileError struct {
+	// Class is either Transient or Terminal.
+	// +kubebuilder:validation:Enum=Transient;Terminal
+	Class string `json:"class"`
+
+	// Reason is a CamelCase name of the step that failed.
+	Reason string `json:"reason"`
+
+	// Message is the error message.
+	Message string `json:"message"`
+
+	// Time is when the error happened.
+	Time metav1.Time `json:"time"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 // 关键代码打印多行
 // +kubebuilder:printcolumn:name="Mod",type="string",JSONPath=".status.mod"
+// +kubebuilder:printcolumn:name="Revision",type="integer",JSONPath=".status.currentRevision"
+// +kubebuilder:printcolumn:name="Ready",type="integer",JSONPath=".status.pods.ready"
+// +kubebuilder:printcolumn:name="Total",type="integer",JSONPath=".status.pods.total"
+// +kubebuilder:printcolumn:name="Restarts",type="integer",JSONPath=".status.pods.restarts"
+// +kubebuilder:printcolumn:name="Degraded",type="string",JSONPath=".status.conditions[?(@.type=='Degraded')].status"
+// +kubebuilder:printcolumn:name="Hibernated",type="boolean",JSONPath=".status.hibernation.hibernated",priority=1
+// +kubebuilder:printcolumn:name="Expires",type="string",JSONPath=".status.expiry.expiresAt",priority=1
+// +kubebuilder:printcolumn:name="Schedule",type="string",JSONPath=".status.schedule.active",priority=1
 
 // MacBook is the Schema for the macbooks API
 type MacBook struct {
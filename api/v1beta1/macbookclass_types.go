@@ -0,0 +1,97 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultClassAnnotation marks the MacBookClass used by MacBooks without spec.className.
+const DefaultClassAnnotation = "mock.dong.com/is-default-class"
+
+// MacBook 可以覆盖的 class 字段
+const (
+	// OverrideRegistry lets MacBooks use images from another registry.
+	OverrideRegistry ClassOverride = "Registry"
+	// OverrideResources lets MacBooks set spec.resources.
+	OverrideResources ClassOverride = "Resources"
+	// OverrideProbes lets MacBooks set spec.livenessProbe and spec.readinessProbe.
+	OverrideProbes ClassOverride = "Probes"
+	// OverrideSecurityContext lets MacBooks set spec.securityContext.
+	OverrideSecurityContext ClassOverride = "SecurityContext"
+)
+
+// MacBookClassSpec holds defaults shared by the MacBooks of a class.
+type MacBookClassSpec struct {
+	// ImageRegistry is prefixed to images that do not name a registry, e.g. registry.example.com/team.
+	// +optional
+	ImageRegistry string `json:"imageRegistry,omitempty"`
+
+	// Resources are the default compute resources of the web container.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// LivenessProbe is the default liveness probe of the web container.
+	// +optional
+	LivenessProbe *corev1.Probe `json:"livenessProbe,omitempty"`
+
+	// ReadinessProbe is the default readiness probe of the web container.
+	// +optional
+	ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+
+	// SecurityContext is the default security context of the web container.
+	// +optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+
+	// AllowedOverrides lists the settings MacBooks of the class may set themselves.
+	// A MacBook setting anything else is rejected with a Degraded condition.
+	// +optional
+	// +listType=set
+	AllowedOverrides []ClassOverride `json:"allowedOverrides,omitempty"`
+}
+
+// ClassOverride is a setting of a MacBookClass that MacBooks may override.
+// +kubebuilder:validation:Enum=Registry;Resources;Probes;SecurityContext
+type ClassOverride string
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Registry",type="string",JSONPath=".spec.imageRegistry"
+// +kubebuilder:printcolumn:name="Default",type="string",JSONPath=".metadata.annotations.mock\\.dong\\.com/is-default-class"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MacBookClass is the Schema for the macbookclasses API
+type MacBookClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MacBookClassSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MacBookClassList contains a list of MacBookClass
+type MacBookClassList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MacBookClass `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MacBookClass{}, &MacBookClassList{})
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MacBookQuotaSpec limits what the MacBooks of a namespace may request. Creating or
+// updating a MacBook is rejected when it would raise the usage above a limit.
+type MacBookQuotaSpec struct {
+	// MaxMacBooks is the maximum number of MacBooks in the namespace.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxMacBooks *int32 `json:"maxMacbooks,omitempty"`
+
+	// MaxReplicas is the maximum total of replicas. A MacBook counts its spec.replicas
+	// or the largest replicas of its schedules, whichever is higher.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxReplicas *int32 `json:"maxReplicas,omitempty"`
+
+	// MaxCPU is the maximum total CPU requested by the MacBooks' pods at those replicas.
+	// +optional
+	MaxCPU *resource.Quantity `json:"maxCpu,omitempty"`
+
+	// MaxMemory is the maximum total memory requested by the MacBooks' pods at those replicas.
+	// +optional
+	MaxMemory *resource.Quantity `json:"maxMemory,omitempty"`
+}
+
+// MacBookQuotaUsage is what the MacBooks of a namespace request.
+type MacBookQuotaUsage struct {
+	// MacBooks is the number of MacBooks.
+	MacBooks int32 `json:"macbooks"`
+
+	// Replicas is the total of replicas.
+	Replicas int32 `json:"replicas"`
+
+	// CPU is the total CPU requested.
+	CPU resource.Quantity `json:"cpu"`
+
+	// Memory is the total memory requested.
+	Memory resource.Quantity `json:"memory"`
+}
+
+// MacBookQuotaStatus defines the observed state of MacBookQuota
+type MacBookQuotaStatus struct {
+	// ObservedGeneration is the generation of the spec the status was computed from.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Used is the current usage of the namespace.
+	// +optional
+	Used MacBookQuotaUsage `json:"used,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:path=macbookquotas
+// +kubebuilder:printcolumn:name="MacBooks",type="integer",JSONPath=".status.used.macbooks"
+// +kubebuilder:printcolumn:name="Max MacBooks",type="integer",JSONPath=".spec.maxMacbooks"
+// +kubebuilder:printcolumn:name="Replicas",type="integer",JSONPath=".status.used.replicas"
+// +kubebuilder:printcolumn:name="Max Replicas",type="integer",JSONPath=".spec.maxReplicas"
+// +kubebuilder:printcolumn:name="CPU",type="string",JSONPath=".status.used.cpu",priority=1
+// +kubebuilder:printcolumn:name="Memory",type="string",JSONPath=".status.used.memory",priority=1
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MacBookQuota is the Schema for the macbookquotas API
+type MacBookQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MacBookQuotaSpec   `json:"spec,omitempty"`
+	Status MacBookQuotaStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MacBookQuotaList contains a list of MacBookQuota
+type MacBookQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MacBookQuota `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MacBookQuota{}, &MacBookQuotaList{})
+}
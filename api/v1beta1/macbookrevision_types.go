@@ -0,0 +1,103 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MacBookRevisionLabel is set on every MacBookRevision to the name of its MacBook.
+const MacBookRevisionLabel = "mock.dong.com/macbook"
+
+// revision 的结果
+const (
+	// RevisionOutcomePending means the revision is rolling out.
+	RevisionOutcomePending = "Pending"
+	// RevisionOutcomeSucceeded means the revision's rollout completed.
+	RevisionOutcomeSucceeded = "Succeeded"
+	// RevisionOutcomeFailed means the revision failed to become healthy and was rolled back.
+	RevisionOutcomeFailed = "Failed"
+	// RevisionOutcomeSuperseded means a newer revision was accepted before this one finished.
+	RevisionOutcomeSuperseded = "Superseded"
+)
+
+// MacBookRevisionSpec is an immutable snapshot of an accepted MacBook spec. Updates to it
+// are rejected by the validating webhook.
+// The controller only creates and deletes revisions, it never updates their spec.
+type MacBookRevisionSpec struct {
+	// MacBook is the name of the MacBook the revision belongs to.
+	MacBook string `json:"macbook"`
+
+	// Revision is the sequence number of the revision within its MacBook, starting at 1.
+	Revision int64 `json:"revision"`
+
+	// Hash is the hash of Spec.
+	Hash string `json:"hash"`
+
+	// Spec is the snapshot of the MacBook spec.
+	Spec MacBookSpec `json:"spec"`
+}
+
+// MacBookRevisionStatus defines the observed state of MacBookRevision
+type MacBookRevisionStatus struct {
+	// Outcome is the result of rolling out the revision.
+	// +kubebuilder:validation:Enum=Pending;Succeeded;Failed;Superseded
+	// +optional
+	Outcome string `json:"outcome,omitempty"`
+
+	// Message explains the outcome.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// CompletedAt is when the outcome became final.
+	// +optional
+	CompletedAt *metav1.Time `json:"completedAt,omitempty"`
+
+	// Hooks are the results of the hook Jobs run for the revision.
+	// +optional
+	Hooks []HookStatus `json:"hooks,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="MacBook",type="string",JSONPath=".spec.macbook"
+// +kubebuilder:printcolumn:name="Revision",type="integer",JSONPath=".spec.revision"
+// +kubebuilder:printcolumn:name="Hash",type="string",JSONPath=".spec.hash"
+// +kubebuilder:printcolumn:name="Outcome",type="string",JSONPath=".status.outcome"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MacBookRevision is the Schema for the macbookrevisions API
+type MacBookRevision struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MacBookRevisionSpec   `json:"spec,omitempty"`
+	Status MacBookRevisionStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MacBookRevisionList contains a list of MacBookRevision
+type MacBookRevisionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MacBookRevision `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MacBookRevision{}, &MacBookRevisionList{})
+}
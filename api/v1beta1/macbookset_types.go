@@ -0,0 +1,174 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// MacBookSetLabel is set on every MacBook of a MacBookSet to the set's name.
+const MacBookSetLabel = "mock.dong.com/macbookset"
+
+// MacBookSetSpec defines the desired state of MacBookSet
+type MacBookSetSpec struct {
+	// NamespaceSelector selects the namespaces that get a MacBook. Namespaces that
+	// stop matching lose their MacBook.
+	NamespaceSelector metav1.LabelSelector `json:"namespaceSelector"`
+
+	// Template is the MacBook created in every selected namespace. The MacBooks are
+	// named after the set.
+	Template MacBookTemplate `json:"template"`
+
+	// Rollout updates the MacBooks in waves after the template changes. Without it
+	// every MacBook is updated at once. MacBooks in newly selected namespaces are
+	// always created from the current template.
+	// +optional
+	Rollout *MacBookSetRollout `json:"rollout,omitempty"`
+}
+
+// MacBookSetRollout controls a wave rollout of a MacBookSet.
+type MacBookSetRollout struct {
+	// BatchSize is the number of MacBooks updated in each wave, or a percentage of
+	// the selected namespaces such as 10%. A wave starts when every MacBook of the
+	// previous waves is Ready at the new template.
+	// +kubebuilder:validation:XIntOrString
+	BatchSize intstr.IntOrString `json:"batchSize"`
+
+	// FailureThreshold is the number of failed MacBooks that halts the rollout.
+	// A MacBook fails when it reports Degraded or is not Ready within WaveTimeout.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +optional
+	FailureThreshold int32 `json:"failureThreshold,omitempty"`
+
+	// WaveTimeout is how long the MacBooks of a wave may take to become Ready. Defaults to 10m.
+	// +optional
+	WaveTimeout *metav1.Duration `json:"waveTimeout,omitempty"`
+}
+
+// MacBookTemplate describes the MacBooks created by a MacBookSet.
+type MacBookTemplate struct {
+	// Labels added to the MacBooks.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations added to the MacBooks.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Spec of the MacBooks.
+	Spec MacBookSpec `json:"spec"`
+}
+
+// MacBookSetStatus defines the observed state of MacBookSet
+type MacBookSetStatus struct {
+	// ObservedGeneration is the generation of the spec the status was computed from.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Namespaces is the state of the MacBook in each selected namespace.
+	// +optional
+	Namespaces []MacBookSetNamespaceStatus `json:"namespaces,omitempty"`
+
+	// MacBooks is the number of MacBooks of the set.
+	MacBooks int32 `json:"macbooks"`
+
+	// ReadyMacBooks is the number of those MacBooks that are Ready at their current spec.
+	ReadyMacBooks int32 `json:"readyMacbooks"`
+
+	// Rollout is the progress of the wave rollout of the current template.
+	// +optional
+	Rollout *MacBookSetRolloutStatus `json:"rollout,omitempty"`
+
+	// Conditions of the set. Ready is True when the MacBook of every selected namespace is ready.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// MacBookSetNamespaceStatus is the state of the MacBook of a set in one namespace.
+type MacBookSetNamespaceStatus struct {
+	// Name of the namespace.
+	Name string `json:"name"`
+
+	// Ready is true when the MacBook is Ready at its current spec.
+	Ready bool `json:"ready"`
+
+	// Message explains why the MacBook is not ready.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// MacBookSetRolloutStatus is the progress of a wave rollout.
+type MacBookSetRolloutStatus struct {
+	// TemplateHash identifies the template being rolled out.
+	TemplateHash string `json:"templateHash"`
+
+	// Wave is the number of waves started, 0 before the first wave.
+	Wave int32 `json:"wave"`
+
+	// WaveStartTime is when the current wave started.
+	// +optional
+	WaveStartTime *metav1.Time `json:"waveStartTime,omitempty"`
+
+	// UpdatedMacBooks is the number of MacBooks at the template.
+	UpdatedMacBooks int32 `json:"updatedMacbooks"`
+
+	// Failed lists the namespaces whose MacBook failed at the template in any wave.
+	// A failed namespace is not checked again until the template changes.
+	// +optional
+	Failed []string `json:"failed,omitempty"`
+
+	// Halted is true when the failures reached the threshold. No more MacBooks are
+	// updated until the template changes.
+	// +optional
+	Halted bool `json:"halted,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="MacBooks",type="integer",JSONPath=".status.macbooks"
+// +kubebuilder:printcolumn:name="Ready MacBooks",type="integer",JSONPath=".status.readyMacbooks"
+// +kubebuilder:printcolumn:name="Wave",type="integer",JSONPath=".status.rollout.wave",priority=1
+// +kubebuilder:printcolumn:name="Halted",type="boolean",JSONPath=".status.rollout.halted",priority=1
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MacBookSet is the Schema for the macbooksets API
+type MacBookSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MacBookSetSpec   `json:"spec,omitempty"`
+	Status MacBookSetStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MacBookSetList contains a list of MacBookSet
+type MacBookSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MacBookSet `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MacBookSet{}, &MacBookSetList{})
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TenantLabel is set on every namespace and seed MacBook of a Tenant to the tenant's name.
+const TenantLabel = "mock.dong.com/tenant"
+
+// namespace 在 tenant status 中的阶段
+const (
+	// TenantNamespaceActive means the namespace exists and is owned by the tenant.
+	TenantNamespaceActive = "Active"
+	// TenantNamespaceTerminating means the namespace is being deleted.
+	TenantNamespaceTerminating = "Terminating"
+	// TenantNamespaceConflict means a namespace with the name exists but belongs to someone else.
+	TenantNamespaceConflict = "Conflict"
+)
+
+// TenantSpec defines the desired state of Tenant
+type TenantSpec struct {
+	// Namespaces are created and owned by the tenant. Namespaces removed from the
+	// list are deleted together with everything in them.
+	// +kubebuilder:validation:MinItems=1
+	// +listType=set
+	Namespaces []string `json:"namespaces"`
+
+	// Labels are added to every namespace of the tenant.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ResourceQuota is applied to every namespace as the tenant-quota ResourceQuota.
+	// +optional
+	ResourceQuota *corev1.ResourceQuotaSpec `json:"resourceQuota,omitempty"`
+
+	// LimitRange is applied to every namespace as the tenant-limits LimitRange.
+	// +optional
+	LimitRange *corev1.LimitRangeSpec `json:"limitRange,omitempty"`
+
+	// Admins are granted AdminRole in every namespace through the tenant-admins RoleBinding.
+	// +optional
+	Admins []rbacv1.Subject `json:"admins,omitempty"`
+
+	// AdminRole is the ClusterRole granted to the admins.
+	// +kubebuilder:default=admin
+	// +optional
+	AdminRole string `json:"adminRole,omitempty"`
+
+	// MacBooks are created once in the tenant's namespaces. The tenant does not update
+	// them afterwards, so teams are free to change them.
+	// +optional
+	MacBooks []TenantMacBook `json:"macbooks,omitempty"`
+}
+
+// TenantMacBook is a MacBook created when the tenant is set up.
+type TenantMacBook struct {
+	// Name of the MacBook.
+	Name string `json:"name"`
+
+	// Namespace of the MacBook, one of the tenant's namespaces.
+	Namespace string `json:"namespace"`
+
+	// Spec of the MacBook.
+	Spec MacBookSpec `json:"spec"`
+}
+
+// TenantStatus defines the observed state of Tenant
+type TenantStatus struct {
+	// ObservedGeneration is the generation of the spec the status was computed from.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Namespaces is the state of each namespace of the tenant.
+	// +optional
+	Namespaces []TenantNamespaceStatus `json:"namespaces,omitempty"`
+
+	// MacBooks is the number of MacBooks in the tenant's namespaces.
+	MacBooks int32 `json:"macbooks"`
+
+	// ReadyMacBooks is the number of those MacBooks whose Ready condition is True.
+	ReadyMacBooks int32 `json:"readyMacbooks"`
+
+	// Conditions of the tenant. Ready is True when every namespace is set up.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// TenantNamespaceStatus is the state of one namespace of a tenant.
+type TenantNamespaceStatus struct {
+	// Name of the namespace.
+	Name string `json:"name"`
+
+	// Phase of the namespace.
+	// +kubebuilder:validation:Enum=Active;Terminating;Conflict
+	Phase string `json:"phase"`
+
+	// MacBooks is the number of MacBooks in the namespace.
+	MacBooks int32 `json:"macbooks"`
+
+	// ReadyMacBooks is the number of those MacBooks whose Ready condition is True.
+	ReadyMacBooks int32 `json:"readyMacbooks"`
+
+	// Message explains a Conflict phase.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="MacBooks",type="integer",JSONPath=".status.macbooks"
+// +kubebuilder:printcolumn:name="Ready MacBooks",type="integer",JSONPath=".status.readyMacbooks"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// Tenant is the Schema for the tenants API
+type Tenant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TenantSpec   `json:"spec,omitempty"`
+	Status TenantStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TenantList contains a list of Tenant
+type TenantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Tenant `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Tenant{}, &TenantList{})
+}
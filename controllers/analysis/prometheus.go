@@ -0,0 +1,89 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package analysis 查询 Prometheus 兼容的 HTTP API，判断发布中的版本是否健康
+package analysis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// ErrNoData 查询没有返回任何样本，通常是指标还没有产生
+var ErrNoData = errors.New("query returned no data")
+
+// Prometheus 执行即时查询，结果必须是一个标量或者只有一个样本的向量
+type Prometheus struct {
+	api promv1.API
+}
+
+// NewPrometheus address 为 Prometheus HTTP API 的地址，例如 http://prometheus.monitoring:9090
+func NewPrometheus(address string) (*Prometheus, error) {
+	c, err := api.NewClient(api.Config{Address: address})
+	if err != nil {
+		return nil, err
+	}
+	return &Prometheus{api: promv1.NewAPI(c)}, nil
+}
+
+// Query 执行 PromQL 即时查询并返回唯一的值
+func (p *Prometheus) Query(ctx context.Context, query string) (float64, error) {
+	value, _, err := p.api.Query(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case *model.Scalar:
+		return float64(v.Value), nil
+	case model.Vector:
+		if len(v) == 0 {
+			return 0, ErrNoData
+		}
+		if len(v) > 1 {
+			return 0, fmt.Errorf("query returned %d series, expected 1", len(v))
+		}
+		return float64(v[0].Value), nil
+	default:
+		return 0, fmt.Errorf("unsupported result type %s", value.Type())
+	}
+}
+
+// Threshold 可以接受的取值范围，为空的一端不限制
+type Threshold struct {
+	Min *float64
+	Max *float64
+}
+
+// Check 值在范围内返回 nil，否则返回说明原因的错误，NaN 总是不满足
+func (t Threshold) Check(v float64) error {
+	if math.IsNaN(v) {
+		return errors.New("value is NaN")
+	}
+	if t.Min != nil && v < *t.Min {
+		return fmt.Errorf("%g is below the minimum %g", v, *t.Min)
+	}
+	if t.Max != nil && v > *t.Max {
+		return fmt.Errorf("%g is above the maximum %g", v, *t.Max)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package analysis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakePrometheus 按查询语句返回固定的 /api/v1/query 响应
+func fakePrometheus(t *testing.T, responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/query" {
+			http.NotFound(w, req)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		data, ok := responses[req.Form.Get("query")]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"unknown query"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":%s}`, data)
+	}))
+}
+
+func TestPrometheusQuery(t *testing.T) {
+	server := fakePrometheus(t, map[string]string{
+		"scalar":  `{"resultType":"scalar","result":[1620000000,"0.995"]}`,
+		"vector":  `{"resultType":"vector","result":[{"metric":{"app":"mac"},"value":[1620000000,"0.25"]}]}`,
+		"empty":   `{"resultType":"vector","result":[]}`,
+		"multi":   `{"resultType":"vector","result":[{"metric":{"a":"1"},"value":[1620000000,"1"]},{"metric":{"a":"2"},"value":[1620000000,"2"]}]}`,
+		"matrix":  `{"resultType":"matrix","result":[]}`,
+		"notanum": `{"resultType":"scalar","result":[1620000000,"NaN"]}`,
+	})
+	defer server.Close()
+
+	prom, err := NewPrometheus(server.URL)
+	if err != nil {
+		t.Fatalf("NewPrometheus: %v", err)
+	}
+
+	tests := []struct {
+		query   string
+		want    float64
+		wantErr bool
+		noData  bool
+	}{
+		{query: "scalar", want: 0.995},
+		{query: "vector", want: 0.25},
+		{query: "empty", wantErr: true, noData: true},
+		{query: "multi", wantErr: true},
+		{query: "matrix", wantErr: true},
+		{query: "unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := prom.Query(context.Background(), tt.query)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", tt.query, got)
+			}
+			if tt.noData && !errors.Is(err, ErrNoData) {
+				t.Errorf("%s: expected ErrNoData, got %v", tt.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.query, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	v, err := prom.Query(context.Background(), "notanum")
+	if err != nil {
+		t.Fatalf("notanum: unexpected error %v", err)
+	}
+	if err := (Threshold{}).Check(v); err == nil {
+		t.Errorf("NaN should never pass a threshold")
+	}
+}
+
+func TestThresholdCheck(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		threshold Threshold
+		value     float64
+		ok        bool
+	}{
+		{Threshold{}, 42, true},
+		{Threshold{Min: f(0.99)}, 0.995, true},
+		{Threshold{Min: f(0.99)}, 0.98, false},
+		{Threshold{Max: f(0.5)}, 0.5, true},
+		{Threshold{Max: f(0.5)}, 0.51, false},
+		{Threshold{Min: f(1), Max: f(2)}, 1.5, true},
+		{Threshold{Min: f(1), Max: f(2)}, 3, false},
+	}
+	for _, tt := range tests {
+		if err := tt.threshold.Check(tt.value); (err == nil) != tt.ok {
+			t.Errorf("Check(%v) with %+v: got %v, want ok=%v", tt.value, tt.threshold, err, tt.ok)
+		}
+	}
+}
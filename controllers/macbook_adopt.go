@@ -0,0 +1,120 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// AdoptAnnotation 值为 true 时和 spec.adopt 一样，接管没有 owner 的同名 deployment
+const AdoptAnnotation = "mock.dong.com/adopt"
+
+func adoptionEnabled(MacBook *mockv1beta1.MacBook) bool {
+	return MacBook.Spec.Adopt || MacBook.Annotations[AdoptAnnotation] == "true"
+}
+
+// claimDeployment 确认集群中的同名 deployment 归 MacBook 管理。
+// 属于其他 owner 时报告冲突；没有 owner 时只有开启接管才会检查兼容性并设置 owner，
+// 之后由 updateDeployment 改成期望状态
+func (r *MacBookReconciler) claimDeployment(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, dep, found *appsv1.Deployment) *reconcileError {
+	if metav1.IsControlledBy(found, MacBook) {
+		return nil
+	}
+	// 冲突只能由用户处理，重试也不会成功
+	if owner := metav1.GetControllerOf(found); owner != nil {
+		return terminalError("DeploymentConflict", fmt.Errorf("deployment %s is controlled by %s %s", found.Name, owner.Kind, owner.Name))
+	}
+	if !adoptionEnabled(MacBook) {
+		return terminalError("DeploymentConflict", fmt.Errorf("deployment %s already exists without an owner, set spec.adopt or the %s=true annotation to adopt it",
+			found.Name, AdoptAnnotation))
+	}
+
+	// deployment 的 selector 不能修改，必须能选中期望模板的 pod
+	selector, err := metav1.LabelSelectorAsSelector(found.Spec.Selector)
+	if err != nil {
+		return terminalError("AdoptionIncompatible", fmt.Errorf("deployment %s has an invalid selector: %w", found.Name, err))
+	}
+	if selector.Empty() || !selector.Matches(labels.Set(dep.Spec.Template.Labels)) {
+		return terminalError("AdoptionIncompatible", fmt.Errorf("selector %s of deployment %s does not match the pod labels %v of MacBook %s",
+			selector, found.Name, dep.Spec.Template.Labels, MacBook.Name))
+	}
+
+	if err := controllerutil.SetControllerReference(MacBook, found, r.Scheme); err != nil {
+		return terminalError("SetControllerReferenceFailed", err)
+	}
+	if err := r.Update(ctx, found); err != nil {
+		return classifyError("DeploymentAdoptFailed", err)
+	}
+	clog.Info("deployment adopted", "deployment-name", found.Name)
+	r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonAdopted, "Adopted existing deployment %s", found.Name)
+	r.recordEvent(ctx, found, corev1.EventTypeNormal, EventReasonAdopted, "Adopted by MacBook %s", MacBook.Name)
+	return nil
+}
+
+// claimService 和 claimDeployment 一样确认同名 service 归 MacBook 管理，避免改写别人的 service。
+// 没有 owner 的 service 只有开启接管并且 selector 选择的是 MacBook 的 pod 时才接管，之后由 applyService 改成期望状态
+func (r *MacBookReconciler) claimService(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, svc, found *corev1.Service) *reconcileError {
+	if metav1.IsControlledBy(found, MacBook) {
+		return nil
+	}
+	if owner := metav1.GetControllerOf(found); owner != nil {
+		return terminalError("ServiceConflict", fmt.Errorf("service %s is controlled by %s %s", found.Name, owner.Kind, owner.Name))
+	}
+	if !adoptionEnabled(MacBook) {
+		return terminalError("ServiceConflict", fmt.Errorf("service %s already exists without an owner, set spec.adopt or the %s=true annotation to adopt it",
+			found.Name, AdoptAnnotation))
+	}
+
+	// blue/green 的颜色由控制器切换，不参与比较
+	want := labels.Set{}
+	for k, v := range svc.Spec.Selector {
+		if k != tools.ColorLabel {
+			want[k] = v
+		}
+	}
+	current := labels.Set{}
+	for k, v := range found.Spec.Selector {
+		if k != tools.ColorLabel {
+			current[k] = v
+		}
+	}
+	if len(current) == 0 || !labels.SelectorFromSet(current).Matches(want) {
+		return terminalError("AdoptionIncompatible", fmt.Errorf("selector %v of service %s does not select the pods %v of MacBook %s",
+			found.Spec.Selector, found.Name, svc.Spec.Selector, MacBook.Name))
+	}
+
+	if err := controllerutil.SetControllerReference(MacBook, found, r.Scheme); err != nil {
+		return terminalError("SetControllerReferenceFailed", err)
+	}
+	if err := r.Update(ctx, found); err != nil {
+		return classifyError("ServiceAdoptFailed", err)
+	}
+	clog.Info("service adopted", "service-name", found.Name)
+	r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonAdopted, "Adopted existing service %s", found.Name)
+	r.recordEvent(ctx, found, corev1.EventTypeNormal, EventReasonAdopted, "Adopted by MacBook %s", MacBook.Name)
+	return nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestClaimDeployment(t *testing.T) {
+	otherOwner := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "other", UID: "other-uid", Controller: boolPtr(true)}
+	tests := []struct {
+		name string
+		// setup 修改 MacBook 和集群中已有的 deployment
+		setup      func(MacBook *mockv1beta1.MacBook, found *appsv1.Deployment)
+		wantReason string
+		wantOwned  bool
+	}{
+		{
+			name:       "unowned deployment is a conflict without adoption",
+			wantReason: "DeploymentConflict",
+		},
+		{
+			name: "deployment of another owner is a conflict",
+			setup: func(MacBook *mockv1beta1.MacBook, found *appsv1.Deployment) {
+				MacBook.Spec.Adopt = true
+				found.OwnerReferences = []metav1.OwnerReference{otherOwner}
+			},
+			wantReason: "DeploymentConflict",
+		},
+		{
+			// 升级前创建的 deployment 只按 app 选择，同样选中期望模板的 pod
+			name: "compatible selector is adopted",
+			setup: func(MacBook *mockv1beta1.MacBook, found *appsv1.Deployment) {
+				MacBook.Spec.Adopt = true
+				found.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{tools.AppLabel: MacBook.Name}}
+			},
+			wantOwned: true,
+		},
+		{
+			name: "adopt annotation is the same as spec.adopt",
+			setup: func(MacBook *mockv1beta1.MacBook, found *appsv1.Deployment) {
+				MacBook.Annotations = map[string]string{AdoptAnnotation: "true"}
+			},
+			wantOwned: true,
+		},
+		{
+			name: "selector of other pods is incompatible",
+			setup: func(MacBook *mockv1beta1.MacBook, found *appsv1.Deployment) {
+				MacBook.Spec.Adopt = true
+				found.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{tools.AppLabel: "legacy"}}
+			},
+			wantReason: "AdoptionIncompatible",
+		},
+		{
+			name: "empty selector is incompatible",
+			setup: func(MacBook *mockv1beta1.MacBook, found *appsv1.Deployment) {
+				MacBook.Spec.Adopt = true
+				found.Spec.Selector = &metav1.LabelSelector{}
+			},
+			wantReason: "AdoptionIncompatible",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			dep := tools.NewDeployMent(MacBook, nil)
+			found := dep.DeepCopy()
+			if tt.setup != nil {
+				tt.setup(MacBook, found)
+			}
+			r := newFakeReconciler(t, found.DeepCopy())
+			ctx := context.Background()
+			if err := r.Get(ctx, client.ObjectKeyFromObject(found), found); err != nil {
+				t.Fatal(err)
+			}
+
+			rerr := r.claimDeployment(ctx, ctrl.Log, MacBook, dep, found)
+
+			if tt.wantReason == "" && rerr != nil || tt.wantReason != "" && (rerr == nil || rerr.reason != tt.wantReason || rerr.class != errorTerminal) {
+				t.Fatalf("claimDeployment error = %v, want terminal %q", rerr, tt.wantReason)
+			}
+			stored := &appsv1.Deployment{}
+			if err := r.Get(ctx, client.ObjectKeyFromObject(found), stored); err != nil {
+				t.Fatal(err)
+			}
+			if owned := metav1.IsControlledBy(stored, MacBook); owned != tt.wantOwned {
+				t.Errorf("deployment controlled by the MacBook = %v, want %v", owned, tt.wantOwned)
+			}
+		})
+	}
+}
+
+func TestClaimService(t *testing.T) {
+	tests := []struct {
+		name       string
+		selector   map[string]string
+		wantReason string
+	}{
+		{"service selecting the MacBook's pods is adopted", map[string]string{tools.AppLabel: "mac"}, ""},
+		// blue/green 的颜色不参与比较
+		{"color is ignored", map[string]string{tools.AppLabel: "mac", tools.ColorLabel: tools.ColorGreen}, ""},
+		{"service of other pods is incompatible", map[string]string{tools.AppLabel: "legacy"}, "AdoptionIncompatible"},
+		{"service without a selector is incompatible", nil, "AdoptionIncompatible"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.Adopt = true
+			svc := tools.NewService(MacBook)
+			found := svc.DeepCopy()
+			found.Spec.Selector = tt.selector
+			r := newFakeReconciler(t, found.DeepCopy())
+			ctx := context.Background()
+			if err := r.Get(ctx, client.ObjectKeyFromObject(found), found); err != nil {
+				t.Fatal(err)
+			}
+
+			rerr := r.claimService(ctx, ctrl.Log, MacBook, svc, found)
+
+			if tt.wantReason == "" && rerr != nil || tt.wantReason != "" && (rerr == nil || rerr.reason != tt.wantReason) {
+				t.Fatalf("claimService error = %v, want %q", rerr, tt.wantReason)
+			}
+			stored := &corev1.Service{}
+			if err := r.Get(ctx, client.ObjectKeyFromObject(found), stored); err != nil {
+				t.Fatal(err)
+			}
+			if owned := metav1.IsControlledBy(stored, MacBook); owned != (tt.wantReason == "") {
+				t.Errorf("service controlled by the MacBook = %v, want %v", owned, tt.wantReason == "")
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
@@ -0,0 +1,196 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/analysis"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// defaultAnalysisInterval 分析步骤两次测量之间的默认间隔
+	defaultAnalysisInterval = time.Minute
+	// defaultAnalysisCount 分析通过需要的默认成功次数
+	defaultAnalysisCount = 3
+	// analysisConsecutiveErrorLimit 连续这么多次无法查询指标时分析失败，偶尔的查询错误不影响结果
+	analysisConsecutiveErrorLimit = 5
+	// analysisQueryTimeout 单个查询的超时时间
+	analysisQueryTimeout = 10 * time.Second
+	// analysisMeasurementTimeout 一次测量所有查询的总时间，查询在调协的 worker 中同步执行，不能长时间占用
+	analysisMeasurementTimeout = 20 * time.Second
+)
+
+// runAnalysis 执行 canary 的分析步骤，每个间隔测量一次，结果写入 status.canary.analysis。
+// 返回 Running 表示还需要继续测量，Successful 表示通过，Failed 表示需要终止 canary
+func (r *MacBookReconciler) runAnalysis(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, step *mockv1beta1.AnalysisStep, now metav1.Time) string {
+	st := MacBook.Status.Canary
+	as := st.Analysis
+	if as == nil || as.Step != st.CurrentStep {
+		as = &mockv1beta1.AnalysisStatus{Step: st.CurrentStep, Phase: mockv1beta1.AnalysisPhaseRunning}
+		st.Analysis = as
+	}
+	if as.Phase != mockv1beta1.AnalysisPhaseRunning {
+		return as.Phase
+	}
+
+	cfg := canaryStrategy(MacBook).Analysis
+	if cfg == nil {
+		as.Phase = mockv1beta1.AnalysisPhaseFailed
+		as.Message = "spec.strategy.canary.analysis is not set"
+		return as.Phase
+	}
+	interval := defaultAnalysisInterval
+	if step.Interval != nil {
+		interval = step.Interval.Duration
+	}
+	count, failureLimit := int32(defaultAnalysisCount), int32(0)
+	if step.Count != nil {
+		count = *step.Count
+	}
+	if step.FailureLimit != nil {
+		failureLimit = *step.FailureLimit
+	}
+
+	// 还没到下一次测量的时间
+	if as.LastMeasuredAt != nil {
+		if wait := interval - now.Sub(as.LastMeasuredAt.Time); wait > 0 {
+			requeueAfter(ctx, wait)
+			return as.Phase
+		}
+	}
+
+	mctx, cancel := context.WithTimeout(ctx, analysisMeasurementTimeout)
+	results, outcome := r.measure(mctx, MacBook, cfg)
+	cancel()
+	as.Metrics = results
+	as.LastMeasuredAt = &now
+	switch outcome {
+	case mockv1beta1.AnalysisPhaseSuccessful:
+		as.Successful++
+		as.ConsecutiveErrors = 0
+	case mockv1beta1.AnalysisPhaseFailed:
+		as.Failed++
+		as.ConsecutiveErrors = 0
+	default:
+		as.ConsecutiveErrors++
+	}
+	clog.Info("canary analysis measured", "step", as.Step, "outcome", outcome, "successful", as.Successful, "failed", as.Failed)
+
+	switch {
+	case as.Failed > failureLimit:
+		as.Phase = mockv1beta1.AnalysisPhaseFailed
+		as.Message = fmt.Sprintf("%d measurements failed, limit is %d: %s", as.Failed, failureLimit, describeFailures(results))
+	case as.ConsecutiveErrors >= analysisConsecutiveErrorLimit:
+		as.Phase = mockv1beta1.AnalysisPhaseFailed
+		as.Message = fmt.Sprintf("%d measurements in a row could not query the metrics: %s", as.ConsecutiveErrors, describeFailures(results))
+	case as.Successful >= count:
+		as.Phase = mockv1beta1.AnalysisPhaseSuccessful
+		as.Message = fmt.Sprintf("%d/%d measurements successful", as.Successful, count)
+	default:
+		as.Message = fmt.Sprintf("%d/%d measurements successful, next at %s", as.Successful, count, now.Add(interval).Format(time.RFC3339))
+		requeueAfter(ctx, interval)
+	}
+	return as.Phase
+}
+
+// measure 查询所有指标，任意一个超出范围测量即失败；没有失败但有查询错误时结果为 Error。
+// ctx 到期后剩下的指标不再查询，记为 Error
+func (r *MacBookReconciler) measure(ctx context.Context, MacBook *mockv1beta1.MacBook, cfg *mockv1beta1.CanaryAnalysis) ([]mockv1beta1.MetricResult, string) {
+	results := make([]mockv1beta1.MetricResult, 0, len(cfg.Metrics))
+	prom, err := analysis.NewPrometheus(cfg.Address)
+	if err != nil {
+		for _, m := range cfg.Metrics {
+			results = append(results, mockv1beta1.MetricResult{Name: m.Name, Phase: mockv1beta1.AnalysisPhaseError, Message: err.Error()})
+		}
+		return results, mockv1beta1.AnalysisPhaseError
+	}
+
+	replacer := strings.NewReplacer(
+		"{{namespace}}", MacBook.Namespace,
+		"{{name}}", MacBook.Name,
+		"{{canary}}", tools.CanaryName(MacBook),
+	)
+	outcome := mockv1beta1.AnalysisPhaseSuccessful
+	for _, m := range cfg.Metrics {
+		result := mockv1beta1.MetricResult{Name: m.Name}
+		if err := ctx.Err(); err != nil {
+			result.Phase = mockv1beta1.AnalysisPhaseError
+			result.Message = fmt.Sprintf("not queried: %v", err)
+			if outcome == mockv1beta1.AnalysisPhaseSuccessful {
+				outcome = mockv1beta1.AnalysisPhaseError
+			}
+			results = append(results, result)
+			continue
+		}
+		qctx, cancel := context.WithTimeout(ctx, analysisQueryTimeout)
+		value, err := prom.Query(qctx, replacer.Replace(m.Query))
+		cancel()
+		if err != nil {
+			result.Phase = mockv1beta1.AnalysisPhaseError
+			result.Message = err.Error()
+			if outcome == mockv1beta1.AnalysisPhaseSuccessful {
+				outcome = mockv1beta1.AnalysisPhaseError
+			}
+			results = append(results, result)
+			continue
+		}
+
+		result.Value = strconv.FormatFloat(value, 'g', -1, 64)
+		threshold := analysis.Threshold{Min: quantityFloat(m.Min), Max: quantityFloat(m.Max)}
+		if err := threshold.Check(value); err != nil {
+			result.Phase = mockv1beta1.AnalysisPhaseFailed
+			result.Message = err.Error()
+			outcome = mockv1beta1.AnalysisPhaseFailed
+		} else {
+			result.Phase = mockv1beta1.AnalysisPhaseSuccessful
+		}
+		results = append(results, result)
+	}
+	return results, outcome
+}
+
+// describeFailures 把失败和出错的指标拼成一条消息
+func describeFailures(results []mockv1beta1.MetricResult) string {
+	var msgs []string
+	for _, res := range results {
+		if res.Phase != mockv1beta1.AnalysisPhaseSuccessful {
+			msgs = append(msgs, fmt.Sprintf("%s %s (%s)", res.Name, strings.ToLower(res.Phase), res.Message))
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func quantityFloat(q *resource.Quantity) *float64 {
+	if q == nil {
+		return nil
+	}
+	f, err := strconv.ParseFloat(q.AsDec().String(), 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
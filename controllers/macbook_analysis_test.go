@@ -0,0 +1,256 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// fakeAnalysisPrometheus 对 success-rate 查询返回 value，value 为空时返回查询错误
+func fakeAnalysisPrometheus(value string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if value == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"unavailable"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"scalar","result":[1620000000,%q]}}`, value)
+	}))
+}
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func TestRunAnalysis(t *testing.T) {
+	now := metav1.NewTime(time.Date(2021, 6, 20, 10, 0, 0, 0, time.UTC))
+	justMeasured := metav1.NewTime(now.Add(-10 * time.Second))
+	longAgo := metav1.NewTime(now.Add(-2 * time.Minute))
+
+	tests := []struct {
+		name string
+		// value 为 success-rate 的值，空字符串表示 Prometheus 返回错误
+		value        string
+		step         mockv1beta1.AnalysisStep
+		prev         *mockv1beta1.AnalysisStatus
+		wantPhase    string
+		wantSuccess  int32
+		wantFailed   int32
+		wantErrors   int32
+		wantRequeue  time.Duration
+		wantMeasured bool
+	}{
+		{
+			name:         "first measurement keeps running",
+			value:        "0.999",
+			wantPhase:    mockv1beta1.AnalysisPhaseRunning,
+			wantSuccess:  1,
+			wantRequeue:  defaultAnalysisInterval,
+			wantMeasured: true,
+		},
+		{
+			name:         "enough successful measurements pass",
+			value:        "0.999",
+			step:         mockv1beta1.AnalysisStep{Count: int32Ptr(2)},
+			prev:         &mockv1beta1.AnalysisStatus{Phase: mockv1beta1.AnalysisPhaseRunning, Successful: 1, LastMeasuredAt: &longAgo},
+			wantPhase:    mockv1beta1.AnalysisPhaseSuccessful,
+			wantSuccess:  2,
+			wantMeasured: true,
+		},
+		{
+			name:         "measurement out of threshold fails",
+			value:        "0.5",
+			wantPhase:    mockv1beta1.AnalysisPhaseFailed,
+			wantFailed:   1,
+			wantMeasured: true,
+		},
+		{
+			name:         "failures within the limit keep running",
+			value:        "0.5",
+			step:         mockv1beta1.AnalysisStep{FailureLimit: int32Ptr(1)},
+			wantPhase:    mockv1beta1.AnalysisPhaseRunning,
+			wantFailed:   1,
+			wantRequeue:  defaultAnalysisInterval,
+			wantMeasured: true,
+		},
+		{
+			name:         "inconclusive measurement keeps running",
+			value:        "",
+			wantPhase:    mockv1beta1.AnalysisPhaseRunning,
+			wantErrors:   1,
+			wantRequeue:  defaultAnalysisInterval,
+			wantMeasured: true,
+		},
+		{
+			name:         "too many inconclusive measurements fail",
+			value:        "",
+			prev:         &mockv1beta1.AnalysisStatus{Phase: mockv1beta1.AnalysisPhaseRunning, ConsecutiveErrors: analysisConsecutiveErrorLimit - 1, LastMeasuredAt: &longAgo},
+			wantPhase:    mockv1beta1.AnalysisPhaseFailed,
+			wantErrors:   analysisConsecutiveErrorLimit,
+			wantMeasured: true,
+		},
+		{
+			name:        "waits for the interval",
+			value:       "0.999",
+			prev:        &mockv1beta1.AnalysisStatus{Phase: mockv1beta1.AnalysisPhaseRunning, Successful: 1, LastMeasuredAt: &justMeasured},
+			wantPhase:   mockv1beta1.AnalysisPhaseRunning,
+			wantSuccess: 1,
+			wantRequeue: defaultAnalysisInterval - 10*time.Second,
+		},
+		{
+			name:        "finished analysis is not measured again",
+			value:       "0.5",
+			prev:        &mockv1beta1.AnalysisStatus{Phase: mockv1beta1.AnalysisPhaseSuccessful, Successful: 3, LastMeasuredAt: &longAgo},
+			wantPhase:   mockv1beta1.AnalysisPhaseSuccessful,
+			wantSuccess: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakeAnalysisPrometheus(tt.value)
+			defer server.Close()
+
+			min := resource.MustParse("0.99")
+			MacBook := &mockv1beta1.MacBook{
+				ObjectMeta: metav1.ObjectMeta{Name: "mac", Namespace: "default"},
+				Spec: mockv1beta1.MacBookSpec{
+					Strategy: &mockv1beta1.RolloutStrategy{Canary: &mockv1beta1.CanaryStrategy{
+						Analysis: &mockv1beta1.CanaryAnalysis{
+							Address: server.URL,
+							Metrics: []mockv1beta1.AnalysisMetric{{Name: "success-rate", Query: "success_rate", Min: &min}},
+						},
+					}},
+				},
+				Status: mockv1beta1.MacBookStatus{Canary: &mockv1beta1.CanaryStatus{Analysis: tt.prev}},
+			}
+			r := &MacBookReconciler{}
+			ctx := withRequeue(context.Background())
+
+			phase := r.runAnalysis(ctx, ctrl.Log, MacBook, &tt.step, now)
+
+			as := MacBook.Status.Canary.Analysis
+			if phase != tt.wantPhase || as.Phase != tt.wantPhase {
+				t.Errorf("phase = %s (status %s), want %s", phase, as.Phase, tt.wantPhase)
+			}
+			if as.Successful != tt.wantSuccess || as.Failed != tt.wantFailed || as.ConsecutiveErrors != tt.wantErrors {
+				t.Errorf("successful/failed/errors = %d/%d/%d, want %d/%d/%d",
+					as.Successful, as.Failed, as.ConsecutiveErrors, tt.wantSuccess, tt.wantFailed, tt.wantErrors)
+			}
+			if measured := as.LastMeasuredAt != nil && as.LastMeasuredAt.Equal(&now); measured != tt.wantMeasured {
+				t.Errorf("measured = %v, want %v", measured, tt.wantMeasured)
+			}
+			if got := requeueResult(ctx).RequeueAfter; got != tt.wantRequeue {
+				t.Errorf("requeue after %s, want %s", got, tt.wantRequeue)
+			}
+		})
+	}
+}
+
+func TestCanarySteps(t *testing.T) {
+	analysis := &mockv1beta1.CanaryAnalysis{Address: "http://prometheus:9090"}
+	tests := []struct {
+		name     string
+		strategy mockv1beta1.CanaryStrategy
+		want     []string
+	}{
+		{"default weight", mockv1beta1.CanaryStrategy{}, []string{"setWeight"}},
+		{"analysis appended", mockv1beta1.CanaryStrategy{Analysis: analysis}, []string{"setWeight", "analysis"}},
+		{
+			"explicit analysis step kept",
+			mockv1beta1.CanaryStrategy{
+				Analysis: analysis,
+				Steps:    []mockv1beta1.CanaryStep{{Analysis: &mockv1beta1.AnalysisStep{}}, {SetWeight: int32Ptr(50)}},
+			},
+			[]string{"analysis", "setWeight"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, step := range canarySteps(&tt.strategy) {
+				switch {
+				case step.SetWeight != nil:
+					got = append(got, "setWeight")
+				case step.Analysis != nil:
+					got = append(got, "analysis")
+				default:
+					got = append(got, "pause")
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("steps = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeasureStopsAtDeadline(t *testing.T) {
+	var queries int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		select {
+		case <-req.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"scalar","result":[1620000000,"1"]}}`)
+	}))
+	defer slow.Close()
+	cfg := &mockv1beta1.CanaryAnalysis{
+		Address: slow.URL,
+		Metrics: []mockv1beta1.AnalysisMetric{
+			{Name: "success-rate", Query: "rate"},
+			{Name: "latency", Query: "latency"},
+			{Name: "errors", Query: "errors"},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	results, outcome := newFakeReconciler(t).measure(ctx, newTestMacBook(), cfg)
+
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("measure took %s, want it to stop at the deadline", elapsed)
+	}
+	if outcome != mockv1beta1.AnalysisPhaseError {
+		t.Errorf("outcome = %s, want %s", outcome, mockv1beta1.AnalysisPhaseError)
+	}
+	if len(results) != len(cfg.Metrics) {
+		t.Fatalf("%d results, want one per metric", len(results))
+	}
+	for _, res := range results {
+		if res.Phase != mockv1beta1.AnalysisPhaseError {
+			t.Errorf("metric %s = %s, want %s", res.Name, res.Phase, mockv1beta1.AnalysisPhaseError)
+		}
+	}
+	// 到期后剩下的指标不再查询
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%d queries sent, want 1", n)
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// defaultScaleDownDelay spec.strategy.blueGreen.scaleDownDelay 为空时旧颜色保留的时间
+const defaultScaleDownDelay = 30 * time.Second
+
+func blueGreenStrategy(MacBook *mockv1beta1.MacBook) *mockv1beta1.BlueGreenStrategy {
+	if MacBook.Spec.Strategy == nil {
+		return nil
+	}
+	return MacBook.Spec.Strategy.BlueGreen
+}
+
+// blueGreenStatus 配置了 blue/green 策略并且已经开始管理颜色时返回发布状态
+func blueGreenStatus(MacBook *mockv1beta1.MacBook) *mockv1beta1.BlueGreenStatus {
+	if blueGreenStrategy(MacBook) == nil {
+		return nil
+	}
+	return MacBook.Status.BlueGreen
+}
+
+// reconcileBlueGreen blue/green 发布：active 颜色的 deployment 运行可用版本，新的模板在另一个颜色上完整预览，
+// 预览就绪（并且手动确认）后由 reconcileService 把 service 切换过去，旧颜色保留 scaleDownDelay 以便立即回滚
+func (r *MacBookReconciler) reconcileBlueGreen(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, templateHash string, scaled bool) *reconcileError {
+	MacBook.Status.Canary = nil
+	// 之前 canary 留下的 deployment 没有颜色标签，不会被 service 选中，直接删除
+	if rerr := r.deleteDeployment(ctx, clog, MacBook, tools.CanaryName(MacBook), ""); rerr != nil {
+		return rerr
+	}
+
+	good := MacBook.Status.LastKnownGood
+	st := MacBook.Status.BlueGreen
+	if st == nil {
+		st = &mockv1beta1.BlueGreenStatus{
+			ActiveColor:        tools.ColorBlue,
+			ActiveTemplateHash: templateHash,
+			Phase:              mockv1beta1.BlueGreenPhaseActive,
+		}
+		// 已经有可用版本时先保持它，新的模板走预览
+		if good != nil {
+			st.ActiveTemplateHash = good.TemplateHash
+		}
+		MacBook.Status.BlueGreen = st
+	}
+	// active 的模板只能来自当前 spec 或者最近一次可用版本，都不是时（例如第一次发布还没完成就修改了 spec）直接在 active 上滚动
+	if st.ActiveTemplateHash != templateHash && (good == nil || good.TemplateHash != st.ActiveTemplateHash) {
+		st.ActiveTemplateHash = templateHash
+	}
+	// 用户修改了模板，重新尝试新的版本
+	if failed := MacBook.Status.FailedRevision; failed != nil && failed.TemplateHash != templateHash {
+		MacBook.Status.FailedRevision = nil
+	}
+
+	source := MacBook
+	if st.ActiveTemplateHash != templateHash {
+		source = MacBook.DeepCopy()
+		source.Spec = *good.Spec.DeepCopy()
+	}
+	active := injectConsumedEnv(ctx, tools.NewColorDeployMent(source, classFrom(ctx), st.ActiveColor))
+	if err := controllerutil.SetControllerReference(MacBook, active, r.Scheme); err != nil {
+		return terminalError("SetControllerReferenceFailed", err)
+	}
+	found, rerr := r.applyDeployment(ctx, clog, MacBook, active, scaled, true)
+	if rerr != nil {
+		return rerr
+	}
+	MacBook.Status.Mod = active.Name
+
+	rerr = r.stepBlueGreen(ctx, clog, MacBook, templateHash, found)
+	// 汇总 pod 状态到 MacBook status，预览失败时也要更新
+	if err := r.updatePodStatus(ctx, MacBook, found); err != nil && rerr == nil {
+		rerr = err
+	}
+	return rerr
+}
+
+// stepBlueGreen 推进 blue/green 发布的状态机，结果写入 status.blueGreen
+func (r *MacBookReconciler) stepBlueGreen(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, templateHash string, active *appsv1.Deployment) *reconcileError {
+	strategy := blueGreenStrategy(MacBook)
+	st := MacBook.Status.BlueGreen
+	now := metav1.Now()
+	previewColor := tools.OtherColor(st.ActiveColor)
+	previewName := tools.ColorName(MacBook, previewColor)
+
+	if templateHash == st.ActiveTemplateHash {
+		st.PreviewTemplateHash = ""
+		st.Phase = mockv1beta1.BlueGreenPhaseActive
+		st.Message = ""
+		// 第一次发布或者在 active 上原地滚动完成，记为可用版本；模板被维护窗口暂缓时 active 运行的还是旧版本
+		if !templateHeld(MacBook) && active.Status.ObservedGeneration >= active.Generation && deploymentHealthy(active) {
+			if good := MacBook.Status.LastKnownGood; good == nil || good.TemplateHash != templateHash {
+				MacBook.Status.LastKnownGood = &mockv1beta1.KnownGoodRevision{
+					TemplateHash: templateHash,
+					Spec:         *MacBook.Spec.DeepCopy(),
+					Time:         now,
+				}
+				clog.Info("revision is healthy", "templateHash", templateHash)
+			}
+		}
+		return r.scaleDownPrevious(ctx, clog, MacBook, previewName)
+	}
+
+	if failed := MacBook.Status.FailedRevision; failed != nil && failed.TemplateHash == templateHash {
+		if rerr := r.deleteDeployment(ctx, clog, MacBook, previewName, ""); rerr != nil {
+			return rerr
+		}
+		return terminalError("RevisionFailed", fmt.Errorf("revision %s failed with %s, keeping active revision %s until the spec changes",
+			failed.TemplateHash, failed.Reason, st.ActiveTemplateHash))
+	}
+
+	if st.PreviewTemplateHash != templateHash {
+		st.PreviewTemplateHash = templateHash
+		clog.Info("blue/green preview started", "templateHash", templateHash, "color", previewColor)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonPreviewStarted, "Previewing revision %s on deployment %s", templateHash, previewName)
+	}
+
+	if MacBook.Annotations[AbortAnnotation] == "true" {
+		if rerr := r.removeAnnotation(ctx, MacBook, AbortAnnotation); rerr != nil {
+			return rerr
+		}
+		return r.abortPreview(ctx, clog, MacBook, previewName, "Aborted", "aborted by the "+AbortAnnotation+" annotation")
+	}
+
+	preview := injectConsumedEnv(ctx, tools.NewColorDeployMent(MacBook, classFrom(ctx), previewColor))
+	if err := controllerutil.SetControllerReference(MacBook, preview, r.Scheme); err != nil {
+		return terminalError("SetControllerReferenceFailed", err)
+	}
+	found, rerr := r.applyDeployment(ctx, clog, MacBook, preview, true, false)
+	if rerr != nil {
+		return rerr
+	}
+	observed := found.Status.ObservedGeneration >= found.Generation
+	if observed {
+		waiting, rerr := r.waitingContainers(ctx, MacBook, tools.ColorPodSelector(MacBook, previewColor))
+		if rerr != nil {
+			return rerr
+		}
+		if reason, message := rolloutFailure(found, waiting); reason != "" {
+			return r.abortPreview(ctx, clog, MacBook, previewName, reason, message)
+		}
+	}
+	if !observed || !deploymentComplete(found) {
+		st.Phase = mockv1beta1.BlueGreenPhaseProgressing
+		st.Message = fmt.Sprintf("waiting for preview deployment %s to become ready", previewName)
+		return nil
+	}
+	// 副本数为 0 时预览没有运行过，不能切换并记为可用版本
+	if !deploymentHealthy(found) {
+		st.Phase = mockv1beta1.BlueGreenPhaseProgressing
+		st.Message = fmt.Sprintf("preview deployment %s has no replicas to verify", previewName)
+		return nil
+	}
+
+	// 回到切换前的版本并且旧颜色还在运行，属于回滚，不需要再次确认
+	rollback := templateHash == st.PreviousTemplateHash && st.ScaleDownAt != nil
+	_, promote := MacBook.Annotations[PromoteAnnotation]
+	if !strategy.AutoPromote && !rollback && !promote {
+		st.Phase = mockv1beta1.BlueGreenPhasePaused
+		st.Message = "preview is ready, waiting for the " + PromoteAnnotation + " annotation"
+		return nil
+	}
+	// 自动切换要等维护窗口，回滚和手动确认不受限制
+	if strategy.AutoPromote && !rollback && !promote && changesHeld(MacBook) {
+		holdChange(MacBook, fmt.Sprintf("switch of service %s to revision %s", MacBook.Name, templateHash))
+		st.Phase = mockv1beta1.BlueGreenPhasePaused
+		st.Message = "preview is ready, waiting for the next maintenance window"
+		return nil
+	}
+	if rerr := r.removeAnnotation(ctx, MacBook, PromoteAnnotation); rerr != nil {
+		return rerr
+	}
+
+	delay := defaultScaleDownDelay
+	if strategy.ScaleDownDelay != nil {
+		delay = strategy.ScaleDownDelay.Duration
+	}
+	scaleDownAt := metav1.NewTime(now.Add(delay))
+	clog.Info("switching service", "from", st.ActiveColor, "to", previewColor, "templateHash", templateHash)
+	r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonSwitched, "Switched service %s from %s (%s) to %s (%s)",
+		MacBook.Name, st.ActiveColor, st.ActiveTemplateHash, previewColor, templateHash)
+
+	st.PreviousTemplateHash = st.ActiveTemplateHash
+	st.ActiveColor = previewColor
+	st.ActiveTemplateHash = templateHash
+	st.PreviewTemplateHash = ""
+	st.Phase = mockv1beta1.BlueGreenPhaseActive
+	st.Message = ""
+	st.SwitchedAt = &now
+	st.ScaleDownAt = &scaleDownAt
+	MacBook.Status.LastKnownGood = &mockv1beta1.KnownGoodRevision{
+		TemplateHash: templateHash,
+		Spec:         *MacBook.Spec.DeepCopy(),
+		Time:         now,
+	}
+	MacBook.Status.Mod = found.Name
+	requeueAfter(ctx, delay)
+	return nil
+}
+
+// abortPreview 终止预览，记录失败版本，service 保持在 active 颜色
+func (r *MacBookReconciler) abortPreview(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, previewName, reason, message string) *reconcileError {
+	st := MacBook.Status.BlueGreen
+	st.Phase = mockv1beta1.BlueGreenPhaseAborted
+	st.Message = fmt.Sprintf("%s: %s", reason, message)
+	MacBook.Status.FailedRevision = &mockv1beta1.FailedRevision{
+		TemplateHash: st.PreviewTemplateHash,
+		Reason:       reason,
+		Message:      message,
+		Time:         metav1.Now(),
+	}
+	clog.Info("blue/green preview aborted", "templateHash", st.PreviewTemplateHash, "reason", reason)
+	r.recordEvent(ctx, MacBook, corev1.EventTypeWarning, EventReasonPreviewAborted, "Aborted preview of revision %s (%s: %s)", st.PreviewTemplateHash, reason, message)
+	st.PreviewTemplateHash = ""
+	return r.deleteDeployment(ctx, clog, MacBook, previewName, "")
+}
+
+// scaleDownPrevious 旧颜色保留到 scaleDownAt，之后删除
+func (r *MacBookReconciler) scaleDownPrevious(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, name string) *reconcileError {
+	st := MacBook.Status.BlueGreen
+	if st.ScaleDownAt != nil {
+		if remaining := time.Until(st.ScaleDownAt.Time); remaining > 0 {
+			st.Message = fmt.Sprintf("keeping previous deployment %s until %s", name, st.ScaleDownAt.Format(time.RFC3339))
+			requeueAfter(ctx, remaining)
+			return nil
+		}
+	}
+	if rerr := r.deleteDeployment(ctx, clog, MacBook, name, ""); rerr != nil {
+		return rerr
+	}
+	if st.ScaleDownAt != nil {
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonPreviousScaledDown, "Deleted previous deployment %s", name)
+		st.ScaleDownAt = nil
+	}
+	return nil
+}
+
+// cleanupBlueGreen 不再使用 blue/green 时，等 MacBook 同名的 deployment 滚动完成后删除 green deployment
+func (r *MacBookReconciler) cleanupBlueGreen(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, stable *appsv1.Deployment) *reconcileError {
+	MacBook.Status.BlueGreen = nil
+	if stable.Status.ObservedGeneration < stable.Generation || !deploymentComplete(stable) {
+		return nil
+	}
+	return r.deleteDeployment(ctx, clog, MacBook, tools.ColorName(MacBook, tools.ColorGreen), "")
+}
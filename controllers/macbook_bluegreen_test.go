@@ -0,0 +1,201 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestStepBlueGreen(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup 修改 MacBook 并返回集群中已有的其他对象
+		setup        func(MacBook *mockv1beta1.MacBook) []runtime.Object
+		templateHash string
+		wantPhase    string
+		wantActive   string
+		wantGood     string
+		wantFailed   string
+		wantTerminal bool
+		wantPreview  bool
+		wantRequeue  bool
+	}{
+		{
+			name:         "completed active revision is known good",
+			templateHash: "v1",
+			wantPhase:    mockv1beta1.BlueGreenPhaseActive,
+			wantActive:   tools.ColorBlue,
+			wantGood:     "v1",
+		},
+		{
+			name:         "new template is previewed",
+			templateHash: "v2",
+			wantPhase:    mockv1beta1.BlueGreenPhaseProgressing,
+			wantActive:   tools.ColorBlue,
+			wantPreview:  true,
+		},
+		{
+			name: "ready preview waits for promotion",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				return []runtime.Object{completeDeployment(MacBook, tools.NewColorDeployMent(MacBook, nil, tools.ColorGreen))}
+			},
+			templateHash: "v2",
+			wantPhase:    mockv1beta1.BlueGreenPhasePaused,
+			wantActive:   tools.ColorBlue,
+			wantPreview:  true,
+		},
+		{
+			name: "auto promote switches the service",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				MacBook.Spec.Strategy.BlueGreen.AutoPromote = true
+				return []runtime.Object{completeDeployment(MacBook, tools.NewColorDeployMent(MacBook, nil, tools.ColorGreen))}
+			},
+			templateHash: "v2",
+			wantPhase:    mockv1beta1.BlueGreenPhaseActive,
+			wantActive:   tools.ColorGreen,
+			wantGood:     "v2",
+			wantPreview:  true,
+			wantRequeue:  true,
+		},
+		{
+			name: "promote annotation switches the service",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				MacBook.Annotations = map[string]string{PromoteAnnotation: ""}
+				return []runtime.Object{completeDeployment(MacBook, tools.NewColorDeployMent(MacBook, nil, tools.ColorGreen))}
+			},
+			templateHash: "v2",
+			wantPhase:    mockv1beta1.BlueGreenPhaseActive,
+			wantActive:   tools.ColorGreen,
+			wantGood:     "v2",
+			wantPreview:  true,
+			wantRequeue:  true,
+		},
+		{
+			name: "rollback to the previous color needs no promotion",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				scaleDownAt := metav1.Now()
+				MacBook.Status.BlueGreen.PreviousTemplateHash = "v2"
+				MacBook.Status.BlueGreen.ScaleDownAt = &scaleDownAt
+				return []runtime.Object{completeDeployment(MacBook, tools.NewColorDeployMent(MacBook, nil, tools.ColorGreen))}
+			},
+			templateHash: "v2",
+			wantPhase:    mockv1beta1.BlueGreenPhaseActive,
+			wantActive:   tools.ColorGreen,
+			wantGood:     "v2",
+			wantPreview:  true,
+			wantRequeue:  true,
+		},
+		{
+			name: "active revision scaled to zero is not known good",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				MacBook.Spec.Replicas = int32Ptr(0)
+				return nil
+			},
+			templateHash: "v1",
+			wantPhase:    mockv1beta1.BlueGreenPhaseActive,
+			wantActive:   tools.ColorBlue,
+		},
+		{
+			// 预览没有运行过 pod，不切换 service
+			name: "preview scaled to zero is not switched",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				MacBook.Spec.Replicas = int32Ptr(0)
+				MacBook.Spec.Strategy.BlueGreen.AutoPromote = true
+				return []runtime.Object{completeDeployment(MacBook, tools.NewColorDeployMent(MacBook, nil, tools.ColorGreen))}
+			},
+			templateHash: "v2",
+			wantPhase:    mockv1beta1.BlueGreenPhaseProgressing,
+			wantActive:   tools.ColorBlue,
+			wantPreview:  true,
+		},
+		{
+			name: "crash looping preview is aborted",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				preview := tools.NewColorDeployMent(MacBook, nil, tools.ColorGreen)
+				return []runtime.Object{crashLoopingPod("mac-green-1", preview.Spec.Template.Labels)}
+			},
+			templateHash: "v2",
+			wantPhase:    mockv1beta1.BlueGreenPhaseAborted,
+			wantActive:   tools.ColorBlue,
+			wantFailed:   "v2",
+		},
+		{
+			name: "failed revision keeps the active color",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				MacBook.Status.FailedRevision = &mockv1beta1.FailedRevision{TemplateHash: "v2", Reason: rollbackReasonCrashLoop}
+				return []runtime.Object{completeDeployment(MacBook, tools.NewColorDeployMent(MacBook, nil, tools.ColorGreen))}
+			},
+			templateHash: "v2",
+			wantPhase:    mockv1beta1.BlueGreenPhaseActive,
+			wantActive:   tools.ColorBlue,
+			wantFailed:   "v2",
+			wantTerminal: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.Strategy = &mockv1beta1.RolloutStrategy{BlueGreen: &mockv1beta1.BlueGreenStrategy{}}
+			MacBook.Status.BlueGreen = &mockv1beta1.BlueGreenStatus{
+				ActiveColor:        tools.ColorBlue,
+				ActiveTemplateHash: "v1",
+				Phase:              mockv1beta1.BlueGreenPhaseActive,
+			}
+			objs := []runtime.Object{MacBook.DeepCopy()}
+			if tt.setup != nil {
+				objs = append(objs, tt.setup(MacBook)...)
+			}
+			r := newFakeReconciler(t, objs...)
+			active := completeDeployment(MacBook, tools.NewColorDeployMent(MacBook, nil, tools.ColorBlue))
+			ctx := withRequeue(context.Background())
+
+			rerr := r.stepBlueGreen(ctx, ctrl.Log, MacBook, tt.templateHash, active)
+
+			if terminal := rerr != nil && rerr.class == errorTerminal; terminal != tt.wantTerminal || rerr != nil && !terminal {
+				t.Fatalf("stepBlueGreen error = %v, want terminal %v", rerr, tt.wantTerminal)
+			}
+			st := MacBook.Status.BlueGreen
+			if st.Phase != tt.wantPhase || st.ActiveColor != tt.wantActive {
+				t.Errorf("phase/active = %s/%s, want %s/%s", st.Phase, st.ActiveColor, tt.wantPhase, tt.wantActive)
+			}
+			if good := MacBook.Status.LastKnownGood; tt.wantGood == "" && good != nil || tt.wantGood != "" && (good == nil || good.TemplateHash != tt.wantGood) {
+				t.Errorf("last known good = %+v, want %q", good, tt.wantGood)
+			}
+			if failed := MacBook.Status.FailedRevision; tt.wantFailed == "" && failed != nil || tt.wantFailed != "" && (failed == nil || failed.TemplateHash != tt.wantFailed) {
+				t.Errorf("failed revision = %+v, want %q", failed, tt.wantFailed)
+			}
+			preview := &appsv1.Deployment{}
+			err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: tools.ColorName(MacBook, tools.ColorGreen)}, preview)
+			if exists := err == nil; exists != tt.wantPreview {
+				t.Errorf("preview deployment exists = %v (%v), want %v", exists, err, tt.wantPreview)
+			}
+			if got := requeueResult(ctx).RequeueAfter; (got == defaultScaleDownDelay) != tt.wantRequeue {
+				t.Errorf("requeue after %s, want scale down delay %v", got, tt.wantRequeue)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// 通过 MacBook 上的注解手动推进或者终止发布，处理完后控制器会删除注解
+const (
+	// PromoteAnnotation 跳过当前步骤，值为 full 时跳过所有剩余步骤直接提升
+	PromoteAnnotation = "mock.dong.com/promote"
+	// AbortAnnotation 值为 true 时终止发布并恢复 stable 模板
+	AbortAnnotation = "mock.dong.com/abort"
+
+	promoteFull = "full"
+)
+
+func canaryStrategy(MacBook *mockv1beta1.MacBook) *mockv1beta1.CanaryStrategy {
+	if MacBook.Spec.Strategy == nil {
+		return nil
+	}
+	return MacBook.Spec.Strategy.Canary
+}
+
+// defaultCanaryWeight 没有配置步骤时 canary 的权重
+const defaultCanaryWeight = int32(20)
+
+// canarySteps 实际执行的步骤：没有配置步骤时按默认权重运行 canary；
+// 配置了分析但没有分析步骤时在最后追加一个，每次修改模板都经过分析才会提升
+func canarySteps(strategy *mockv1beta1.CanaryStrategy) []mockv1beta1.CanaryStep {
+	steps := strategy.Steps
+	if len(steps) == 0 {
+		weight := defaultCanaryWeight
+		steps = []mockv1beta1.CanaryStep{{SetWeight: &weight}}
+	}
+	if strategy.Analysis == nil {
+		return steps
+	}
+	for _, step := range steps {
+		if step.Analysis != nil {
+			return steps
+		}
+	}
+	return append(steps[:len(steps):len(steps)], mockv1beta1.CanaryStep{Analysis: &mockv1beta1.AnalysisStep{}})
+}
+
+// canaryInProgress 当前模板正在做 canary 发布
+func canaryInProgress(MacBook *mockv1beta1.MacBook, templateHash string) bool {
+	st := MacBook.Status.Canary
+	return canaryStrategy(MacBook) != nil && st != nil && st.TemplateHash == templateHash &&
+		(st.Phase == mockv1beta1.CanaryPhaseProgressing || st.Phase == mockv1beta1.CanaryPhasePaused)
+}
+
+// stepCanary 推进 canary 发布的状态机，结果写入 status.canary：
+// 所有步骤完成后把当前版本记为可用版本，之后 stable deployment 滚动到新模板；
+// 手动终止或者 canary 的 pod 失败时记录失败版本，和自动回滚一样保持 stable 模板直到 spec 再次修改
+func (r *MacBookReconciler) stepCanary(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, templateHash string) *reconcileError {
+	strategy := canaryStrategy(MacBook)
+	if strategy == nil {
+		MacBook.Status.Canary = nil
+		return nil
+	}
+	// 第一次部署没有 stable 版本，当前模板已经是 stable 或者已经失败过，都不需要 canary
+	good, failed := MacBook.Status.LastKnownGood, MacBook.Status.FailedRevision
+	if good == nil || good.TemplateHash == templateHash || (failed != nil && failed.TemplateHash == templateHash) {
+		return nil
+	}
+
+	now := metav1.Now()
+	st := MacBook.Status.Canary
+	if st == nil || st.TemplateHash != templateHash {
+		st = &mockv1beta1.CanaryStatus{
+			TemplateHash:  templateHash,
+			Phase:         mockv1beta1.CanaryPhaseProgressing,
+			StepStartedAt: &now,
+		}
+		MacBook.Status.Canary = st
+		clog.Info("canary started", "templateHash", templateHash, "stable", good.TemplateHash)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonCanaryStarted, "Started canary of revision %s against %s", templateHash, good.TemplateHash)
+	}
+	total := tools.DesiredReplicas(MacBook)
+	setCanaryReplicas(st, total)
+	// 副本数为 0 时 canary 没有 pod 可以验证，暂停到重新扩容，不提升为可用版本
+	if total == 0 {
+		st.Phase = mockv1beta1.CanaryPhaseProgressing
+		st.Message = "waiting for replicas, the MacBook is scaled to 0"
+		return nil
+	}
+
+	if MacBook.Annotations[AbortAnnotation] == "true" {
+		if rerr := r.removeAnnotation(ctx, MacBook, AbortAnnotation); rerr != nil {
+			return rerr
+		}
+		r.abortCanary(ctx, clog, MacBook, "Aborted", "aborted by the "+AbortAnnotation+" annotation")
+		return nil
+	}
+
+	canaryDep := &appsv1.Deployment{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: MacBook.Namespace, Name: tools.CanaryName(MacBook)}, canaryDep); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return classifyError("DeploymentGetFailed", err)
+		}
+		canaryDep = nil
+	}
+	if canaryDep != nil && canaryDep.Status.ObservedGeneration >= canaryDep.Generation {
+		// 只根据 canary 的 pod 判断，stable 的 pod 不影响 canary 的结果
+		waiting, rerr := r.waitingContainers(ctx, MacBook, tools.CanaryPodSelector(MacBook))
+		if rerr != nil {
+			return rerr
+		}
+		if reason, message := rolloutFailure(canaryDep, waiting); reason != "" {
+			r.abortCanary(ctx, clog, MacBook, reason, message)
+			return nil
+		}
+	}
+
+	promote := MacBook.Annotations[PromoteAnnotation]
+	if promote != "" {
+		if rerr := r.removeAnnotation(ctx, MacBook, PromoteAnnotation); rerr != nil {
+			return rerr
+		}
+	}
+
+	steps := canarySteps(strategy)
+	for promote != promoteFull && int(st.CurrentStep) < len(steps) {
+		step := steps[st.CurrentStep]
+		// 手动推进跳过当前步骤
+		if promote == "" {
+			switch {
+			case step.SetWeight != nil:
+				st.Weight = *step.SetWeight
+				setCanaryReplicas(st, total)
+				if !deploymentAvailable(canaryDep, st.CanaryReplicas) {
+					st.Phase = mockv1beta1.CanaryPhaseProgressing
+					st.Message = fmt.Sprintf("waiting for %d canary replicas at weight %d", st.CanaryReplicas, st.Weight)
+					return nil
+				}
+			case step.Pause != nil && step.Pause.Duration != nil:
+				remaining := step.Pause.Duration.Duration - now.Sub(st.StepStartedAt.Time)
+				if remaining > 0 {
+					st.Phase = mockv1beta1.CanaryPhaseProgressing
+					st.Message = fmt.Sprintf("paused until %s", now.Add(remaining).Format(time.RFC3339))
+					requeueAfter(ctx, remaining)
+					return nil
+				}
+			case step.Pause != nil:
+				st.Phase = mockv1beta1.CanaryPhasePaused
+				st.Message = "waiting for the " + PromoteAnnotation + " annotation"
+				return nil
+			case step.Analysis != nil:
+				// 按当前权重保持 canary，根据指标自动推进或者终止
+				switch r.runAnalysis(ctx, clog, MacBook, step.Analysis, now) {
+				case mockv1beta1.AnalysisPhaseFailed:
+					r.abortCanary(ctx, clog, MacBook, "AnalysisFailed", st.Analysis.Message)
+					return nil
+				case mockv1beta1.AnalysisPhaseRunning:
+					st.Phase = mockv1beta1.CanaryPhaseProgressing
+					st.Message = "analysis: " + st.Analysis.Message
+					return nil
+				}
+			}
+		}
+		promote = ""
+		clog.Info("canary step completed", "step", st.CurrentStep)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonCanaryStepCompleted, "Completed canary step %d at weight %d", st.CurrentStep, st.Weight)
+		st.CurrentStep++
+		st.StepStartedAt = &now
+	}
+
+	// 所有步骤完成，提升为 stable
+	st.Phase = mockv1beta1.CanaryPhaseCompleted
+	st.Weight = 100
+	st.Message = "promoted to stable"
+	setCanaryReplicas(st, total)
+	MacBook.Status.LastKnownGood = &mockv1beta1.KnownGoodRevision{
+		TemplateHash: templateHash,
+		Spec:         *MacBook.Spec.DeepCopy(),
+		Time:         now,
+	}
+	clog.Info("canary promoted", "templateHash", templateHash)
+	r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonCanaryPromoted, "Promoted revision %s to stable", templateHash)
+	return nil
+}
+
+// abortCanary 终止 canary，记录失败版本，之后 stable deployment 恢复全部副本
+func (r *MacBookReconciler) abortCanary(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, reason, message string) {
+	st := MacBook.Status.Canary
+	st.Phase = mockv1beta1.CanaryPhaseAborted
+	st.Message = fmt.Sprintf("%s: %s", reason, message)
+	st.Weight = 0
+	setCanaryReplicas(st, tools.DesiredReplicas(MacBook))
+	MacBook.Status.FailedRevision = &mockv1beta1.FailedRevision{
+		TemplateHash: st.TemplateHash,
+		Reason:       reason,
+		Message:      message,
+		Time:         metav1.Now(),
+	}
+	clog.Info("canary aborted", "templateHash", st.TemplateHash, "reason", reason)
+	r.recordEvent(ctx, MacBook, corev1.EventTypeWarning, EventReasonCanaryAborted, "Aborted canary of revision %s (%s: %s)", st.TemplateHash, reason, message)
+}
+
+// setCanaryReplicas 按权重拆分副本数，权重大于 0 时 canary 至少一个副本
+func setCanaryReplicas(st *mockv1beta1.CanaryStatus, total int32) {
+	canary := (total*st.Weight + 99) / 100
+	if canary > total {
+		canary = total
+	}
+	st.CanaryReplicas = canary
+	st.StableReplicas = total - canary
+}
+
+// deploymentAvailable deployment 已经处理了最新的 spec，并且有 want 个更新后的可用副本
+func deploymentAvailable(dep *appsv1.Deployment, want int32) bool {
+	if want == 0 {
+		return true
+	}
+	return dep != nil && dep.Status.ObservedGeneration >= dep.Generation &&
+		dep.Status.UpdatedReplicas >= want && dep.Status.AvailableReplicas >= want
+}
+
+// cleanupCanary canary 结束后删除 canary deployment。
+// 终止时立即删除；提升时等 stable deployment 滚动完成后再删除，避免容量下降
+func (r *MacBookReconciler) cleanupCanary(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, stable *appsv1.Deployment, rolledBack bool) *reconcileError {
+	if !rolledBack && (stable.Status.ObservedGeneration < stable.Generation || !deploymentComplete(stable)) {
+		return nil
+	}
+	return r.deleteDeployment(ctx, clog, MacBook, tools.CanaryName(MacBook), "")
+}
+
+// removeAnnotation 删除 MacBook 上的注解，表示手动操作已经处理
+func (r *MacBookReconciler) removeAnnotation(ctx context.Context, MacBook *mockv1beta1.MacBook, key string) *reconcileError {
+	if _, ok := MacBook.Annotations[key]; !ok {
+		return nil
+	}
+	// Update 会用 apiserver 的返回值覆盖对象，这里更新一个副本，只同步 metadata，
+	// 保留本次调协中对 status 的修改
+	updated := MacBook.DeepCopy()
+	delete(updated.Annotations, key)
+	if err := r.Update(ctx, updated); err != nil {
+		return classifyMacBookError("AnnotationUpdateFailed", err)
+	}
+	MacBook.ObjectMeta = updated.ObjectMeta
+	return nil
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestSetCanaryReplicas(t *testing.T) {
+	tests := []struct {
+		weight, total          int32
+		wantCanary, wantStable int32
+	}{
+		{0, 10, 0, 10},
+		{20, 10, 2, 8},
+		{25, 10, 3, 7},
+		{1, 3, 1, 2},
+		{50, 1, 1, 0},
+		{100, 4, 4, 0},
+		{20, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		st := &mockv1beta1.CanaryStatus{Weight: tt.weight}
+		setCanaryReplicas(st, tt.total)
+		if st.CanaryReplicas != tt.wantCanary || st.StableReplicas != tt.wantStable {
+			t.Errorf("weight %d of %d: canary/stable = %d/%d, want %d/%d",
+				tt.weight, tt.total, st.CanaryReplicas, st.StableReplicas, tt.wantCanary, tt.wantStable)
+		}
+	}
+}
+
+func TestDeploymentAvailable(t *testing.T) {
+	tests := []struct {
+		name string
+		dep  *appsv1.Deployment
+		want int32
+		ok   bool
+	}{
+		{"nothing wanted", nil, 0, true},
+		{"missing deployment", nil, 1, false},
+		{"available", &appsv1.Deployment{Status: appsv1.DeploymentStatus{UpdatedReplicas: 2, AvailableReplicas: 2}}, 2, true},
+		{"not yet available", &appsv1.Deployment{Status: appsv1.DeploymentStatus{UpdatedReplicas: 2, AvailableReplicas: 1}}, 2, false},
+		{
+			"spec not observed",
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Generation: 2},
+				Status:     appsv1.DeploymentStatus{ObservedGeneration: 1, UpdatedReplicas: 2, AvailableReplicas: 2},
+			},
+			2,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deploymentAvailable(tt.dep, tt.want); got != tt.ok {
+				t.Errorf("deploymentAvailable = %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestStepCanary(t *testing.T) {
+	minute := metav1.Duration{Duration: time.Minute}
+	steps := []mockv1beta1.CanaryStep{
+		{SetWeight: int32Ptr(20)},
+		{Pause: &mockv1beta1.CanaryPause{}},
+		{SetWeight: int32Ptr(50)},
+		{Pause: &mockv1beta1.CanaryPause{Duration: &minute}},
+	}
+	// canaryWithAvailable MacBook 拥有的 canary deployment，有 n 个可用副本
+	canaryWithAvailable := func(MacBook *mockv1beta1.MacBook, n int32) runtime.Object {
+		dep := completeDeployment(MacBook, tools.NewCanaryDeployMent(MacBook, nil))
+		dep.Spec.Replicas = &n
+		dep.Status = appsv1.DeploymentStatus{Replicas: n, UpdatedReplicas: n, AvailableReplicas: n}
+		return dep
+	}
+	tests := []struct {
+		name string
+		// setup 修改 MacBook 并返回集群中已有的其他对象
+		setup       func(MacBook *mockv1beta1.MacBook) []runtime.Object
+		noKnownGood bool
+		wantPhase   string
+		wantStep    int32
+		wantWeight  int32
+		wantCanary  int32
+		wantGood    string
+		wantFailed  bool
+		wantRequeue bool
+	}{
+		{
+			name:        "first deployment has no canary",
+			noKnownGood: true,
+		},
+		{
+			name:       "new template waits for canary replicas",
+			wantPhase:  mockv1beta1.CanaryPhaseProgressing,
+			wantWeight: 20,
+			wantCanary: 2,
+			wantGood:   "v1",
+		},
+		{
+			name: "available canary moves on to the pause",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				return []runtime.Object{canaryWithAvailable(MacBook, 2)}
+			},
+			wantPhase:  mockv1beta1.CanaryPhasePaused,
+			wantStep:   1,
+			wantWeight: 20,
+			wantCanary: 2,
+			wantGood:   "v1",
+		},
+		{
+			name: "promote annotation skips the pause",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				MacBook.Annotations = map[string]string{PromoteAnnotation: "true"}
+				MacBook.Status.Canary = &mockv1beta1.CanaryStatus{TemplateHash: "v2", CurrentStep: 1, Weight: 20}
+				return []runtime.Object{canaryWithAvailable(MacBook, 2)}
+			},
+			wantPhase:  mockv1beta1.CanaryPhaseProgressing,
+			wantStep:   2,
+			wantWeight: 50,
+			wantCanary: 5,
+			wantGood:   "v1",
+		},
+		{
+			name: "timed pause requeues",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				started := metav1.Now()
+				MacBook.Status.Canary = &mockv1beta1.CanaryStatus{TemplateHash: "v2", CurrentStep: 3, Weight: 50, StepStartedAt: &started}
+				return []runtime.Object{canaryWithAvailable(MacBook, 5)}
+			},
+			wantPhase:   mockv1beta1.CanaryPhaseProgressing,
+			wantStep:    3,
+			wantWeight:  50,
+			wantCanary:  5,
+			wantGood:    "v1",
+			wantRequeue: true,
+		},
+		{
+			name: "full promotion completes the canary",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				MacBook.Annotations = map[string]string{PromoteAnnotation: promoteFull}
+				return nil
+			},
+			wantPhase:  mockv1beta1.CanaryPhaseCompleted,
+			wantWeight: 100,
+			wantCanary: 10,
+			wantGood:   "v2",
+		},
+		{
+			name: "crash looping canary is aborted",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				canary := tools.NewCanaryDeployMent(MacBook, nil)
+				return []runtime.Object{canaryWithAvailable(MacBook, 2), crashLoopingPod("mac-canary-1", canary.Spec.Template.Labels)}
+			},
+			wantPhase:  mockv1beta1.CanaryPhaseAborted,
+			wantGood:   "v1",
+			wantFailed: true,
+		},
+		{
+			// 没有 pod 可以验证，不提升为可用版本
+			name: "canary waits while scaled to zero",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				MacBook.Spec.Replicas = int32Ptr(0)
+				MacBook.Annotations = map[string]string{PromoteAnnotation: promoteFull}
+				return nil
+			},
+			wantPhase:  mockv1beta1.CanaryPhaseProgressing,
+			wantWeight: 0,
+			wantGood:   "v1",
+		},
+		{
+			name: "crash looping stable pods do not abort the canary",
+			setup: func(MacBook *mockv1beta1.MacBook) []runtime.Object {
+				stable := tools.NewDeployMent(MacBook, nil)
+				return []runtime.Object{canaryWithAvailable(MacBook, 2), crashLoopingPod("mac-1", stable.Spec.Template.Labels)}
+			},
+			wantPhase:  mockv1beta1.CanaryPhasePaused,
+			wantStep:   1,
+			wantWeight: 20,
+			wantCanary: 2,
+			wantGood:   "v1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.Replicas = int32Ptr(10)
+			MacBook.Spec.Strategy = &mockv1beta1.RolloutStrategy{Canary: &mockv1beta1.CanaryStrategy{Steps: steps}}
+			if !tt.noKnownGood {
+				MacBook.Status.LastKnownGood = &mockv1beta1.KnownGoodRevision{TemplateHash: "v1"}
+			}
+			objs := []runtime.Object{MacBook.DeepCopy()}
+			if tt.setup != nil {
+				objs = append(objs, tt.setup(MacBook)...)
+			}
+			r := newFakeReconciler(t, objs...)
+			ctx := withRequeue(context.Background())
+
+			if rerr := r.stepCanary(ctx, ctrl.Log, MacBook, "v2"); rerr != nil {
+				t.Fatal(rerr)
+			}
+
+			st := MacBook.Status.Canary
+			if tt.wantPhase == "" {
+				if st != nil {
+					t.Errorf("status.canary = %+v, want none", st)
+				}
+				return
+			}
+			if st == nil {
+				t.Fatal("status.canary not set")
+			}
+			if st.Phase != tt.wantPhase || st.CurrentStep != tt.wantStep || st.Weight != tt.wantWeight {
+				t.Errorf("phase/step/weight = %s/%d/%d, want %s/%d/%d", st.Phase, st.CurrentStep, st.Weight, tt.wantPhase, tt.wantStep, tt.wantWeight)
+			}
+			total := tools.DesiredReplicas(MacBook)
+			if st.CanaryReplicas != tt.wantCanary || st.StableReplicas != total-tt.wantCanary {
+				t.Errorf("canary/stable replicas = %d/%d, want %d/%d", st.CanaryReplicas, st.StableReplicas, tt.wantCanary, total-tt.wantCanary)
+			}
+			if good := MacBook.Status.LastKnownGood; good == nil || good.TemplateHash != tt.wantGood {
+				t.Errorf("last known good = %+v, want %s", good, tt.wantGood)
+			}
+			if failed := MacBook.Status.FailedRevision != nil; failed != tt.wantFailed {
+				t.Errorf("failed revision recorded = %v, want %v", failed, tt.wantFailed)
+			}
+			if requeue := requeueResult(ctx).RequeueAfter > 0; requeue != tt.wantRequeue {
+				t.Errorf("requeue = %v, want %v", requeue, tt.wantRequeue)
+			}
+		})
+	}
+}
+
+func TestServiceSelectsMacBookPods(t *testing.T) {
+	MacBook := newTestMacBook()
+	// 名称恰好是 mac-api 的另一个 MacBook
+	other := newTestMacBook()
+	other.Name = "mac-api"
+	hook, err := tools.NewHookJob(MacBook, mockv1beta1.HookPreDeploy, &mockv1beta1.Hook{}, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   bool
+	}{
+		{"stable pod", tools.NewDeployMent(MacBook, nil).Spec.Template.Labels, true},
+		{"canary pod", tools.NewCanaryDeployMent(MacBook, nil).Spec.Template.Labels, true},
+		{"component pod", tools.NewComponentDeployMent(MacBook, &mockv1beta1.Component{Name: "api", Image: "api"}).Spec.Template.Labels, false},
+		{"hook pod", hook.Spec.Template.Labels, false},
+		{"pod of another MacBook", tools.NewDeployMent(other, nil).Spec.Template.Labels, false},
+		{"other workload with the same app label", map[string]string{tools.AppLabel: MacBook.Name}, false},
+	}
+	selector := labels.SelectorFromSet(tools.NewService(MacBook).Spec.Selector)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selector.Matches(labels.Set(tt.labels)); got != tt.want {
+				t.Errorf("service selects %v = %v, want %v", tt.labels, got, tt.want)
+			}
+		})
+	}
+}
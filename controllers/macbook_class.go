@@ -0,0 +1,145 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// classKey MacBook 上 spec.className 的索引，没有设置 className 的 MacBook 索引值为空字符串
+const classKey = ".spec.className"
+
+type classKeyType struct{}
+
+// withClass 把本次调协使用的 class 放入 ctx，生成 deployment 的地方通过 classFrom 取出
+func withClass(ctx context.Context, class *mockv1beta1.MacBookClass) context.Context {
+	return context.WithValue(ctx, classKeyType{}, class)
+}
+
+// classFrom 返回本次调协使用的 class，没有 class 时为 nil
+func classFrom(ctx context.Context) *mockv1beta1.MacBookClass {
+	class, _ := ctx.Value(classKeyType{}).(*mockv1beta1.MacBookClass)
+	return class
+}
+
+// errMultipleDefaultClasses 有多个 class 标记为默认
+var errMultipleDefaultClasses = errors.New("multiple MacBookClasses are marked as default")
+
+// resolveClass 找到 MacBook 使用的 class，并检查 MacBook 只覆盖了 class 允许的设置
+func (r *MacBookReconciler) resolveClass(ctx context.Context, MacBook *mockv1beta1.MacBook) (*mockv1beta1.MacBookClass, *reconcileError) {
+	class, err := findClass(ctx, r.Client, MacBook)
+	switch {
+	// class 创建后通过索引触发调协
+	case apierrors.IsNotFound(err):
+		return nil, terminalError("ClassNotFound", fmt.Errorf("MacBookClass %s not found", MacBook.Spec.ClassName))
+	case errors.Is(err, errMultipleDefaultClasses):
+		return nil, terminalError("MultipleDefaultClasses", fmt.Errorf("%w, set spec.className", err))
+	case err != nil:
+		return nil, classifyError("ClassGetFailed", err)
+	case class == nil:
+		return nil, nil
+	}
+
+	if err := checkOverrides(MacBook, class); err != nil {
+		return nil, terminalError("OverrideNotAllowed", err)
+	}
+	return class, nil
+}
+
+// findClass 返回 spec.className 指定的 class，没有指定时返回标记为默认的 class，都没有时返回 nil
+func findClass(ctx context.Context, c client.Reader, MacBook *mockv1beta1.MacBook) (*mockv1beta1.MacBookClass, error) {
+	class := &mockv1beta1.MacBookClass{}
+	if name := MacBook.Spec.ClassName; name != "" {
+		if err := c.Get(ctx, client.ObjectKey{Name: name}, class); err != nil {
+			return nil, err
+		}
+		return class, nil
+	}
+
+	list := &mockv1beta1.MacBookClassList{}
+	if err := c.List(ctx, list); err != nil {
+		return nil, err
+	}
+	var defaults []string
+	for i := range list.Items {
+		if list.Items[i].Annotations[mockv1beta1.DefaultClassAnnotation] == "true" {
+			class = &list.Items[i]
+			defaults = append(defaults, class.Name)
+		}
+	}
+	switch len(defaults) {
+	case 0:
+		return nil, nil
+	case 1:
+		return class, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errMultipleDefaultClasses, strings.Join(defaults, ", "))
+	}
+}
+
+// checkOverrides MacBook 设置了 class 没有允许覆盖的字段时返回错误
+func checkOverrides(MacBook *mockv1beta1.MacBook, class *mockv1beta1.MacBookClass) error {
+	allowed := make(map[mockv1beta1.ClassOverride]bool, len(class.Spec.AllowedOverrides))
+	for _, o := range class.Spec.AllowedOverrides {
+		allowed[o] = true
+	}
+	spec := MacBook.Spec
+	var denied []string
+	if registry := tools.ImageRegistry(spec.Image); class.Spec.ImageRegistry != "" && registry != "" &&
+		!strings.HasPrefix(spec.Image, strings.TrimSuffix(class.Spec.ImageRegistry, "/")+"/") && !allowed[mockv1beta1.OverrideRegistry] {
+		denied = append(denied, fmt.Sprintf("image registry %s", registry))
+	}
+	if spec.Resources != nil && !allowed[mockv1beta1.OverrideResources] {
+		denied = append(denied, "spec.resources")
+	}
+	if (spec.LivenessProbe != nil || spec.ReadinessProbe != nil) && !allowed[mockv1beta1.OverrideProbes] {
+		denied = append(denied, "probes")
+	}
+	if spec.SecurityContext != nil && !allowed[mockv1beta1.OverrideSecurityContext] {
+		denied = append(denied, "spec.securityContext")
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("MacBookClass %s does not allow overriding %s", class.Name, strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// classToMacBooks class 修改后通过索引找到使用它的 MacBook 重新调协。
+// 默认 class 的标记可能刚被加上或去掉，没有设置 className 的 MacBook 也要重新调协
+func (r *MacBookReconciler) classToMacBooks(obj client.Object) []reconcile.Request {
+	var requests []reconcile.Request
+	for _, name := range []string{obj.GetName(), ""} {
+		list := &mockv1beta1.MacBookList{}
+		if err := r.List(context.Background(), list, client.MatchingFields{classKey: name}); err != nil {
+			r.Log.Error(err, "unable to list MacBooks of class", "class", obj.GetName())
+			return nil
+		}
+		for i := range list.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&list.Items[i])})
+		}
+	}
+	return requests
+}
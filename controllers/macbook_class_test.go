@@ -0,0 +1,204 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func newTestClass(name string, isDefault bool) *mockv1beta1.MacBookClass {
+	class := &mockv1beta1.MacBookClass{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if isDefault {
+		class.Annotations = map[string]string{mockv1beta1.DefaultClassAnnotation: "true"}
+	}
+	return class
+}
+
+func TestResolveClass(t *testing.T) {
+	tests := []struct {
+		name       string
+		className  string
+		classes    []runtime.Object
+		wantClass  string
+		wantReason string
+	}{
+		{
+			name:    "no class",
+			classes: []runtime.Object{newTestClass("standard", false)},
+		},
+		{
+			name:      "class by name",
+			className: "standard",
+			classes:   []runtime.Object{newTestClass("standard", false), newTestClass("small", true)},
+			wantClass: "standard",
+		},
+		{
+			name:      "default class",
+			classes:   []runtime.Object{newTestClass("standard", false), newTestClass("small", true)},
+			wantClass: "small",
+		},
+		{
+			name:       "missing class",
+			className:  "large",
+			classes:    []runtime.Object{newTestClass("small", true)},
+			wantReason: "ClassNotFound",
+		},
+		{
+			name:       "multiple default classes",
+			classes:    []runtime.Object{newTestClass("standard", true), newTestClass("small", true)},
+			wantReason: "MultipleDefaultClasses",
+		},
+		{
+			name:      "explicit class ignores multiple defaults",
+			className: "small",
+			classes:   []runtime.Object{newTestClass("standard", true), newTestClass("small", true)},
+			wantClass: "small",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.ClassName = tt.className
+			r := newFakeReconciler(t, tt.classes...)
+
+			class, rerr := r.resolveClass(context.Background(), MacBook)
+
+			if tt.wantReason != "" {
+				if rerr == nil || rerr.class != errorTerminal || rerr.reason != tt.wantReason {
+					t.Fatalf("resolveClass error = %v, want terminal %s", rerr, tt.wantReason)
+				}
+				return
+			}
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			name := ""
+			if class != nil {
+				name = class.Name
+			}
+			if name != tt.wantClass {
+				t.Errorf("class = %q, want %q", name, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestCheckOverrides(t *testing.T) {
+	probe := &corev1.Probe{InitialDelaySeconds: 10}
+	tests := []struct {
+		name    string
+		allowed []mockv1beta1.ClassOverride
+		// setup 修改 MacBook 的 spec
+		setup   func(spec *mockv1beta1.MacBookSpec)
+		wantErr bool
+	}{
+		{
+			name: "class defaults only",
+		},
+		{
+			name: "image without a registry",
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.Image = "nginx"
+			},
+		},
+		{
+			name: "image from the class registry",
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.Image = "registry.example.com/nginx"
+			},
+		},
+		{
+			name: "image from another registry",
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.Image = "other.example.com/nginx"
+			},
+			wantErr: true,
+		},
+		{
+			name:    "another registry is allowed",
+			allowed: []mockv1beta1.ClassOverride{mockv1beta1.OverrideRegistry},
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.Image = "other.example.com/nginx"
+			},
+		},
+		{
+			name: "resources",
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.Resources = &corev1.ResourceRequirements{}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "resources are allowed",
+			allowed: []mockv1beta1.ClassOverride{mockv1beta1.OverrideResources},
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.Resources = &corev1.ResourceRequirements{}
+			},
+		},
+		{
+			name: "readiness probe",
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.ReadinessProbe = probe
+			},
+			wantErr: true,
+		},
+		{
+			name:    "probes are allowed",
+			allowed: []mockv1beta1.ClassOverride{mockv1beta1.OverrideProbes},
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.LivenessProbe = probe
+				spec.ReadinessProbe = probe
+			},
+		},
+		{
+			name: "security context",
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.SecurityContext = &corev1.SecurityContext{}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "only the allowed override passes",
+			allowed: []mockv1beta1.ClassOverride{mockv1beta1.OverrideSecurityContext},
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.SecurityContext = &corev1.SecurityContext{}
+				spec.Resources = &corev1.ResourceRequirements{}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class := newTestClass("standard", false)
+			class.Spec.ImageRegistry = "registry.example.com"
+			class.Spec.AllowedOverrides = tt.allowed
+			MacBook := newTestMacBook()
+			if tt.setup != nil {
+				tt.setup(&MacBook.Spec)
+			}
+			if err := checkOverrides(MacBook, class); (err != nil) != tt.wantErr {
+				t.Errorf("checkOverrides error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
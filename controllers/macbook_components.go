@@ -0,0 +1,143 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// reconcileComponents 为 spec.components 中的每个组件创建或修正 deployment 和 service，
+// 删除已经移除的组件，并把组件的就绪状态合并到 MacBook 的 Ready condition。
+// scaled 为 true 表示休眠修改了副本数，不算漂移
+func (r *MacBookReconciler) reconcileComponents(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, scaled bool) *reconcileError {
+	MacBook.Status.Components = nil
+	var notReady []string
+	for i := range MacBook.Spec.Components {
+		c := &MacBook.Spec.Components[i]
+		dep := injectConsumedEnv(ctx, tools.NewComponentDeployMent(MacBook, c))
+		if err := controllerutil.SetControllerReference(MacBook, dep, r.Scheme); err != nil {
+			return terminalError("SetControllerReferenceFailed", err)
+		}
+		found, rerr := r.applyDeployment(ctx, clog, MacBook, dep, scaled, true)
+		if rerr != nil {
+			return rerr
+		}
+
+		name := tools.ComponentName(MacBook, c.Name)
+		if len(c.Ports) == 0 {
+			// 没有端口的组件（例如 worker）不需要 service
+			if rerr := r.deleteService(ctx, clog, MacBook, name, c.Name); rerr != nil {
+				return rerr
+			}
+		} else {
+			svc := tools.NewComponentService(MacBook, c)
+			if err := controllerutil.SetControllerReference(MacBook, svc, r.Scheme); err != nil {
+				return terminalError("SetControllerReferenceFailed", err)
+			}
+			if rerr := r.applyService(ctx, clog, MacBook, svc); rerr != nil {
+				return rerr
+			}
+		}
+
+		st := componentStatus(c.Name, found)
+		if !st.Ready {
+			notReady = append(notReady, c.Name)
+		}
+		MacBook.Status.Components = append(MacBook.Status.Components, st)
+	}
+
+	if rerr := r.pruneComponents(ctx, clog, MacBook); rerr != nil {
+		return rerr
+	}
+
+	// MacBook 自己的 pod 就绪后还要等所有组件就绪
+	if len(notReady) > 0 && meta.IsStatusConditionTrue(MacBook.Status.Conditions, mockv1beta1.ConditionReady) {
+		meta.SetStatusCondition(&MacBook.Status.Conditions, metav1.Condition{
+			Type:               mockv1beta1.ConditionReady,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: MacBook.Generation,
+			Reason:             "ComponentsNotReady",
+			Message:            fmt.Sprintf("components not ready: %s", strings.Join(notReady, ", ")),
+		})
+	}
+	return nil
+}
+
+// validateComponents 组件的 deployment 和 service 名称为 <name>-<component>，
+// canary、green 和 preview 会和 canary、blue/green 使用的对象重名
+func validateComponents(MacBook *mockv1beta1.MacBook) *reconcileError {
+	for _, c := range MacBook.Spec.Components {
+		if tools.ReservedComponentName(MacBook, c.Name) {
+			return terminalError("InvalidComponent", fmt.Errorf("component name %q is reserved: %s is used by canary and blue/green rollouts",
+				c.Name, tools.ComponentName(MacBook, c.Name)))
+		}
+	}
+	return nil
+}
+
+// componentStatus 组件的 deployment 已经处理了最新的模板，所有副本都已更新并可用时就绪
+func componentStatus(name string, dep *appsv1.Deployment) mockv1beta1.ComponentStatus {
+	st := mockv1beta1.ComponentStatus{Name: name, Replicas: 1}
+	if dep.Spec.Replicas != nil {
+		st.Replicas = *dep.Spec.Replicas
+	}
+	st.ReadyReplicas = dep.Status.ReadyReplicas
+	if st.ReadyReplicas > dep.Status.UpdatedReplicas {
+		st.ReadyReplicas = dep.Status.UpdatedReplicas
+	}
+	st.Ready = dep.Status.ObservedGeneration >= dep.Generation && deploymentComplete(dep) && st.ReadyReplicas >= st.Replicas
+	return st
+}
+
+// pruneComponents 删除 spec.components 中已经不存在的组件的 deployment 和 service
+func (r *MacBookReconciler) pruneComponents(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) *reconcileError {
+	wanted := make(map[string]bool, len(MacBook.Spec.Components))
+	for _, c := range MacBook.Spec.Components {
+		wanted[c.Name] = true
+	}
+	depList := &appsv1.DeploymentList{}
+	if err := r.List(ctx, depList, client.InNamespace(MacBook.Namespace), client.MatchingLabels{tools.MacBookLabel: MacBook.Name}); err != nil {
+		return classifyError("DeploymentListFailed", err)
+	}
+	for i := range depList.Items {
+		dep := &depList.Items[i]
+		component, ok := dep.Labels[tools.ComponentLabel]
+		if !ok || wanted[component] || !metav1.IsControlledBy(dep, MacBook) {
+			continue
+		}
+		if rerr := r.deleteDeployment(ctx, clog, MacBook, dep.Name, component); rerr != nil {
+			return rerr
+		}
+		if rerr := r.deleteService(ctx, clog, MacBook, dep.Name, component); rerr != nil {
+			return rerr
+		}
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonComponentDeleted, "Deleted component %s removed from spec.components", component)
+	}
+	return nil
+}
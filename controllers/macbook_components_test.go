@@ -0,0 +1,104 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestValidateComponents(t *testing.T) {
+	tests := []struct {
+		component string
+		wantErr   bool
+	}{
+		{"api", false},
+		{"worker", false},
+		{"canary", true},
+		{"green", true},
+		{"preview", true},
+		{"blue", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.component, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.Components = []mockv1beta1.Component{{Name: tt.component, Image: "busybox"}}
+			rerr := validateComponents(MacBook)
+			if (rerr != nil) != tt.wantErr || rerr != nil && rerr.class != errorTerminal {
+				t.Errorf("validateComponents(%s) = %v, want error %v", tt.component, rerr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestComponentSelector(t *testing.T) {
+	web := newTestMacBook()
+	web.Name = "web"
+	api := &mockv1beta1.Component{Name: "api", Image: "api"}
+	// 名称恰好是 web-api 的另一个 MacBook
+	other := newTestMacBook()
+	other.Name = "web-api"
+
+	selector := labels.SelectorFromSet(tools.NewComponentService(web, api).Spec.Selector)
+	if !selector.Matches(labels.Set(tools.NewComponentDeployMent(web, api).Spec.Template.Labels)) {
+		t.Error("component service does not select the component pods")
+	}
+	if selector.Matches(labels.Set(tools.NewDeployMent(other, nil).Spec.Template.Labels)) {
+		t.Error("component service selects the pods of MacBook web-api")
+	}
+	depSelector := labels.SelectorFromSet(tools.NewComponentDeployMent(web, api).Spec.Selector.MatchLabels)
+	if depSelector.Matches(labels.Set(tools.NewDeployMent(other, nil).Spec.Template.Labels)) {
+		t.Error("component deployment selects the pods of MacBook web-api")
+	}
+	podLabels := tools.NewComponentDeployMent(web, api).Spec.Template.Labels
+	if labels.SelectorFromSet(tools.NewService(other).Spec.Selector).Matches(labels.Set(podLabels)) {
+		t.Error("service of MacBook web-api selects the component pods")
+	}
+	if _, ok := podLabels[tools.AppLabel]; ok {
+		t.Errorf("component pods have the %s label: %v", tools.AppLabel, podLabels)
+	}
+}
+
+func TestRolloutCleanupKeepsComponents(t *testing.T) {
+	MacBook := newTestMacBook()
+	// 组件 canary 的 deployment 和 canary deployment 同名
+	component := completeDeployment(MacBook, tools.NewComponentDeployMent(MacBook, &mockv1beta1.Component{Name: "canary", Image: "busybox"}))
+	stable := completeDeployment(MacBook, tools.NewDeployMent(MacBook, nil))
+	r := newFakeReconciler(t, component, stable)
+	ctx := context.Background()
+
+	if rerr := r.cleanupCanary(ctx, ctrl.Log, MacBook, stable, true); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if rerr := r.cleanupBlueGreen(ctx, ctrl.Log, MacBook, stable); rerr != nil {
+		t.Fatal(rerr)
+	}
+	err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: tools.CanaryName(MacBook)}, &appsv1.Deployment{})
+	if apierrors.IsNotFound(err) {
+		t.Error("canary cleanup deleted the deployment of a component")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+}
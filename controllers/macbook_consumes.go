@@ -0,0 +1,163 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// consumesKey MacBook 上 spec.consumes 的索引，值为使用的 service 的 namespace/name
+const consumesKey = ".spec.consumes"
+
+type consumedEnvKeyType struct{}
+
+// withConsumedEnv 把本次调协注入的环境变量放入 ctx，生成 deployment 的地方通过 injectConsumedEnv 使用
+func withConsumedEnv(ctx context.Context, env []corev1.EnvVar) context.Context {
+	return context.WithValue(ctx, consumedEnvKeyType{}, env)
+}
+
+// injectConsumedEnv 把 spec.consumes 的环境变量加到 deployment 的每个容器中，容器自己设置的同名变量优先。
+// 环境变量是 pod 模板的一部分，service 的端口变化后模板哈希随之变化，pod 滚动更新
+func injectConsumedEnv(ctx context.Context, dep *appsv1.Deployment) *appsv1.Deployment {
+	mergeConsumedEnv(ctx, dep.Spec.Template.Spec.Containers)
+	return dep
+}
+
+// mergeConsumedEnv 把 spec.consumes 的环境变量加到每个容器中，hook 的 job 也使用
+func mergeConsumedEnv(ctx context.Context, containers []corev1.Container) {
+	env, _ := ctx.Value(consumedEnvKeyType{}).([]corev1.EnvVar)
+	if len(env) == 0 {
+		return
+	}
+	for i := range containers {
+		defined := make(map[string]bool, len(containers[i].Env))
+		for _, e := range containers[i].Env {
+			defined[e.Name] = true
+		}
+		merged := append([]corev1.EnvVar(nil), containers[i].Env...)
+		for _, e := range env {
+			if !defined[e.Name] {
+				merged = append(merged, e)
+			}
+		}
+		containers[i].Env = merged
+	}
+}
+
+// validateConsumes 不同的 MacBook 转换成同一个环境变量前缀时变量会互相覆盖，例如 a/db 和 b/db
+func validateConsumes(MacBook *mockv1beta1.MacBook) *reconcileError {
+	seen := make(map[string]types.NamespacedName, len(MacBook.Spec.Consumes))
+	for _, ref := range MacBook.Spec.Consumes {
+		key := referenceKey(MacBook, ref)
+		prefix := envPrefix(key.Name)
+		if other, ok := seen[prefix]; ok && other != key {
+			return terminalError("InvalidConsumes", fmt.Errorf("consumed MacBooks %s and %s both use the environment variable prefix %s", other, key, prefix))
+		}
+		seen[prefix] = key
+	}
+	return nil
+}
+
+// resolveConsumes 读取 spec.consumes 中每个 MacBook 的 service，生成 HOST、PORT 和 URL 环境变量，
+// service 是否都存在写入 WaitingForServices condition。service 不存在时无法生成变量，返回 true，
+// 本次调协不把 pod 滚动到缺少变量的模板，service 创建后通过索引重新调协
+func (r *MacBookReconciler) resolveConsumes(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) ([]corev1.EnvVar, bool, *reconcileError) {
+	if len(MacBook.Spec.Consumes) == 0 {
+		removeCondition(&MacBook.Status.Conditions, mockv1beta1.ConditionWaitingForServices)
+		return nil, false, nil
+	}
+
+	var env []corev1.EnvVar
+	var missing []string
+	for _, ref := range MacBook.Spec.Consumes {
+		key := referenceKey(MacBook, ref)
+		svc := &corev1.Service{}
+		if err := r.Get(ctx, key, svc); err != nil {
+			if apierrors.IsNotFound(err) {
+				missing = append(missing, key.String())
+				continue
+			}
+			return nil, false, classifyError("ConsumedServiceGetFailed", err)
+		}
+		if len(svc.Spec.Ports) == 0 {
+			return nil, false, terminalError("ConsumedServiceNoPorts", fmt.Errorf("service %s of consumed MacBook %s has no ports", key, key.Name))
+		}
+		port := svc.Spec.Ports[0]
+		for _, p := range svc.Spec.Ports {
+			if p.Name == "http" {
+				port = p
+				break
+			}
+		}
+		prefix := envPrefix(key.Name)
+		host := fmt.Sprintf("%s.%s.svc", key.Name, key.Namespace)
+		env = append(env,
+			corev1.EnvVar{Name: prefix + "_HOST", Value: host},
+			corev1.EnvVar{Name: prefix + "_PORT", Value: strconv.Itoa(int(port.Port))},
+			corev1.EnvVar{Name: prefix + "_URL", Value: fmt.Sprintf("http://%s:%d", host, port.Port)},
+		)
+	}
+
+	cond := metav1.Condition{
+		Type:               mockv1beta1.ConditionWaitingForServices,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: MacBook.Generation,
+		Reason:             "ServicesFound",
+	}
+	if len(missing) > 0 {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "ServicesNotFound"
+		cond.Message = fmt.Sprintf("services of consumed MacBooks not found: %s", strings.Join(missing, ", "))
+		clog.Info("waiting for consumed services", "missing", missing)
+	}
+	meta.SetStatusCondition(&MacBook.Status.Conditions, cond)
+	return env, len(missing) > 0, nil
+}
+
+// envPrefix MacBook 名称转换成环境变量的前缀，例如 order-db 为 ORDER_DB
+func envPrefix(name string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// serviceToConsumers service 创建或端口变化后通过索引找到使用它的 MacBook 重新调协
+func (r *MacBookReconciler) serviceToConsumers(obj client.Object) []reconcile.Request {
+	list := &mockv1beta1.MacBookList{}
+	key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	if err := r.List(context.Background(), list, client.MatchingFields{consumesKey: key.String()}); err != nil {
+		r.Log.Error(err, "unable to list consuming MacBooks", "service", key)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for i := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&list.Items[i])})
+	}
+	return requests
+}
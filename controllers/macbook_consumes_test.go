@@ -0,0 +1,183 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestValidateConsumes(t *testing.T) {
+	tests := []struct {
+		name     string
+		consumes []mockv1beta1.MacBookReference
+		wantErr  bool
+	}{
+		{"different names", []mockv1beta1.MacBookReference{{Name: "order-db"}, {Name: "payments", Namespace: "billing"}}, false},
+		{"same MacBook twice", []mockv1beta1.MacBookReference{{Name: "db"}, {Name: "db", Namespace: "default"}}, false},
+		{"same name in another namespace", []mockv1beta1.MacBookReference{{Name: "db"}, {Name: "db", Namespace: "billing"}}, true},
+		{"names with the same prefix", []mockv1beta1.MacBookReference{{Name: "order-db"}, {Name: "order.db"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.Consumes = tt.consumes
+			rerr := validateConsumes(MacBook)
+			if (rerr != nil) != tt.wantErr || rerr != nil && rerr.class != errorTerminal {
+				t.Errorf("validateConsumes error = %v, want terminal error %v", rerr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveConsumes(t *testing.T) {
+	service := func(namespace, name string, ports ...corev1.ServicePort) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec:       corev1.ServiceSpec{Ports: ports},
+		}
+	}
+	tests := []struct {
+		name       string
+		consumes   []mockv1beta1.MacBookReference
+		objs       []runtime.Object
+		wantEnv    map[string]string
+		wantWait   bool
+		wantReason string
+	}{
+		{
+			name: "nothing consumed",
+		},
+		{
+			name:     "services found",
+			consumes: []mockv1beta1.MacBookReference{{Name: "order-db"}, {Name: "payments", Namespace: "billing"}},
+			objs: []runtime.Object{
+				service("default", "order-db", corev1.ServicePort{Name: "sql", Port: 5432}),
+				service("billing", "payments", corev1.ServicePort{Name: "grpc", Port: 9090}, corev1.ServicePort{Name: "http", Port: 80}),
+			},
+			wantEnv: map[string]string{
+				"ORDER_DB_HOST": "order-db.default.svc",
+				"ORDER_DB_PORT": "5432",
+				"ORDER_DB_URL":  "http://order-db.default.svc:5432",
+				"PAYMENTS_HOST": "payments.billing.svc",
+				"PAYMENTS_PORT": "80",
+				"PAYMENTS_URL":  "http://payments.billing.svc:80",
+			},
+			wantReason: "ServicesFound",
+		},
+		{
+			name:       "missing service waits",
+			consumes:   []mockv1beta1.MacBookReference{{Name: "order-db"}, {Name: "payments"}},
+			objs:       []runtime.Object{service("default", "order-db", corev1.ServicePort{Port: 5432})},
+			wantWait:   true,
+			wantReason: "ServicesNotFound",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.Consumes = tt.consumes
+			r := newFakeReconciler(t, tt.objs...)
+
+			env, wait, rerr := r.resolveConsumes(context.Background(), ctrl.Log, MacBook)
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			if wait != tt.wantWait {
+				t.Errorf("wait = %v, want %v", wait, tt.wantWait)
+			}
+			if !wait {
+				got := map[string]string{}
+				for _, e := range env {
+					got[e.Name] = e.Value
+				}
+				if len(got) != len(tt.wantEnv) {
+					t.Errorf("env = %v, want %v", got, tt.wantEnv)
+				}
+				for k, v := range tt.wantEnv {
+					if got[k] != v {
+						t.Errorf("%s = %q, want %q", k, got[k], v)
+					}
+				}
+			}
+			cond := meta.FindStatusCondition(MacBook.Status.Conditions, mockv1beta1.ConditionWaitingForServices)
+			switch {
+			case tt.wantReason == "" && cond != nil:
+				t.Errorf("condition = %+v, want none", cond)
+			case tt.wantReason != "" && (cond == nil || cond.Reason != tt.wantReason):
+				t.Errorf("condition = %+v, want reason %s", cond, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestInjectConsumedEnv(t *testing.T) {
+	MacBook := newTestMacBook()
+	dep := tools.NewDeployMent(MacBook, nil)
+	dep.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "DB_HOST", Value: "localhost"}}
+	dep.Spec.Template.Spec.Containers = append(dep.Spec.Template.Spec.Containers, corev1.Container{Name: "sidecar"})
+	ctx := withConsumedEnv(context.Background(), []corev1.EnvVar{{Name: "DB_HOST", Value: "db.default.svc"}, {Name: "DB_PORT", Value: "80"}})
+
+	containers := injectConsumedEnv(ctx, dep).Spec.Template.Spec.Containers
+
+	// 容器自己设置的同名变量优先
+	if env := containers[0].Env; len(env) != 2 || env[0].Value != "localhost" || env[1].Name != "DB_PORT" {
+		t.Errorf("web container env = %v", env)
+	}
+	if env := containers[1].Env; len(env) != 2 || env[0].Value != "db.default.svc" {
+		t.Errorf("sidecar env = %v", env)
+	}
+}
+
+// TestConsumedDependencyWaits MacBook 同时依赖并使用 db，db 的 service 还不存在时等待依赖而不是报告错误
+func TestConsumedDependencyWaits(t *testing.T) {
+	MacBook := newTestMacBook()
+	MacBook.Spec.Image = "nginx"
+	MacBook.Spec.DependsOn = []mockv1beta1.MacBookReference{{Name: "db"}}
+	MacBook.Spec.Consumes = []mockv1beta1.MacBookReference{{Name: "db"}}
+	db := &mockv1beta1.MacBook{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+	r := newFakeReconciler(t, MacBook.DeepCopy(), db)
+	ctx := context.Background()
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(MacBook)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(MacBook), MacBook); err != nil {
+		t.Fatal(err)
+	}
+	if meta.IsStatusConditionTrue(MacBook.Status.Conditions, mockv1beta1.ConditionDegraded) {
+		t.Errorf("MacBook is degraded: %+v", MacBook.Status.LastError)
+	}
+	if !meta.IsStatusConditionTrue(MacBook.Status.Conditions, mockv1beta1.ConditionWaitingForDependencies) {
+		t.Errorf("conditions = %+v, want waiting for dependencies", MacBook.Status.Conditions)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(MacBook), &appsv1.Deployment{}); !apierrors.IsNotFound(err) {
+		t.Errorf("deployment created while waiting: %v", err)
+	}
+}
@@ -19,18 +19,32 @@ package controllers
 import (
 	mockv1beta1 "alex-opr/api/v1beta1"
 	"alex-opr/controllers/tools"
+	"alex-opr/controllers/tracing"
 	"context"
+	"errors"
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"time"
 )
 
@@ -42,6 +56,13 @@ type MacBookReconciler struct {
 	Scheme *runtime.Scheme
 	// 添加事件记录器
 	Recorder record.EventRecorder
+	// MaintenanceConfig 全局维护窗口所在的 ConfigMap，为空时只使用 MacBook 自己声明的窗口
+	MaintenanceConfig types.NamespacedName
+	// APIReader 不经过缓存直接读取 apiserver，用于 spec.waitFor 等待的对象
+	APIReader client.Reader
+
+	// waitForWatches spec.waitFor 引用的 kind 的 watch，SetupWithManager 中创建
+	waitForWatches *waitForWatches
 }
 
 // 注意权限管理，进行相关权限给予
@@ -49,9 +70,18 @@ type MacBookReconciler struct {
 //+kubebuilder:rbac:groups=mock.dong.com,resources=macbooks,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=mock.dong.com,resources=macbooks/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=mock.dong.com,resources=macbooks/finalizers,verbs=update
+//+kubebuilder:rbac:groups=mock.dong.com,resources=macbookrevisions,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=mock.dong.com,resources=macbookrevisions/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=mock.dong.com,resources=macbookclasses,verbs=get;list;watch
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=deployments/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=events,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;update;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -62,8 +92,25 @@ type MacBookReconciler struct {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.7.2/pkg/reconcile
-func (r *MacBookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	clog := r.Log.WithValues("macbook", req.NamespacedName)
+func (r *MacBookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, reterr error) {
+	// 每次调协生成一个 trace，client 的每次调用都是它的子 span
+	ctx, span := tracing.Tracer().Start(ctx, "MacBook.Reconcile", trace.WithAttributes(
+		attribute.String("k8s.namespace", req.Namespace),
+		attribute.String("k8s.name", req.Name),
+	))
+	defer func() {
+		if reterr != nil {
+			span.RecordError(reterr)
+			span.SetStatus(codes.Error, reterr.Error())
+		}
+		span.End()
+	}()
+
+	// 各个步骤通过 requeueAfter 请求定时重新调协，例如 canary 的暂停步骤
+	ctx = withRequeue(ctx)
+
+	// 日志中带上 traceID，方便和 trace 对应起来
+	clog := r.Log.WithValues("macbook", req.NamespacedName).WithValues(tracing.LogValues(ctx)...)
 
 	/*
 		获取调协的crd实例
@@ -72,14 +119,17 @@ func (r *MacBookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	// 实例出一个空的对象
 	MacBook := &mockv1beta1.MacBook{}
 	// client/Reader 接口 调用get方法从api中获取创建的对象
-	err := r.Get(context.TODO(), req.NamespacedName, MacBook)
+	err := r.Get(ctx, req.NamespacedName, MacBook)
 	if err != nil {
+		// 对象已经被删除属于可忽略的错误，其余错误交给 workqueue 退避重试
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
 		return ctrl.Result{}, err
-	} else {
-		clog.Info("find MacBook !", "MacBook-Annotations", MacBook.Annotations)
 	}
-
-	r.Recorder.Event(MacBook, "Normal", "BeginReconcile", "开始调协了")
+	clog.Info("find MacBook !", "MacBook-Annotations", MacBook.Annotations)
+	// 记录调协前的 status，结束时只有发生变化才更新
+	before := MacBook.Status.DeepCopy()
 
 	/*
 		finalizers 处理
@@ -97,46 +147,224 @@ func (r *MacBookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		if !containsString(MacBook.GetFinalizers(), myFinalizerName) {
 			MacBook.SetFinalizers(append(MacBook.GetFinalizers(), myFinalizerName))
 			if err := r.Update(ctx, MacBook); err != nil {
-				return ctrl.Result{}, err
+				return r.finishReconcile(ctx, clog, MacBook, before, classifyMacBookError("FinalizerAddFailed", err))
 			}
 		}
 	} else {
 		// The object is being deleted
 		if containsString(MacBook.GetFinalizers(), myFinalizerName) {
+			r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonFinalizerStarted, "Cleaning up MacBook %s", MacBook.Name)
+			// 按 deletionPolicy 保留的对象先去掉 owner reference，再移除 finalizer 交给垃圾回收
+			if err := r.applyDeletionPolicy(ctx, clog, MacBook); err != nil {
+				return r.finishReconcile(ctx, clog, MacBook, before, classifyError("FinalizerFailed", err))
+			}
 			// our finalizer is present, so lets handle any external dependency
 			if err := r.deleteExternalResources(MacBook); err != nil {
 				// if fail to delete the external dependency here, return with error
 				// so that it can be retried
-				return ctrl.Result{}, err
+				return r.finishReconcile(ctx, clog, MacBook, before, classifyError("FinalizerFailed", err))
 			}
 
 			// remove our finalizer from the list and update it.
 			MacBook.SetFinalizers(removeString(MacBook.GetFinalizers(), myFinalizerName))
 			if err := r.Update(ctx, MacBook); err != nil {
-				return ctrl.Result{}, err
+				return r.finishReconcile(ctx, clog, MacBook, before, classifyMacBookError("FinalizerRemoveFailed", err))
 			}
+			r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonFinalizerCompleted, "Cleaned up MacBook %s", MacBook.Name)
 		}
 
 		// Stop reconciliation as the item is being deleted
 		return ctrl.Result{}, nil
 	}
 
+	// 过期的 MacBook 直接删除，由上面的 finalizer 逻辑完成清理
+	expired, rerr := r.checkExpiry(ctx, clog, MacBook)
+	if rerr != nil {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+	if expired {
+		return ctrl.Result{}, nil
+	}
+
+	// spec.rollbackTo 恢复历史版本的 spec，MacBook 更新后由新的 generation 触发下一次调协
+	restored, rerr := r.rollbackToRevision(ctx, clog, MacBook)
+	if rerr != nil {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+	if restored {
+		return ctrl.Result{}, nil
+	}
+
+	// 每个被接受的 spec 都保存为一个 MacBookRevision
+	revision, rerr := r.recordRevision(ctx, clog, MacBook)
+	if rerr != nil {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+
+	// class 的默认值和 MacBook 的设置一起决定 pod 模板
+	class, rerr := r.resolveClass(ctx, MacBook)
+	if rerr != nil {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+	ctx = withClass(ctx, class)
+	// 组件的对象不能和 canary、blue/green 的对象重名，在创建任何工作负载之前检查
+	if rerr := validateComponents(MacBook); rerr != nil {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+	if rerr := validateConsumes(MacBook); rerr != nil {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+
+	// 扩缩容计划和休眠决定期望的副本数，由它们引起的副本数变化不算漂移
+	prevReplicas := tools.DesiredReplicas(MacBook)
+	if rerr := r.applySchedules(ctx, clog, MacBook); rerr != nil {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+	r.applyHibernation(ctx, clog, MacBook)
+	scaled := tools.DesiredReplicas(MacBook) != prevReplicas
+
+	// 维护窗口外暂缓会重启 pod 的变化
+	if rerr := r.applyMaintenance(ctx, clog, MacBook); rerr != nil {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+
+	// 依赖的 MacBook 就绪前不创建或更新工作负载，已经运行的保持不变
+	waiting, rerr := r.checkDependencies(ctx, clog, MacBook)
+	if rerr != nil || waiting {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+	// spec.consumes 的 service 地址以环境变量注入 pod 模板，依赖的 MacBook 就绪前它的 service 可能还不存在
+	env, waiting, rerr := r.resolveConsumes(ctx, clog, MacBook)
+	if rerr != nil || waiting {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+	ctx = withConsumedEnv(ctx, env)
+	// spec.waitFor 的对象就绪前不创建 deployment
+	held, rerr := r.checkWaitFor(ctx, clog, MacBook)
+	if rerr != nil || held {
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+	// preDeploy hook 完成前不发布新的 pod 模板
+	proceed, rerr := r.runPreDeployHook(ctx, clog, MacBook)
+	if rerr != nil || !proceed {
+		// hook 的结果同样记录到 revision
+		if err := r.updateRevisionOutcome(ctx, MacBook, revision); err != nil && rerr == nil {
+			rerr = err
+		}
+		return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+	}
+
+	rerr = r.reconcileDeployment(ctx, clog, MacBook, scaled)
+	// service 的 selector 取决于 blue/green 当前的 active 颜色，放在 deployment 之后
+	if err := r.reconcileService(ctx, clog, MacBook); err != nil && rerr == nil {
+		rerr = err
+	}
+	// 组件的就绪状态合并到 MacBook 自己的 Ready condition 中，放在 deployment 之后
+	if err := r.reconcileComponents(ctx, clog, MacBook, scaled); err != nil && rerr == nil {
+		rerr = err
+	}
+	if err := r.updateRevisionOutcome(ctx, MacBook, revision); err != nil && rerr == nil {
+		rerr = err
+	}
+	setPendingCondition(MacBook)
+
+	return r.finishReconcile(ctx, clog, MacBook, before, rerr)
+
+}
+
+// reconcileDeployment 创建 MacBook 对应的 deployment，每一步的错误都经过 classifyError 分类。
+// scaled 为 true 表示扩缩容计划或者休眠修改了副本数，不算漂移
+func (r *MacBookReconciler) reconcileDeployment(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, scaled bool) *reconcileError {
 	/*
 		创建dep并建立关系
 	*/
 
-	dep := tools.NewDeployMent(MacBook)
-
-	addedNamespaces.Add(float64(999))
+	dep := injectConsumedEnv(ctx, tools.NewDeployMent(MacBook, classFrom(ctx)))
+	// 模板哈希标识一个版本，失败过的版本继续使用最近一次可用的模板
+	templateHash := tools.TemplateHash(&dep.Spec.Template)
+	if postDeployHook(MacBook) != nil && (canaryStrategy(MacBook) != nil || blueGreenStrategy(MacBook) != nil) {
+		return terminalError("InvalidHooks", errors.New("spec.hooks.postDeploy is only supported with the rolling update strategy"))
+	}
+	if blueGreenStrategy(MacBook) != nil {
+		if canaryStrategy(MacBook) != nil {
+			return terminalError("InvalidStrategy", errors.New("spec.strategy.canary and spec.strategy.blueGreen are mutually exclusive"))
+		}
+		return r.reconcileBlueGreen(ctx, clog, MacBook, templateHash, scaled)
+	}
+	// 配置了 canary 策略时先推进发布步骤，决定 stable 和 canary 的副本数。
+	// 维护窗口外不开始新的 canary，已经开始的继续推进
+	started := MacBook.Status.Canary != nil && MacBook.Status.Canary.TemplateHash == templateHash
+	if started || !changesHeld(MacBook) {
+		if rerr := r.stepCanary(ctx, clog, MacBook, templateHash); rerr != nil {
+			return rerr
+		}
+	}
+	rolledBack := applyKnownGood(ctx, MacBook, dep, templateHash)
+	canary := canaryInProgress(MacBook, templateHash)
+	if canary {
+		// canary 期间 stable deployment 保持可用版本的模板，只按权重缩减副本
+		dep.Spec.Template = knownGoodTemplate(ctx, MacBook)
+		stableReplicas := MacBook.Status.Canary.StableReplicas
+		dep.Spec.Replicas = &stableReplicas
+	}
+	// canary 推进、提升和终止引起的 deployment 变化都是控制器自己计划的，不算漂移
+	planned := scaled || (MacBook.Status.Canary != nil && MacBook.Status.Canary.TemplateHash == templateHash)
 
 	/*
 		建立关系
 	*/
-	err = controllerutil.SetControllerReference(MacBook, dep, r.Scheme)
-	if err != nil {
-		clog.Error(err, "SetControllerReference fail")
+	// 建立关系失败重试也不会成功，属于终止性错误
+	if err := controllerutil.SetControllerReference(MacBook, dep, r.Scheme); err != nil {
+		return terminalError("SetControllerReferenceFailed", err)
+	}
+
+	found, rerr := r.applyDeployment(ctx, clog, MacBook, dep, planned, true)
+	if rerr != nil {
+		return rerr
+	}
+	MacBook.Status.Mod = dep.Name
+
+	if canary {
+		canaryDep := injectConsumedEnv(ctx, tools.NewCanaryDeployMent(MacBook, classFrom(ctx)))
+		canaryReplicas := MacBook.Status.Canary.CanaryReplicas
+		canaryDep.Spec.Replicas = &canaryReplicas
+		if err := controllerutil.SetControllerReference(MacBook, canaryDep, r.Scheme); err != nil {
+			return terminalError("SetControllerReferenceFailed", err)
+		}
+		if _, rerr := r.applyDeployment(ctx, clog, MacBook, canaryDep, true, false); rerr != nil {
+			return rerr
+		}
+	} else if rerr := r.cleanupCanary(ctx, clog, MacBook, found, rolledBack); rerr != nil {
+		return rerr
+	}
+	if rerr := r.cleanupBlueGreen(ctx, clog, MacBook, found); rerr != nil {
+		return rerr
 	}
 
+	// 汇总 pod 状态到 MacBook status
+	if rerr := r.updatePodStatus(ctx, MacBook, found); rerr != nil {
+		return rerr
+	}
+
+	depList := &appsv1.DeploymentList{}
+	if err := r.List(ctx, depList, client.InNamespace(MacBook.Namespace), client.MatchingFields{nsKey: MacBook.Namespace}); err != nil {
+		return classifyError("DeploymentListFailed", err)
+	}
+
+	clog.Info("获取到了某个ns的deployment列表", "delListLen", len(depList.Items))
+
+	// canary 期间由 stepCanary 判断成败，stable deployment 一直是可用版本；
+	// 模板被暂缓时 deployment 运行的还是旧版本，不能据此判断新版本
+	if canary || templateHeld(MacBook) {
+		return nil
+	}
+	// 检查发布是否成功，失败则自动回滚
+	return r.checkRollout(ctx, clog, MacBook, found, templateHash, rolledBack)
+}
+
+// applyDeployment deployment 不存在就创建，存在则改回期望状态，返回集群中的 deployment。
+// holdable 为 true 表示 deployment 的 pod 正在提供服务，维护窗口外不修改它的模板
+func (r *MacBookReconciler) applyDeployment(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, dep *appsv1.Deployment, planned, holdable bool) (*appsv1.Deployment, *reconcileError) {
 	// 将查找的对象填入下面的指针类型变量中
 	// dep为期望状态不是指针，found为实际集群的状态可以实时反应出来
 	found := &appsv1.Deployment{}
@@ -145,38 +373,170 @@ func (r *MacBookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	// Object 需要是一个指针类型
 	// 找到了就为空
 	// 每次更新deployment出现更新就会触发这个操作
-	err = r.Get(context.TODO(), types.NamespacedName{Name: dep.Name, Namespace: dep.Namespace}, found)
+	err := r.Get(ctx, types.NamespacedName{Name: dep.Name, Namespace: dep.Namespace}, found)
 
-	if err != nil {
+	switch {
+	case apierrors.IsNotFound(err):
 		// 2 调用 client/Writer 接口来往k8s里面创建资源
-		err = r.Create(context.TODO(), dep)
-		if err != nil {
-			clog.Error(err, "deployment create not ok")
-		} else {
-			//r.Recorder.Event(dep, "Normal", "GetRes", "deployment create ok !")
-			clog.Info("deployment create ok", "deployment-name", dep.Name)
-			MacBook.Status.Mod = dep.Name
-			// 关键代码 更新status
-			if err := r.Status().Update(ctx, MacBook); err != nil {
-				clog.Error(err, "MacBook.Status.Mod update fail !")
-			} else {
-				clog.Info("MacBook.Status.Mod update okokok !")
-			}
+		if err := r.Create(ctx, dep); err != nil {
+			return nil, classifyError("DeploymentCreateFailed", err)
 		}
-	} else {
-		//clog.Info("找到了 deployment", "lable", dep.Spec.Template.Spec.Containers[0].Name)
-		clog.Info("找到了 deployment", "Annotations", found.Annotations)
+		clog.Info("deployment create ok", "deployment-name", dep.Name)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonCreated, "Created deployment %s", dep.Name)
+		r.recordEvent(ctx, dep, corev1.EventTypeNormal, EventReasonCreated, "Created by MacBook %s", MacBook.Name)
+		return dep, nil
+	case err != nil:
+		return nil, classifyError("DeploymentGetFailed", err)
+	}
+	//clog.Info("找到了 deployment", "lable", dep.Spec.Template.Spec.Containers[0].Name)
+	clog.Info("找到了 deployment", "Annotations", found.Annotations)
+	// 不是 MacBook 创建的 deployment 先接管，接管后改成期望状态是计划内的修改
+	adopted := !metav1.IsControlledBy(found, MacBook)
+	if rerr := r.claimDeployment(ctx, clog, MacBook, dep, found); rerr != nil {
+		return nil, rerr
 	}
+	if rerr := r.updateDeployment(ctx, clog, MacBook, dep, found, planned || adopted, holdable); rerr != nil {
+		return nil, rerr
+	}
+	return found, nil
+}
 
-	depList := &appsv1.DeploymentList{}
-	if err := r.List(ctx, depList, client.InNamespace(req.Namespace), client.MatchingFields{nsKey: req.Namespace}); err != nil {
-		return ctrl.Result{}, err
+// deleteDeployment 删除 MacBook 拥有的指定名称的 deployment，不存在时忽略。
+// component 为 deployment 所属的组件，MacBook 自己的 deployment（canary、green 等）为空；
+// 组件不符的同名 deployment 不删除，避免清理 canary 或 blue/green 时误删组件
+func (r *MacBookReconciler) deleteDeployment(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, name, component string) *reconcileError {
+	found := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: MacBook.Namespace}, found); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return classifyError("DeploymentGetFailed", err)
+	}
+	// 不是 MacBook 创建的同名 deployment 不删除
+	if !metav1.IsControlledBy(found, MacBook) || found.Labels[tools.ComponentLabel] != component {
+		return nil
 	}
+	if err := r.Delete(ctx, found); err != nil && !apierrors.IsNotFound(err) {
+		return classifyError("DeploymentDeleteFailed", err)
+	}
+	clog.Info("deployment delete ok", "deployment-name", found.Name)
+	return nil
+}
 
-	clog.Info("获取到了某个ns的deployment列表", "delListLen", len(depList.Items))
+// updateDeployment 把集群中的 deployment 改回期望状态
+// spec 变化或者 planned 为 true 时记为 Updated/ScaledUp/ScaledDown，否则说明 deployment 被外部修改，记为 DriftCorrected
+func (r *MacBookReconciler) updateDeployment(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, dep, found *appsv1.Deployment, planned, holdable bool) *reconcileError {
+	// DeepDerivative 只比较期望状态中设置了的字段，apiserver 填充的默认值不算漂移
+	templateChanged := !equality.Semantic.DeepDerivative(dep.Spec.Template, found.Spec.Template)
+	// 维护窗口外保持 deployment 当前的模板，副本数照常调整
+	if templateChanged && holdable && changesHeld(MacBook) {
+		holdChange(MacBook, describeTemplateChange(found.Name, found.Spec.Template, dep.Spec.Template))
+		dep.Spec.Template = found.Spec.Template
+		templateChanged = false
+	}
+	oldReplicas, newReplicas := *dep.Spec.Replicas, *dep.Spec.Replicas
+	if found.Spec.Replicas != nil {
+		oldReplicas = *found.Spec.Replicas
+	}
+	deadlineChanged := dep.Spec.ProgressDeadlineSeconds != nil && !equality.Semantic.DeepEqual(dep.Spec.ProgressDeadlineSeconds, found.Spec.ProgressDeadlineSeconds)
+	if !templateChanged && oldReplicas == newReplicas && !deadlineChanged {
+		return nil
+	}
 
-	return ctrl.Result{}, nil
+	found.Spec.Template = dep.Spec.Template
+	found.Spec.Replicas = dep.Spec.Replicas
+	if deadlineChanged {
+		found.Spec.ProgressDeadlineSeconds = dep.Spec.ProgressDeadlineSeconds
+	}
+	if err := r.Update(ctx, found); err != nil {
+		return classifyError("DeploymentUpdateFailed", err)
+	}
+	clog.Info("deployment update ok", "deployment-name", found.Name, "templateChanged", templateChanged, "replicas", newReplicas)
 
+	// status 还没有更新，observedGeneration 仍是上一次调协时的 generation
+	if !planned && MacBook.Generation == MacBook.Status.ObservedGeneration {
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonDriftCorrected, "Reverted out-of-band changes to deployment %s", found.Name)
+		r.recordEvent(ctx, found, corev1.EventTypeNormal, EventReasonDriftCorrected, "Reverted to the state declared by MacBook %s", MacBook.Name)
+		return nil
+	}
+
+	if templateChanged {
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonUpdated, "Updated pod template of deployment %s", found.Name)
+		r.recordEvent(ctx, found, corev1.EventTypeNormal, EventReasonUpdated, "Pod template updated by MacBook %s", MacBook.Name)
+	}
+	if oldReplicas != newReplicas {
+		reason := EventReasonScaledUp
+		if newReplicas < oldReplicas {
+			reason = EventReasonScaledDown
+		}
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, reason, "Scaled deployment %s from %d to %d replicas", found.Name, oldReplicas, newReplicas)
+		r.recordEvent(ctx, found, corev1.EventTypeNormal, reason, "Scaled from %d to %d replicas by MacBook %s", oldReplicas, newReplicas, MacBook.Name)
+	}
+	return nil
+}
+
+// finishReconcile 根据错误分类写入 status 并决定如何返回
+// 可忽略的错误直接结束；暂时性错误记录到 status.lastError 后返回 err，由 workqueue 退避重试；
+// 终止性错误设置 Degraded condition 并发出 Warning 事件，返回 nil 避免死循环，等待用户修改 spec
+func (r *MacBookReconciler) finishReconcile(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, before *mockv1beta1.MacBookStatus, rerr *reconcileError) (ctrl.Result, error) {
+	if rerr != nil && rerr.class == errorIgnorable {
+		clog.V(1).Info("ignore reconcile error", "reason", rerr.reason, "error", rerr.err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	MacBook.Status.ObservedGeneration = MacBook.Generation
+	if rerr == nil {
+		MacBook.Status.LastError = nil
+		meta.SetStatusCondition(&MacBook.Status.Conditions, metav1.Condition{
+			Type:               mockv1beta1.ConditionDegraded,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: MacBook.Generation,
+			Reason:             "ReconcileSucceeded",
+		})
+	} else {
+		lastError := &mockv1beta1.ReconcileError{
+			Class:   string(rerr.class),
+			Reason:  rerr.reason,
+			Message: rerr.err.Error(),
+			Time:    metav1.Now(),
+		}
+		// 同一个错误重复出现时保留第一次的时间，避免 status 来回变化
+		if prev := before.LastError; prev != nil && prev.Class == lastError.Class && prev.Reason == lastError.Reason && prev.Message == lastError.Message {
+			lastError.Time = prev.Time
+		}
+		MacBook.Status.LastError = lastError
+
+		if rerr.class == errorTerminal {
+			meta.SetStatusCondition(&MacBook.Status.Conditions, metav1.Condition{
+				Type:               mockv1beta1.ConditionDegraded,
+				Status:             metav1.ConditionTrue,
+				ObservedGeneration: MacBook.Generation,
+				Reason:             rerr.reason,
+				Message:            rerr.err.Error(),
+			})
+		}
+		// 失败统一使用 ReconcileFailed，重复的失败事件由 recorder 去重
+		r.recordEvent(ctx, MacBook, corev1.EventTypeWarning, EventReasonReconcileFailed, "%s", rerr.Error())
+	}
+
+	// 关键代码 更新status
+	if !equality.Semantic.DeepEqual(before, &MacBook.Status) {
+		if err := r.Status().Update(ctx, MacBook); err != nil {
+			if rerr == nil {
+				return ctrl.Result{}, err
+			}
+			clog.Error(err, "MacBook status update fail !")
+		}
+	}
+
+	if rerr == nil {
+		return requeueResult(ctx), nil
+	}
+	if rerr.class == errorTerminal {
+		clog.Error(rerr, "terminal reconcile error, waiting for the MacBook to change")
+		return requeueResult(ctx), nil
+	}
+	return ctrl.Result{}, rerr
 }
 
 func containsString(slice []string, s string) bool {
@@ -209,18 +569,37 @@ func (r *MacBookReconciler) deleteExternalResources(macbook *mockv1beta1.MacBook
 }
 
 // predicate 使用 https://sdk.operatorframework.io/docs/building-operators/golang/references/event-filtering/
-func onlyReconcilerDeploymentLable() predicate.Predicate {
+// deploymentChanged 所有 namespace 的 deployment 都会触发，更新事件只关心 spec 和 status 的变化
+func deploymentChanged() predicate.Predicate {
 	return predicate.Funcs{
 		// 这些函数中返回值为 true 就会执行响应的事件handler
-		// 下面的逻辑表示 在更新事件中，只有ns为 lrq 的资源对象才会触发更新事件handler
 		UpdateFunc: func(event event.UpdateEvent) bool {
-			return event.ObjectNew.GetNamespace() == "lr"
-		},
-		CreateFunc: func(createEvent event.CreateEvent) bool {
-			return createEvent.Object.GetNamespace() == "lr"
+			oldDep, ok := event.ObjectOld.(*appsv1.Deployment)
+			if !ok {
+				return true
+			}
+			newDep, ok := event.ObjectNew.(*appsv1.Deployment)
+			if !ok {
+				return true
+			}
+			return oldDep.Generation != newDep.Generation || !equality.Semantic.DeepEqual(oldDep.Status, newDep.Status)
 		},
-		DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
-			return deleteEvent.Object.GetNamespace() == "lr"
+	}
+}
+
+// podChanged pod 的创建、删除以及 status 变化（就绪、重启、CrashLoopBackOff 等）才触发调协
+func podChanged() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(event event.UpdateEvent) bool {
+			oldPod, ok := event.ObjectOld.(*corev1.Pod)
+			if !ok {
+				return true
+			}
+			newPod, ok := event.ObjectNew.(*corev1.Pod)
+			if !ok {
+				return true
+			}
+			return oldPod.DeletionTimestamp.IsZero() != newPod.DeletionTimestamp.IsZero() || !equality.Semantic.DeepEqual(oldPod.Status, newPod.Status)
 		},
 	}
 }
@@ -252,14 +631,89 @@ func (r *MacBookReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	}); err != nil {
 		return err
 	}
+	// class 修改后通过这个索引找到使用它的 MacBook
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &mockv1beta1.MacBook{}, classKey, func(rawObj client.Object) []string {
+		return []string{rawObj.(*mockv1beta1.MacBook).Spec.ClassName}
+	}); err != nil {
+		return err
+	}
+
+	// service 变化后通过这个索引找到使用它的 MacBook
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &mockv1beta1.MacBook{}, consumesKey, func(rawObj client.Object) []string {
+		MacBook := rawObj.(*mockv1beta1.MacBook)
+		keys := make([]string, 0, len(MacBook.Spec.Consumes))
+		for _, ref := range MacBook.Spec.Consumes {
+			keys = append(keys, referenceKey(MacBook, ref).String())
+		}
+		return keys
+	}); err != nil {
+		return err
+	}
+	// 依赖的 MacBook 变化后通过这个索引找到依赖它的 MacBook
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &mockv1beta1.MacBook{}, dependsOnKey, func(rawObj client.Object) []string {
+		MacBook := rawObj.(*mockv1beta1.MacBook)
+		keys := make([]string, 0, len(MacBook.Spec.DependsOn))
+		for _, ref := range MacBook.Spec.DependsOn {
+			keys = append(keys, referenceKey(MacBook, ref).String())
+		}
+		return keys
+	}); err != nil {
+		return err
+	}
+	// spec.waitFor 的对象变化后通过这个索引找到等待它的 MacBook
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &mockv1beta1.MacBook{}, waitForKey, func(rawObj client.Object) []string {
+		MacBook := rawObj.(*mockv1beta1.MacBook)
+		keys := make([]string, 0, len(MacBook.Spec.WaitFor))
+		for i := range MacBook.Spec.WaitFor {
+			if target, err := waitForTargetOf(MacBook, &MacBook.Spec.WaitFor[i]); err == nil {
+				keys = append(keys, target.indexKey())
+			}
+		}
+		return keys
+	}); err != nil {
+		return err
+	}
+
+	// 删除 MacBook 时通过这个索引找到需要按 deletionPolicy 释放的对象
+	for _, obj := range []client.Object{&appsv1.Deployment{}, &corev1.Service{}, &corev1.PersistentVolumeClaim{}} {
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), obj, ownerKey, macBookOwners); err != nil {
+			return err
+		}
+	}
 
-	return ctrl.NewControllerManagedBy(mgr).
+	bldr := ctrl.NewControllerManagedBy(mgr).
 		// for指定需要监听的资源 基于watch实现
 		// Watches(&source.Kind{Type: apiType}, &handler.EnqueueRequestForObject{})
 		// builder.WithPredicates(predicate.GenerationChangedPredicate{}) 忽略status字段更新的调协操作
-		For(&mockv1beta1.MacBook{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		// 注解变化也要调协，canary 的 promote/abort 通过注解触发
+		For(&mockv1beta1.MacBook{}, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
 		// Owns 指定监听crd的子资源,第二个字段是过滤器，针对不同的事件采取特定的过滤策略
 		//Owns(&appsv1.Deployment{}).
-		Owns(&appsv1.Deployment{}, builder.WithPredicates(onlyReconcilerDeploymentLable())).
-		Complete(r)
+		Owns(&appsv1.Deployment{}, builder.WithPredicates(deploymentChanged())).
+		Owns(&corev1.Service{}).
+		// hook job 结束后继续发布
+		Owns(&batchv1.Job{}).
+		// pod 不是 MacBook 直接创建的，通过 pod 标签映射回 MacBook
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(podToMacBook), builder.WithPredicates(podChanged())).
+		// class 的默认值修改后重新调协使用它的 MacBook
+		Watches(&source.Kind{Type: &mockv1beta1.MacBookClass{}}, handler.EnqueueRequestsFromMapFunc(r.classToMacBooks)).
+		// 依赖的 MacBook 就绪状态变化后重新调协依赖它的 MacBook
+		Watches(&source.Kind{Type: &mockv1beta1.MacBook{}}, handler.EnqueueRequestsFromMapFunc(r.macBookToDependents)).
+		// 使用的 service 创建或端口变化后重新生成环境变量
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.serviceToConsumers))
+	// 全局维护窗口修改后所有 MacBook 重新判断
+	if r.MaintenanceConfig.Name != "" {
+		bldr = bldr.Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.maintenanceConfigToMacBooks))
+	}
+	c, err := bldr.Build(r)
+	if err != nil {
+		return err
+	}
+	// spec.waitFor 引用的 kind 在第一次等待时才建立 watch
+	metadataClient, err := metadata.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		return err
+	}
+	r.waitForWatches = newWaitForWatches(metadataClient, c, r.waitForObjectToMacBooks, r.Log.WithName("waitFor"))
+	return mgr.Add(r.waitForWatches)
 }
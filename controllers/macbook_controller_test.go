@@ -0,0 +1,75 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newFakeReconciler 使用 fake client 的 reconciler，objs 为集群中已有的对象
+func newFakeReconciler(t *testing.T, objs ...runtime.Object) *MacBookReconciler {
+	t.Helper()
+	s := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := mockv1beta1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return &MacBookReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(objs...).Build(),
+		Log:      ctrl.Log,
+		Scheme:   s,
+		Recorder: record.NewFakeRecorder(100),
+	}
+}
+
+func newTestMacBook() *mockv1beta1.MacBook {
+	return &mockv1beta1.MacBook{
+		TypeMeta:   metav1.TypeMeta{APIVersion: mockv1beta1.GroupVersion.String(), Kind: "MacBook"},
+		ObjectMeta: metav1.ObjectMeta{Name: "mac", Namespace: "default", UID: "mac-uid"},
+		Spec:       mockv1beta1.MacBookSpec{Replicas: int32Ptr(2)},
+	}
+}
+
+// completeDeployment MacBook 拥有的 deployment，所有副本都已更新并可用
+func completeDeployment(MacBook *mockv1beta1.MacBook, dep *appsv1.Deployment) *appsv1.Deployment {
+	dep.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(MacBook, mockv1beta1.GroupVersion.WithKind("MacBook"))}
+	replicas := *dep.Spec.Replicas
+	dep.Status = appsv1.DeploymentStatus{Replicas: replicas, UpdatedReplicas: replicas, AvailableReplicas: replicas}
+	return dep
+}
+
+func crashLoopingPod(name string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "web",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: rollbackReasonCrashLoop, Message: "back-off"}},
+		}}},
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// ReleasedByAnnotation 记录释放对象的 MacBook，值为 MacBook 的名称，方便之后重新接管
+const ReleasedByAnnotation = "mock.dong.com/released-by"
+
+// ownerKey 按 owner reference 中 MacBook 的 uid 索引 deployment、service 和 PVC，删除时只释放 MacBook 拥有的对象
+var ownerKey = "byMacBookOwner"
+
+// macBookOwners 返回对象的 owner reference 中 MacBook 的 uid
+func macBookOwners(obj client.Object) []string {
+	var uids []string
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.APIVersion == mockv1beta1.GroupVersion.String() && ref.Kind == "MacBook" {
+			uids = append(uids, string(ref.UID))
+		}
+	}
+	return uids
+}
+
+// applyDeletionPolicy 在 finalizer 中执行 spec.deletionPolicy：
+// 需要保留的对象去掉指向 MacBook 的 owner reference，垃圾回收就不会删除它们。
+// 控制器不创建 PVC，只有 owner reference 指向 MacBook 的 PVC（例如用户或者其他工具设置的）会被保留
+func (r *MacBookReconciler) applyDeletionPolicy(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) error {
+	var lists []client.ObjectList
+	switch MacBook.Spec.DeletionPolicy {
+	case mockv1beta1.DeletionPolicyOrphan:
+		lists = []client.ObjectList{&appsv1.DeploymentList{}, &corev1.ServiceList{}, &corev1.PersistentVolumeClaimList{}}
+	case mockv1beta1.DeletionPolicyRetainStorage:
+		lists = []client.ObjectList{&corev1.PersistentVolumeClaimList{}}
+	default:
+		return nil
+	}
+	for _, list := range lists {
+		if err := r.releaseOwned(ctx, clog, MacBook, list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseOwned 释放 list 类型中属于 MacBook 的对象，可以重复执行
+func (r *MacBookReconciler) releaseOwned(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, list client.ObjectList) error {
+	if err := r.List(ctx, list, client.InNamespace(MacBook.Namespace), client.MatchingFields{ownerKey: string(MacBook.UID)}); err != nil {
+		return err
+	}
+	return meta.EachListItem(list, func(o runtime.Object) error {
+		obj := o.(client.Object)
+		refs := obj.GetOwnerReferences()
+		kept := make([]metav1.OwnerReference, 0, len(refs))
+		for _, ref := range refs {
+			if ref.UID != MacBook.UID {
+				kept = append(kept, ref)
+			}
+		}
+		if len(kept) == len(refs) {
+			return nil
+		}
+		obj.SetOwnerReferences(kept)
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[ReleasedByAnnotation] = MacBook.Name
+		obj.SetAnnotations(annotations)
+		if err := r.Update(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		kind := "object"
+		if gvk, err := apiutil.GVKForObject(obj, r.Scheme); err == nil {
+			kind = gvk.Kind
+		}
+		clog.Info("released on deletion", "kind", kind, "name", obj.GetName(), "policy", MacBook.Spec.DeletionPolicy)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonReleased, "Released %s %s (deletionPolicy %s)", kind, obj.GetName(), MacBook.Spec.DeletionPolicy)
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestMacBookOwners(t *testing.T) {
+	MacBook := newTestMacBook()
+	obj := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{
+		*metav1.NewControllerRef(MacBook, mockv1beta1.GroupVersion.WithKind("MacBook")),
+		{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db", UID: "db-uid"},
+		{APIVersion: "other.example.com/v1", Kind: "MacBook", Name: "mac", UID: "foreign-uid"},
+	}}}
+	if got := macBookOwners(obj); len(got) != 1 || got[0] != string(MacBook.UID) {
+		t.Errorf("macBookOwners = %v, want [%s]", got, MacBook.UID)
+	}
+}
+
+func TestApplyDeletionPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		// wantReleased 为被释放的对象
+		wantReleased []string
+	}{
+		{mockv1beta1.DeletionPolicyDelete, nil},
+		{mockv1beta1.DeletionPolicyOrphan, []string{"deployment/mac", "service/mac", "pvc/data"}},
+		{mockv1beta1.DeletionPolicyRetainStorage, []string{"pvc/data"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.DeletionPolicy = tt.policy
+			owned := []metav1.OwnerReference{*metav1.NewControllerRef(MacBook, mockv1beta1.GroupVersion.WithKind("MacBook"))}
+			objs := map[string]client.Object{
+				"deployment/mac":   &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "mac", OwnerReferences: owned}},
+				"service/mac":      &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "mac", OwnerReferences: owned}},
+				"pvc/data":         &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "data", OwnerReferences: owned}},
+				"deployment/other": &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other"}},
+				"pvc/unowned":      &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unowned"}},
+			}
+			var initObjs []runtime.Object
+			for _, obj := range objs {
+				initObjs = append(initObjs, obj.DeepCopyObject())
+			}
+			r := newFakeReconciler(t, initObjs...)
+			ctx := context.Background()
+
+			if err := r.applyDeletionPolicy(ctx, ctrl.Log, MacBook); err != nil {
+				t.Fatal(err)
+			}
+
+			released := map[string]bool{}
+			for _, name := range tt.wantReleased {
+				released[name] = true
+			}
+			for name, obj := range objs {
+				// 解码不会清空原来的 owner reference，用一个空对象读取
+				got := obj.DeepCopyObject().(client.Object)
+				got.SetOwnerReferences(nil)
+				if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: obj.GetName()}, got); err != nil {
+					t.Fatal(err)
+				}
+				_, annotated := got.GetAnnotations()[ReleasedByAnnotation]
+				if annotated != released[name] {
+					t.Errorf("%s released = %v, want %v", name, annotated, released[name])
+				}
+				if released[name] && len(macBookOwners(got)) > 0 {
+					t.Errorf("%s still owned by the MacBook", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// dependsOnKey MacBook 上 spec.dependsOn 的索引，值为依赖的 namespace/name
+const dependsOnKey = ".spec.dependsOn"
+
+// referenceKey 引用的 MacBook，没有写 namespace 时和 MacBook 在同一个 namespace
+func referenceKey(MacBook *mockv1beta1.MacBook, ref mockv1beta1.MacBookReference) types.NamespacedName {
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = MacBook.Namespace
+	}
+	return types.NamespacedName{Namespace: namespace, Name: ref.Name}
+}
+
+// checkDependencies 检查 spec.dependsOn 中的 MacBook 是否都已就绪，结果写入 WaitingForDependencies condition。
+// 返回 true 时本次调协不创建或更新工作负载；循环依赖无法自行恢复，属于终止性错误
+func (r *MacBookReconciler) checkDependencies(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) (bool, *reconcileError) {
+	if len(MacBook.Spec.DependsOn) == 0 {
+		removeCondition(&MacBook.Status.Conditions, mockv1beta1.ConditionWaitingForDependencies)
+		return false, nil
+	}
+
+	cycle, err := r.findDependencyCycle(ctx, MacBook)
+	if err != nil {
+		return false, classifyError("DependencyGetFailed", err)
+	}
+	if cycle != nil {
+		return false, terminalError("DependencyCycle", fmt.Errorf("dependency cycle %s", strings.Join(cycle, " -> ")))
+	}
+
+	var waiting []string
+	for _, ref := range MacBook.Spec.DependsOn {
+		key := referenceKey(MacBook, ref)
+		dep := &mockv1beta1.MacBook{}
+		if err := r.Get(ctx, key, dep); err != nil {
+			// 依赖创建后通过索引触发调协
+			if apierrors.IsNotFound(err) {
+				waiting = append(waiting, fmt.Sprintf("%s not found", key))
+				continue
+			}
+			return false, classifyError("DependencyGetFailed", err)
+		}
+		if !macBookReady(dep) {
+			waiting = append(waiting, fmt.Sprintf("%s is not ready", key))
+		}
+	}
+
+	cond := metav1.Condition{
+		Type:               mockv1beta1.ConditionWaitingForDependencies,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: MacBook.Generation,
+		Reason:             "DependenciesReady",
+	}
+	if len(waiting) > 0 {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "DependenciesNotReady"
+		cond.Message = strings.Join(waiting, "; ")
+		clog.Info("waiting for dependencies", "waiting", waiting)
+	}
+	meta.SetStatusCondition(&MacBook.Status.Conditions, cond)
+	return len(waiting) > 0, nil
+}
+
+// findDependencyCycle 沿着 dependsOn 深度优先查找回到 MacBook 自己的路径，没有循环时返回 nil。
+// 每个 MacBook 只查找一次，不经过 MacBook 自己的循环由所在的 MacBook 报告
+func (r *MacBookReconciler) findDependencyCycle(ctx context.Context, MacBook *mockv1beta1.MacBook) ([]string, error) {
+	start := client.ObjectKeyFromObject(MacBook)
+	visited := map[types.NamespacedName]bool{}
+	var visit func(mb *mockv1beta1.MacBook, path []string) ([]string, error)
+	visit = func(mb *mockv1beta1.MacBook, path []string) ([]string, error) {
+		for _, ref := range mb.Spec.DependsOn {
+			key := referenceKey(mb, ref)
+			next := append(path[:len(path):len(path)], key.String())
+			if key == start {
+				return next, nil
+			}
+			if visited[key] {
+				continue
+			}
+			visited[key] = true
+			dep := &mockv1beta1.MacBook{}
+			if err := r.Get(ctx, key, dep); err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			if cycle, err := visit(dep, next); cycle != nil || err != nil {
+				return cycle, err
+			}
+		}
+		return nil, nil
+	}
+	return visit(MacBook, []string{start.String()})
+}
+
+// macBookReady 控制器已经处理了最新的 spec 并且 Ready 为 True
+func macBookReady(MacBook *mockv1beta1.MacBook) bool {
+	return MacBook.Status.ObservedGeneration >= MacBook.Generation &&
+		meta.IsStatusConditionTrue(MacBook.Status.Conditions, mockv1beta1.ConditionReady)
+}
+
+// macBookToDependents MacBook 变化（包括 status）后通过索引找到依赖它的 MacBook 重新调协
+func (r *MacBookReconciler) macBookToDependents(obj client.Object) []reconcile.Request {
+	list := &mockv1beta1.MacBookList{}
+	key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	if err := r.List(context.Background(), list, client.MatchingFields{dependsOnKey: key.String()}); err != nil {
+		r.Log.Error(err, "unable to list dependent MacBooks", "macbook", key)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for i := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&list.Items[i])})
+	}
+	return requests
+}
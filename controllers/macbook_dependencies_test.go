@@ -0,0 +1,130 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestCheckDependencies(t *testing.T) {
+	// dependency namespace/name 的 MacBook，依赖 deps 中的 MacBook，ready 时 Ready 为 True
+	dependency := func(namespace, name string, ready bool, deps ...string) *mockv1beta1.MacBook {
+		MacBook := &mockv1beta1.MacBook{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+		for _, dep := range deps {
+			MacBook.Spec.DependsOn = append(MacBook.Spec.DependsOn, mockv1beta1.MacBookReference{Name: dep})
+		}
+		if ready {
+			meta.SetStatusCondition(&MacBook.Status.Conditions, metav1.Condition{Type: mockv1beta1.ConditionReady, Status: metav1.ConditionTrue, Reason: "Ready"})
+		}
+		return MacBook
+	}
+	tests := []struct {
+		name      string
+		dependsOn []mockv1beta1.MacBookReference
+		// conditions MacBook 已有的 condition
+		conditions   []metav1.Condition
+		objs         []runtime.Object
+		wantWait     bool
+		wantReason   string
+		wantTerminal string
+	}{
+		{
+			name: "no dependencies and no conditions",
+		},
+		{
+			name: "waiting condition is removed with the dependencies",
+			conditions: []metav1.Condition{
+				{Type: mockv1beta1.ConditionWaitingForDependencies, Status: metav1.ConditionTrue, Reason: "DependenciesNotReady"},
+			},
+		},
+		{
+			name:       "missing dependency",
+			dependsOn:  []mockv1beta1.MacBookReference{{Name: "db"}},
+			wantWait:   true,
+			wantReason: "DependenciesNotReady",
+		},
+		{
+			name:       "dependency not ready",
+			dependsOn:  []mockv1beta1.MacBookReference{{Name: "db"}},
+			objs:       []runtime.Object{dependency("default", "db", false)},
+			wantWait:   true,
+			wantReason: "DependenciesNotReady",
+		},
+		{
+			name:       "dependencies ready",
+			dependsOn:  []mockv1beta1.MacBookReference{{Name: "db"}, {Name: "cache", Namespace: "shared"}},
+			objs:       []runtime.Object{dependency("default", "db", true), dependency("shared", "cache", true)},
+			wantReason: "DependenciesReady",
+		},
+		{
+			name:         "depends on itself",
+			dependsOn:    []mockv1beta1.MacBookReference{{Name: "mac"}},
+			wantTerminal: "DependencyCycle",
+		},
+		{
+			name:         "cycle through a dependency",
+			dependsOn:    []mockv1beta1.MacBookReference{{Name: "api"}},
+			objs:         []runtime.Object{dependency("default", "api", true, "db"), dependency("default", "db", true, "mac")},
+			wantTerminal: "DependencyCycle",
+		},
+		{
+			// 不经过 mac 的循环由 db 和 cache 自己报告，mac 只是等待
+			name:       "cycle between dependencies",
+			dependsOn:  []mockv1beta1.MacBookReference{{Name: "db"}},
+			objs:       []runtime.Object{dependency("default", "db", false, "cache"), dependency("default", "cache", false, "db")},
+			wantWait:   true,
+			wantReason: "DependenciesNotReady",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.DependsOn = tt.dependsOn
+			MacBook.Status.Conditions = tt.conditions
+			r := newFakeReconciler(t, append(tt.objs, MacBook.DeepCopy())...)
+
+			wait, rerr := r.checkDependencies(context.Background(), ctrl.Log, MacBook)
+
+			if tt.wantTerminal != "" {
+				if rerr == nil || rerr.class != errorTerminal || rerr.reason != tt.wantTerminal {
+					t.Fatalf("checkDependencies error = %v, want terminal %s", rerr, tt.wantTerminal)
+				}
+				return
+			}
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			if wait != tt.wantWait {
+				t.Errorf("wait = %v, want %v", wait, tt.wantWait)
+			}
+			cond := meta.FindStatusCondition(MacBook.Status.Conditions, mockv1beta1.ConditionWaitingForDependencies)
+			switch {
+			case tt.wantReason == "" && cond != nil:
+				t.Errorf("condition = %+v, want none", cond)
+			case tt.wantReason != "" && (cond == nil || cond.Reason != tt.wantReason):
+				t.Errorf("condition = %+v, want reason %s", cond, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// errorClass 调协错误的分类，决定是否重试以及如何体现在 status 中
+type errorClass string
+
+const (
+	// errorIgnorable 可以忽略，例如对象已经被删除
+	errorIgnorable errorClass = "Ignorable"
+	// errorTransient 暂时性错误，返回给 workqueue 按指数退避重试
+	errorTransient errorClass = mockv1beta1.ErrorClassTransient
+	// errorTerminal 终止性错误，重试也不会成功，设置 Degraded 并等待用户修改 spec
+	errorTerminal errorClass = mockv1beta1.ErrorClassTerminal
+)
+
+// reconcileError 是调协过程中每一步返回的错误，reason 用于 condition 和 event
+type reconcileError struct {
+	class  errorClass
+	reason string
+	err    error
+}
+
+func (e *reconcileError) Error() string {
+	return e.reason + ": " + e.err.Error()
+}
+
+func (e *reconcileError) Unwrap() error {
+	return e.err
+}
+
+// classifyError 根据 api 返回的错误类型给 err 分类，已经分类过的错误原样返回
+func classifyError(reason string, err error) *reconcileError {
+	if err == nil {
+		return nil
+	}
+	var rerr *reconcileError
+	if errors.As(err, &rerr) {
+		return rerr
+	}
+
+	// Forbidden 按暂时性错误重试：ResourceQuota 超限、在删除中的 namespace 创建对象以及缺少 RBAC 权限
+	// 都返回 403，它们不修改 spec 也会恢复
+	class := errorTransient
+	var owned *controllerutil.AlreadyOwnedError
+	switch {
+	case errors.As(err, &owned),
+		apierrors.IsInvalid(err),
+		apierrors.IsBadRequest(err),
+		apierrors.IsUnauthorized(err),
+		apierrors.IsMethodNotSupported(err),
+		apierrors.IsRequestEntityTooLargeError(err):
+		class = errorTerminal
+	}
+	return &reconcileError{class: class, reason: reason, err: err}
+}
+
+// classifyMacBookError 用于 MacBook 自身的更新，返回 NotFound 说明对象已经被删除，可以忽略
+func classifyMacBookError(reason string, err error) *reconcileError {
+	if apierrors.IsNotFound(err) {
+		return ignorableError(reason, err)
+	}
+	return classifyError(reason, err)
+}
+
+// ignorableError 标记一个可以忽略的错误
+func ignorableError(reason string, err error) *reconcileError {
+	return &reconcileError{class: errorIgnorable, reason: reason, err: err}
+}
+
+// terminalError 标记一个终止性错误
+func terminalError(reason string, err error) *reconcileError {
+	return &reconcileError{class: errorTerminal, reason: reason, err: err}
+}
+
+// requeueKey 保存在 ctx 中，调协的各个步骤通过 requeueAfter 请求在一段时间后重新调协
+type requeueKey struct{}
+
+type requeueState struct {
+	after time.Duration
+}
+
+func withRequeue(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requeueKey{}, &requeueState{})
+}
+
+// requeueAfter 请求 d 之后重新调协，多次请求取最早的一次
+func requeueAfter(ctx context.Context, d time.Duration) {
+	state, ok := ctx.Value(requeueKey{}).(*requeueState)
+	if !ok || d <= 0 {
+		return
+	}
+	if state.after == 0 || d < state.after {
+		state.after = d
+	}
+}
+
+// requeueResult 返回本次调协请求的 Result
+func requeueResult(ctx context.Context) ctrl.Result {
+	if state, ok := ctx.Value(requeueKey{}).(*requeueState); ok && state.after > 0 {
+		return ctrl.Result{RequeueAfter: state.after}
+	}
+	return ctrl.Result{}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestClassifyError(t *testing.T) {
+	gr := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	tests := []struct {
+		name string
+		err  error
+		want errorClass
+	}{
+		{"conflict", apierrors.NewConflict(gr, "mac", errors.New("modified")), errorTransient},
+		{"timeout", apierrors.NewServerTimeout(gr, "create", 1), errorTransient},
+		// 缺少权限和 ResourceQuota 超限不修改 spec 也会恢复
+		{"forbidden", apierrors.NewForbidden(gr, "mac", errors.New("exceeded quota")), errorTransient},
+		{"invalid", apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "mac", field.ErrorList{field.Required(field.NewPath("spec"), "")}), errorTerminal},
+		{"bad request", apierrors.NewBadRequest("bad"), errorTerminal},
+		{"already owned", fmt.Errorf("set owner: %w", &controllerutil.AlreadyOwnedError{}), errorTerminal},
+		{"unknown", errors.New("connection refused"), errorTransient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError("Failed", tt.err); got.class != tt.want {
+				t.Errorf("classifyError(%v) = %s, want %s", tt.err, got.class, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyErrorKeepsClass(t *testing.T) {
+	terminal := terminalError("InvalidSpec", errors.New("bad"))
+	if got := classifyError("Wrapped", fmt.Errorf("step: %w", terminal)); got != terminal {
+		t.Errorf("classifyError() = %v, want the wrapped terminal error", got)
+	}
+	if classifyError("Failed", nil) != nil {
+		t.Error("classifyError(nil) is not nil")
+	}
+	if got := classifyMacBookError("StatusUpdateFailed", apierrors.NewNotFound(schema.GroupResource{Resource: "macbooks"}, "mac")); got.class != errorIgnorable {
+		t.Errorf("classifyMacBookError(NotFound) = %s, want %s", got.class, errorIgnorable)
+	}
+}
+
+func TestRequeueAfter(t *testing.T) {
+	ctx := withRequeue(context.Background())
+	if got := requeueResult(ctx).RequeueAfter; got != 0 {
+		t.Errorf("RequeueAfter = %v without a request, want 0", got)
+	}
+	// 多次请求取最早的一次
+	requeueAfter(ctx, time.Minute)
+	requeueAfter(ctx, 10*time.Second)
+	requeueAfter(ctx, time.Hour)
+	if got := requeueResult(ctx).RequeueAfter; got != 10*time.Second {
+		t.Errorf("RequeueAfter = %v, want 10s", got)
+	}
+	// 没有 withRequeue 的 ctx 忽略请求
+	requeueAfter(context.Background(), time.Second)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+
+	"alex-opr/controllers/tracing"
+)
+
+// MacBook 生命周期事件的 reason，只有真正发生状态变化时才会记录
+const (
+	// EventReasonCreated deployment 被创建
+	EventReasonCreated = "Created"
+	// EventReasonUpdated spec 变化后 deployment 被更新
+	EventReasonUpdated = "Updated"
+	// EventReasonDriftCorrected deployment 被外部修改，控制器将其改回期望状态
+	EventReasonDriftCorrected = "DriftCorrected"
+	// EventReasonScaledUp 副本数增加
+	EventReasonScaledUp = "ScaledUp"
+	// EventReasonScaledDown 副本数减少
+	EventReasonScaledDown = "ScaledDown"
+	// EventReasonFinalizerStarted 开始执行 finalizer 清理
+	EventReasonFinalizerStarted = "FinalizerStarted"
+	// EventReasonFinalizerCompleted finalizer 清理完成
+	EventReasonFinalizerCompleted = "FinalizerCompleted"
+	// EventReasonReconcileFailed 调协失败，类型为 Warning
+	EventReasonReconcileFailed = "ReconcileFailed"
+	// EventReasonRolledBack 新版本没有变为健康，回滚到最近一次可用的版本，类型为 Warning
+	EventReasonRolledBack = "RolledBack"
+	// EventReasonRevisionRestored spec.rollbackTo 指定的 revision 已经恢复
+	EventReasonRevisionRestored = "RevisionRestored"
+	// EventReasonRevisionNotFound spec.rollbackTo 指定的 revision 不存在，类型为 Warning
+	EventReasonRevisionNotFound = "RevisionNotFound"
+	// EventReasonCanaryStarted 开始 canary 发布
+	EventReasonCanaryStarted = "CanaryStarted"
+	// EventReasonCanaryStepCompleted canary 的一个步骤完成
+	EventReasonCanaryStepCompleted = "CanaryStepCompleted"
+	// EventReasonCanaryPromoted canary 提升为 stable
+	EventReasonCanaryPromoted = "CanaryPromoted"
+	// EventReasonCanaryAborted canary 被终止，类型为 Warning
+	EventReasonCanaryAborted = "CanaryAborted"
+	// EventReasonPreviewStarted 开始 blue/green 预览
+	EventReasonPreviewStarted = "PreviewStarted"
+	// EventReasonSwitched service 切换到预览颜色
+	EventReasonSwitched = "Switched"
+	// EventReasonPreviewAborted 预览被终止，类型为 Warning
+	EventReasonPreviewAborted = "PreviewAborted"
+	// EventReasonPreviousScaledDown 切换前的颜色超过保留时间后被删除
+	EventReasonPreviousScaledDown = "PreviousScaledDown"
+	// EventReasonScheduleActivated 扩缩容计划触发，修改了副本数
+	EventReasonScheduleActivated = "ScheduleActivated"
+	// EventReasonHibernated 空闲时间超过 idleAfter，副本数缩为 0
+	EventReasonHibernated = "Hibernated"
+	// EventReasonWokenUp 休眠后有新的访问，恢复副本数
+	EventReasonWokenUp = "WokenUp"
+	// EventReasonExpiringSoon MacBook 即将过期被删除，类型为 Warning
+	EventReasonExpiringSoon = "ExpiringSoon"
+	// EventReasonExpired MacBook 已经过期，开始删除，类型为 Warning
+	EventReasonExpired = "Expired"
+	// EventReasonAdopted 已经存在的同名 deployment 被 MacBook 接管
+	EventReasonAdopted = "Adopted"
+	// EventReasonReleased 按 deletionPolicy 删除 MacBook 时保留的对象被释放
+	EventReasonReleased = "Released"
+	// EventReasonComponentDeleted 从 spec.components 中移除的组件被删除
+	EventReasonComponentDeleted = "ComponentDeleted"
+	// EventReasonNamespaceDeleted 从 tenant 中移除的 namespace 被删除
+	EventReasonNamespaceDeleted = "NamespaceDeleted"
+	// EventReasonMacBookDeleted namespace 不再被 MacBookSet 选中，其中的 MacBook 被删除
+	EventReasonMacBookDeleted = "MacBookDeleted"
+	// EventReasonWaveStarted MacBookSet 开始更新新的一批 MacBook
+	EventReasonWaveStarted = "WaveStarted"
+	// EventReasonRolloutHalted 失败的 MacBook 达到阈值，MacBookSet 停止发布，类型为 Warning
+	EventReasonRolloutHalted = "RolloutHalted"
+	// EventReasonHookStarted 为新的 pod 模板创建了 hook job
+	EventReasonHookStarted = "HookStarted"
+	// EventReasonHookSucceeded hook job 完成
+	EventReasonHookSucceeded = "HookSucceeded"
+	// EventReasonHookFailed hook job 失败，类型为 Warning
+	EventReasonHookFailed = "HookFailed"
+)
+
+const (
+	// defaultEventDedupWindow 相同对象上完全相同的事件在窗口期内只记录一次
+	defaultEventDedupWindow = 10 * time.Minute
+	// defaultEventBurst 和 defaultEventQPS 是每个对象的事件令牌桶
+	defaultEventBurst = 10
+	defaultEventQPS   = 1.0 / 30
+	// eventCacheSize 最多跟踪的对象和事件数量
+	eventCacheSize = 4096
+)
+
+// NewEventRecorder 包装 manager 的 EventRecorder，对每个对象的事件去重并限速，
+// 避免 kubectl describe 被重复的事件刷屏
+func NewEventRecorder(recorder record.EventRecorder) record.EventRecorder {
+	return &dedupRecorder{
+		EventRecorder: recorder,
+		window:        defaultEventDedupWindow,
+		seen:          cache.NewLRUExpireCache(eventCacheSize),
+		limiters:      cache.NewLRUExpireCache(eventCacheSize),
+	}
+}
+
+type dedupRecorder struct {
+	record.EventRecorder
+	window time.Duration
+	// seen 记录窗口期内已经发出的事件
+	seen *cache.LRUExpireCache
+	// limiters 每个对象一个令牌桶
+	limiters *cache.LRUExpireCache
+}
+
+func (d *dedupRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if d.allow(object, eventtype, reason, message) {
+		d.EventRecorder.Event(object, eventtype, reason, message)
+	}
+}
+
+func (d *dedupRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if d.allow(object, eventtype, reason, message) {
+		d.EventRecorder.Event(object, eventtype, reason, message)
+	}
+}
+
+func (d *dedupRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if d.allow(object, eventtype, reason, message) {
+		d.EventRecorder.AnnotatedEventf(object, annotations, eventtype, reason, "%s", message)
+	}
+}
+
+// allow 判断事件是否需要发出：窗口期内重复的事件直接丢弃，否则消耗对象的一个令牌
+// Warning 事件不受令牌桶限制，失败信息不能被正常事件挤掉
+func (d *dedupRecorder) allow(object runtime.Object, eventtype, reason, message string) bool {
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		return true
+	}
+	uid := accessor.GetUID()
+	key := fmt.Sprintf("%s/%s/%s/%s", uid, eventtype, reason, message)
+	if _, ok := d.seen.Get(key); ok {
+		return false
+	}
+
+	if eventtype != corev1.EventTypeWarning {
+		var limiter flowcontrol.RateLimiter
+		if v, ok := d.limiters.Get(uid); ok {
+			limiter = v.(flowcontrol.RateLimiter)
+		} else {
+			limiter = flowcontrol.NewTokenBucketRateLimiter(defaultEventQPS, defaultEventBurst)
+		}
+		d.limiters.Add(uid, limiter, time.Hour)
+		if !limiter.TryAccept() {
+			return false
+		}
+	}
+
+	d.seen.Add(key, struct{}{}, d.window)
+	return true
+}
+
+// recordEvent 在 MacBook 或其子资源上记录事件，并带上当前调协的 trace 信息
+func (r *MacBookReconciler) recordEvent(ctx context.Context, object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Recorder.AnnotatedEventf(object, tracing.EventAnnotations(ctx), eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ExtendAnnotation 延长过期时间，值为 Go duration，例如 24h
+const ExtendAnnotation = "mock.dong.com/extend-by"
+
+// expiryWarnings 距离过期还剩这些时间时各发一次 Warning 事件，从大到小排列
+var expiryWarnings = []time.Duration{24 * time.Hour, time.Hour, 10 * time.Minute}
+
+// checkExpiry 计算 MacBook 的过期时间写入 status.expiry，临近过期时发出 Warning 事件，
+// 过期后删除 MacBook，清理交给 finalizer。返回 true 表示 MacBook 已经被删除，本次调协结束
+func (r *MacBookReconciler) checkExpiry(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) (bool, *reconcileError) {
+	var expiresAt time.Time
+	if ttl := MacBook.Spec.TTLSecondsAfterCreation; ttl != nil {
+		expiresAt = MacBook.CreationTimestamp.Add(time.Duration(*ttl) * time.Second)
+	}
+	if at := MacBook.Spec.ExpiresAt; at != nil && (expiresAt.IsZero() || at.Before(&metav1.Time{Time: expiresAt})) {
+		expiresAt = at.Time
+	}
+	if expiresAt.IsZero() {
+		MacBook.Status.Expiry = nil
+		return false, nil
+	}
+
+	st := MacBook.Status.Expiry
+	if st == nil {
+		st = &mockv1beta1.ExpiryStatus{}
+		MacBook.Status.Expiry = st
+	}
+	st.Message = ""
+	if v, ok := MacBook.Annotations[ExtendAnnotation]; ok {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			st.Message = fmt.Sprintf("ignoring annotation %s=%q: expected a positive duration such as 24h", ExtendAnnotation, v)
+		} else {
+			expiresAt = expiresAt.Add(d)
+		}
+	}
+	st.ExpiresAt = metav1.NewTime(expiresAt.UTC().Truncate(time.Second))
+
+	now := time.Now()
+	remaining := st.ExpiresAt.Sub(now)
+	if remaining <= 0 {
+		clog.Info("MacBook expired, deleting", "expiresAt", st.ExpiresAt.Time)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeWarning, EventReasonExpired, "Expired at %s, deleting", st.ExpiresAt.Format(time.RFC3339))
+		// 带上 uid 前置条件，避免删掉同名的新对象
+		if err := r.Delete(ctx, MacBook, client.Preconditions{UID: &MacBook.UID}); err != nil {
+			return false, classifyMacBookError("ExpiryDeleteFailed", err)
+		}
+		return true, nil
+	}
+
+	// 跨过一个提醒阈值时发一次事件，延长过期时间后重新计算
+	if w := expiryWarning(remaining); w > 0 && (st.WarnedAt == nil || expiryWarning(st.ExpiresAt.Sub(st.WarnedAt.Time)) != w) {
+		warnedAt := metav1.NewTime(now)
+		st.WarnedAt = &warnedAt
+		r.recordEvent(ctx, MacBook, corev1.EventTypeWarning, EventReasonExpiringSoon, "Expires at %s (in %s), set the %s annotation to extend it",
+			st.ExpiresAt.Format(time.RFC3339), remaining.Round(time.Second), ExtendAnnotation)
+	}
+
+	// 在下一个提醒阈值或者过期时重新调协
+	next := remaining
+	for _, w := range expiryWarnings {
+		if remaining > w {
+			next = remaining - w
+			break
+		}
+	}
+	requeueAfter(ctx, next)
+	return false, nil
+}
+
+// expiryWarning 返回 remaining 所在的最小提醒阈值，还没到任何阈值时返回 0
+func expiryWarning(remaining time.Duration) time.Duration {
+	var warning time.Duration
+	for _, w := range expiryWarnings {
+		if remaining <= w {
+			warning = w
+		}
+	}
+	return warning
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestExpiryWarning(t *testing.T) {
+	tests := []struct {
+		remaining time.Duration
+		want      time.Duration
+	}{
+		{48 * time.Hour, 0},
+		{24 * time.Hour, 24 * time.Hour},
+		{2 * time.Hour, 24 * time.Hour},
+		{time.Hour, time.Hour},
+		{30 * time.Minute, time.Hour},
+		{5 * time.Minute, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := expiryWarning(tt.remaining); got != tt.want {
+			t.Errorf("expiryWarning(%s) = %s, want %s", tt.remaining, got, tt.want)
+		}
+	}
+}
+
+func TestCheckExpiry(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *metav1.Time {
+		t := metav1.NewTime(now.Add(d))
+		return &t
+	}
+	threeHours := int64(3 * 3600)
+	tests := []struct {
+		name        string
+		ttl         *int64
+		expiresAt   *metav1.Time
+		extend      string
+		warnedAt    *metav1.Time
+		wantExpiry  bool
+		wantDeleted bool
+		// wantRemaining 为 status.expiry 中的过期时间距离现在的时间
+		wantRemaining time.Duration
+		wantWarning   bool
+		wantMessage   bool
+	}{
+		{name: "no expiry"},
+		{name: "far from expiry", expiresAt: at(48 * time.Hour), wantExpiry: true, wantRemaining: 48 * time.Hour},
+		{name: "ttl after creation", ttl: &threeHours, wantExpiry: true, wantRemaining: 2 * time.Hour, wantWarning: true},
+		{
+			name:          "earlier of ttl and expiresAt",
+			ttl:           &threeHours,
+			expiresAt:     at(30 * time.Minute),
+			wantExpiry:    true,
+			wantRemaining: 30 * time.Minute,
+			wantWarning:   true,
+		},
+		{name: "warned once per threshold", expiresAt: at(30 * time.Minute), warnedAt: at(-5 * time.Minute), wantExpiry: true, wantRemaining: 30 * time.Minute},
+		{name: "extended", expiresAt: at(30 * time.Minute), extend: "48h", wantExpiry: true, wantRemaining: 48*time.Hour + 30*time.Minute},
+		{name: "invalid extension ignored", expiresAt: at(48 * time.Hour), extend: "soon", wantExpiry: true, wantRemaining: 48 * time.Hour, wantMessage: true},
+		{name: "expired", expiresAt: at(-time.Minute), wantExpiry: true, wantDeleted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.CreationTimestamp = metav1.NewTime(now.Add(-time.Hour))
+			MacBook.Spec.TTLSecondsAfterCreation = tt.ttl
+			MacBook.Spec.ExpiresAt = tt.expiresAt
+			if tt.extend != "" {
+				MacBook.Annotations = map[string]string{ExtendAnnotation: tt.extend}
+			}
+			if tt.warnedAt != nil {
+				MacBook.Status.Expiry = &mockv1beta1.ExpiryStatus{WarnedAt: tt.warnedAt}
+			}
+			r := newFakeReconciler(t, MacBook.DeepCopy())
+			recorder := r.Recorder.(*record.FakeRecorder)
+			ctx := withRequeue(context.Background())
+
+			deleted, rerr := r.checkExpiry(ctx, ctrl.Log, MacBook)
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+
+			if deleted != tt.wantDeleted {
+				t.Errorf("deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+			err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "mac"}, &mockv1beta1.MacBook{})
+			if gone := apierrors.IsNotFound(err); gone != tt.wantDeleted {
+				t.Errorf("MacBook deleted from the cluster = %v (%v), want %v", gone, err, tt.wantDeleted)
+			}
+			st := MacBook.Status.Expiry
+			if (st != nil) != tt.wantExpiry {
+				t.Fatalf("status.expiry = %+v, want set %v", st, tt.wantExpiry)
+			}
+			if st == nil || tt.wantDeleted {
+				return
+			}
+			if remaining := st.ExpiresAt.Sub(now); remaining < tt.wantRemaining-time.Second || remaining > tt.wantRemaining {
+				t.Errorf("expires in %s, want %s", remaining, tt.wantRemaining)
+			}
+			if warned := len(recorder.Events) > 0; warned != tt.wantWarning {
+				t.Errorf("warning event recorded = %v, want %v", warned, tt.wantWarning)
+			}
+			if (st.Message != "") != tt.wantMessage {
+				t.Errorf("message = %q, want set %v", st.Message, tt.wantMessage)
+			}
+			if requeueResult(ctx).RequeueAfter <= 0 {
+				t.Error("expected a requeue at the next warning threshold")
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/analysis"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LastAccessAnnotation MacBook 最近一次被访问的时间，RFC3339 格式。
+// 唤醒接口会更新它，外部系统也可以直接设置它上报访问时间
+const LastAccessAnnotation = "mock.dong.com/last-access"
+
+// defaultIdleMetricInterval spec.hibernation.metric.interval 为空时查询请求数的间隔
+const defaultIdleMetricInterval = time.Minute
+
+// applyHibernation 根据最近一次活动决定是否休眠，结果写入 status.hibernation，休眠时期望副本数为 0。
+// 活动来自 last-access 注解、spec 的修改以及请求数指标
+func (r *MacBookReconciler) applyHibernation(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) {
+	spec := MacBook.Spec.Hibernation
+	if spec == nil {
+		MacBook.Status.Hibernation = nil
+		return
+	}
+
+	now := metav1.Now()
+	st := MacBook.Status.Hibernation
+	if st == nil {
+		// 刚开启休眠时从现在开始计算空闲时间
+		st = &mockv1beta1.HibernationStatus{LastActivity: &now}
+		MacBook.Status.Hibernation = st
+	}
+	st.Message = ""
+	activity := func(t metav1.Time) {
+		if st.LastActivity == nil || t.After(st.LastActivity.Time) {
+			st.LastActivity = &t
+		}
+	}
+
+	if v, ok := MacBook.Annotations[LastAccessAnnotation]; ok {
+		if t, err := time.Parse(time.RFC3339, v); err != nil {
+			st.Message = fmt.Sprintf("ignoring annotation %s: %v", LastAccessAnnotation, err)
+		} else {
+			activity(metav1.NewTime(t))
+		}
+	}
+	// 修改 spec 也算一次活动，休眠的 MacBook 被编辑后会唤醒
+	if MacBook.Generation != MacBook.Status.ObservedGeneration {
+		activity(now)
+	}
+
+	if st.Hibernated {
+		// 休眠期间没有新的活动，保持休眠，等待注解变化触发调协
+		if st.HibernatedAt != nil && !st.LastActivity.After(st.HibernatedAt.Time) {
+			st.Message = fmt.Sprintf("idle since %s", st.LastActivity.Format(time.RFC3339))
+			return
+		}
+		st.Hibernated = false
+		st.HibernatedAt = nil
+		clog.Info("waking up", "lastActivity", st.LastActivity.Time)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonWokenUp, "Woken up by activity at %s", st.LastActivity.Format(time.RFC3339))
+	}
+
+	// 请求数指标按间隔查询，最近一次查询失败时不休眠，直到之后的查询成功，避免监控故障导致服务被缩容
+	wait := spec.IdleAfter.Duration
+	if m := spec.Metric; m != nil {
+		interval := defaultIdleMetricInterval
+		if m.Interval != nil {
+			interval = m.Interval.Duration
+		}
+		if st.LastMetricCheck == nil || now.Sub(st.LastMetricCheck.Time) >= interval {
+			st.LastMetricCheck = &now
+			requests, err := queryIdleMetric(ctx, MacBook, m)
+			switch {
+			case err != nil:
+				st.LastMetricError = err.Error()
+			case requests > 0:
+				st.LastMetricError = ""
+				activity(now)
+			default:
+				st.LastMetricError = ""
+			}
+		}
+		if next := interval - now.Sub(st.LastMetricCheck.Time); next < wait {
+			wait = next
+		}
+	} else {
+		st.LastMetricError = ""
+	}
+	if st.LastMetricError != "" {
+		st.Message = "request-count query failed: " + st.LastMetricError
+	}
+
+	idle := now.Sub(st.LastActivity.Time)
+	if idle >= spec.IdleAfter.Duration && st.LastMetricError == "" {
+		st.Hibernated = true
+		st.HibernatedAt = &now
+		st.Message = fmt.Sprintf("idle since %s", st.LastActivity.Format(time.RFC3339))
+		clog.Info("hibernating", "idle", idle.String())
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonHibernated, "Scaled to zero after %s without activity", idle.Round(time.Second))
+		return
+	}
+	if remaining := spec.IdleAfter.Duration - idle; remaining > 0 && remaining < wait {
+		wait = remaining
+	}
+	requeueAfter(ctx, wait)
+}
+
+func queryIdleMetric(ctx context.Context, MacBook *mockv1beta1.MacBook, m *mockv1beta1.IdleMetric) (float64, error) {
+	prom, err := analysis.NewPrometheus(m.Address)
+	if err != nil {
+		return 0, err
+	}
+	query := strings.NewReplacer("{{namespace}}", MacBook.Namespace, "{{name}}", MacBook.Name).Replace(m.Query)
+	qctx, cancel := context.WithTimeout(ctx, analysisQueryTimeout)
+	defer cancel()
+	value, err := prom.Query(qctx, query)
+	// 没有数据说明没有请求
+	if err == analysis.ErrNoData {
+		return 0, nil
+	}
+	return value, err
+}
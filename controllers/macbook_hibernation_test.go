@@ -0,0 +1,130 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestApplyHibernation(t *testing.T) {
+	ago := func(d time.Duration) *metav1.Time {
+		t := metav1.NewTime(time.Now().Add(-d))
+		return &t
+	}
+	tests := []struct {
+		name string
+		// value 为请求数指标的值，空字符串表示 Prometheus 返回错误，nil 表示没有配置指标
+		value       *string
+		annotation  *metav1.Time
+		prev        *mockv1beta1.HibernationStatus
+		wantAsleep  bool
+		wantError   bool
+		wantRequeue bool
+	}{
+		{
+			name:       "idle without a metric",
+			prev:       &mockv1beta1.HibernationStatus{LastActivity: ago(20 * time.Minute)},
+			wantAsleep: true,
+		},
+		{
+			name:        "recently active",
+			prev:        &mockv1beta1.HibernationStatus{LastActivity: ago(time.Minute)},
+			wantRequeue: true,
+		},
+		{
+			name:        "access annotation wakes up",
+			annotation:  ago(0),
+			prev:        &mockv1beta1.HibernationStatus{Hibernated: true, HibernatedAt: ago(5 * time.Minute), LastActivity: ago(20 * time.Minute)},
+			wantRequeue: true,
+		},
+		{
+			name:       "stays asleep without activity",
+			prev:       &mockv1beta1.HibernationStatus{Hibernated: true, HibernatedAt: ago(5 * time.Minute), LastActivity: ago(20 * time.Minute)},
+			wantAsleep: true,
+		},
+		{
+			name:       "idle by the metric",
+			value:      stringPtr("0"),
+			prev:       &mockv1beta1.HibernationStatus{LastActivity: ago(20 * time.Minute)},
+			wantAsleep: true,
+		},
+		{
+			name:        "requests are activity",
+			value:       stringPtr("5"),
+			prev:        &mockv1beta1.HibernationStatus{LastActivity: ago(20 * time.Minute)},
+			wantRequeue: true,
+		},
+		{
+			name:        "metric error holds hibernation",
+			value:       stringPtr(""),
+			prev:        &mockv1beta1.HibernationStatus{LastActivity: ago(20 * time.Minute)},
+			wantError:   true,
+			wantRequeue: true,
+		},
+		{
+			name:        "earlier metric error holds hibernation until the next query",
+			value:       stringPtr("0"),
+			prev:        &mockv1beta1.HibernationStatus{LastActivity: ago(20 * time.Minute), LastMetricCheck: ago(10 * time.Second), LastMetricError: "unavailable"},
+			wantError:   true,
+			wantRequeue: true,
+		},
+		{
+			name:       "successful query clears the error",
+			value:      stringPtr("0"),
+			prev:       &mockv1beta1.HibernationStatus{LastActivity: ago(20 * time.Minute), LastMetricCheck: ago(2 * time.Minute), LastMetricError: "unavailable"},
+			wantAsleep: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.Hibernation = &mockv1beta1.HibernationSpec{IdleAfter: metav1.Duration{Duration: 10 * time.Minute}}
+			if tt.value != nil {
+				server := fakeAnalysisPrometheus(*tt.value)
+				defer server.Close()
+				MacBook.Spec.Hibernation.Metric = &mockv1beta1.IdleMetric{Address: server.URL, Query: "requests"}
+			}
+			if tt.annotation != nil {
+				MacBook.Annotations = map[string]string{LastAccessAnnotation: tt.annotation.UTC().Format(time.RFC3339)}
+			}
+			MacBook.Status.Hibernation = tt.prev
+			r := newFakeReconciler(t)
+			ctx := withRequeue(context.Background())
+
+			r.applyHibernation(ctx, ctrl.Log, MacBook)
+
+			st := MacBook.Status.Hibernation
+			if st.Hibernated != tt.wantAsleep {
+				t.Errorf("hibernated = %v (%s), want %v", st.Hibernated, st.Message, tt.wantAsleep)
+			}
+			if (st.LastMetricError != "") != tt.wantError {
+				t.Errorf("last metric error = %q, want set %v", st.LastMetricError, tt.wantError)
+			}
+			if requeue := requeueResult(ctx).RequeueAfter > 0; requeue != tt.wantRequeue {
+				t.Errorf("requeue = %v, want %v", requeue, tt.wantRequeue)
+			}
+		})
+	}
+}
+
+func stringPtr(s string) *string { return &s }
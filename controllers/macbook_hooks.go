@@ -0,0 +1,296 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// hook 失败的原因，记录在 FailedRevision 中
+const (
+	hookReasonPreDeployFailed  = "PreDeployHookFailed"
+	hookReasonPostDeployFailed = "PostDeployHookFailed"
+)
+
+// desiredTemplateHash 当前 spec 生成的 pod 模板的哈希，hook 和 revision 的结果都按它对应到版本
+func desiredTemplateHash(ctx context.Context, MacBook *mockv1beta1.MacBook) string {
+	return tools.TemplateHash(&injectConsumedEnv(ctx, tools.NewDeployMent(MacBook, classFrom(ctx))).Spec.Template)
+}
+
+func preDeployHook(MacBook *mockv1beta1.MacBook) *mockv1beta1.Hook {
+	if MacBook.Spec.Hooks == nil {
+		return nil
+	}
+	return MacBook.Spec.Hooks.PreDeploy
+}
+
+func postDeployHook(MacBook *mockv1beta1.MacBook) *mockv1beta1.Hook {
+	if MacBook.Spec.Hooks == nil {
+		return nil
+	}
+	return MacBook.Spec.Hooks.PostDeploy
+}
+
+// phaseHook 阶段对应的 hook
+func phaseHook(MacBook *mockv1beta1.MacBook, phase string) *mockv1beta1.Hook {
+	if phase == mockv1beta1.HookPreDeploy {
+		return preDeployHook(MacBook)
+	}
+	return postDeployHook(MacBook)
+}
+
+// clearEditedHookFailure 当前模板因为 hook 失败记为失败的版本，而用户之后修改或删除了这个 hook 时，
+// 清除失败的版本，用新的 hook 重新尝试这个模板
+func clearEditedHookFailure(clog logr.Logger, MacBook *mockv1beta1.MacBook, templateHash string) {
+	failed := MacBook.Status.FailedRevision
+	if failed == nil || failed.TemplateHash != templateHash {
+		return
+	}
+	var phase string
+	switch failed.Reason {
+	case hookReasonPreDeployFailed:
+		phase = mockv1beta1.HookPreDeploy
+	case hookReasonPostDeployFailed:
+		phase = mockv1beta1.HookPostDeploy
+	default:
+		return
+	}
+	if failed.HookHash == tools.HookHash(phaseHook(MacBook, phase)) {
+		return
+	}
+	clog.Info("failed hook was edited, retrying revision", "phase", phase, "templateHash", templateHash)
+	MacBook.Status.FailedRevision = nil
+}
+
+// hookField spec.hooks 中阶段对应的字段名，用于错误信息
+func hookField(phase string) string {
+	if phase == mockv1beta1.HookPreDeploy {
+		return "preDeploy"
+	}
+	return "postDeploy"
+}
+
+// runPreDeployHook 新的 pod 模板发布前运行 preDeploy hook，返回 false 时本次调协不创建或更新工作负载。
+// hook 失败的模板记为失败的版本：有可用版本时继续运行可用版本（由 applyKnownGood 处理），没有时报告终止性错误
+func (r *MacBookReconciler) runPreDeployHook(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) (bool, *reconcileError) {
+	templateHash := desiredTemplateHash(ctx, MacBook)
+	clearEditedHookFailure(clog, MacBook, templateHash)
+	if MacBook.Spec.Hooks == nil {
+		MacBook.Status.Hooks = nil
+		return true, nil
+	}
+	// status.hooks 只保留当前模板和当前 hook 的结果
+	var hooks []mockv1beta1.HookStatus
+	for _, st := range MacBook.Status.Hooks {
+		if st.TemplateHash == templateHash && st.HookHash == tools.HookHash(phaseHook(MacBook, st.Phase)) {
+			hooks = append(hooks, st)
+		}
+	}
+	MacBook.Status.Hooks = hooks
+
+	hook := preDeployHook(MacBook)
+	if hook == nil {
+		return true, nil
+	}
+	// 已经发布成功的模板不再运行
+	if good := MacBook.Status.LastKnownGood; good != nil && good.TemplateHash == templateHash {
+		return true, nil
+	}
+	if failed := MacBook.Status.FailedRevision; failed != nil && failed.TemplateHash == templateHash {
+		if MacBook.Status.LastKnownGood != nil {
+			return true, nil
+		}
+		return false, terminalError(failed.Reason, fmt.Errorf("revision %s failed: %s", templateHash, failed.Message))
+	}
+	// 维护窗口外 deployment 的模板变化被暂缓，窗口开始后再运行 hook
+	if changesHeld(MacBook) {
+		exists, err := r.deploymentExists(ctx, MacBook)
+		if err != nil {
+			return false, classifyError("DeploymentGetFailed", err)
+		}
+		if exists {
+			return true, nil
+		}
+	}
+
+	st, rerr := r.runHook(ctx, clog, MacBook, mockv1beta1.HookPreDeploy, hook, templateHash)
+	if rerr != nil {
+		return false, rerr
+	}
+	switch st.Result {
+	case mockv1beta1.HookSucceeded:
+		return true, nil
+	case mockv1beta1.HookFailed:
+		message := fmt.Sprintf("pre-deploy hook %s failed: %s", st.Job, st.Message)
+		MacBook.Status.FailedRevision = &mockv1beta1.FailedRevision{
+			TemplateHash: templateHash,
+			Reason:       hookReasonPreDeployFailed,
+			Message:      message,
+			HookHash:     st.HookHash,
+			Time:         metav1.Now(),
+		}
+		if MacBook.Status.LastKnownGood != nil {
+			return true, nil
+		}
+		return false, terminalError(hookReasonPreDeployFailed, fmt.Errorf("revision %s failed: %s", templateHash, message))
+	}
+	// job 结束后通过 Owns 触发调协
+	return false, nil
+}
+
+// runPostDeployHook 新的 pod 模板发布完成后运行 postDeploy hook，返回 true 表示版本可以记为可用版本。
+// hook 失败时和发布失败一样回滚到最近一次可用的模板
+func (r *MacBookReconciler) runPostDeployHook(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, found *appsv1.Deployment, templateHash string) (bool, *reconcileError) {
+	hook := postDeployHook(MacBook)
+	if hook == nil {
+		return true, nil
+	}
+	st, rerr := r.runHook(ctx, clog, MacBook, mockv1beta1.HookPostDeploy, hook, templateHash)
+	if rerr != nil {
+		return false, rerr
+	}
+	switch st.Result {
+	case mockv1beta1.HookSucceeded:
+		return true, nil
+	case mockv1beta1.HookFailed:
+		rerr := r.rollBack(ctx, clog, MacBook, found, templateHash, hookReasonPostDeployFailed, fmt.Sprintf("post-deploy hook %s failed: %s", st.Job, st.Message))
+		// 记录失败的 hook，修改 hook 后重新发布这个模板
+		if failed := MacBook.Status.FailedRevision; failed != nil && failed.TemplateHash == templateHash {
+			failed.HookHash = st.HookHash
+		}
+		return false, rerr
+	}
+	return false, nil
+}
+
+// runHook 模板的 hook job 不存在就创建，返回 job 的结果并写入 status.hooks。
+// job 的名称包含模板和 hook 的哈希，每个模板和 hook 只运行一次，新的 job 创建后删除同一阶段旧的 job
+func (r *MacBookReconciler) runHook(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, phase string, hook *mockv1beta1.Hook, templateHash string) (mockv1beta1.HookStatus, *reconcileError) {
+	hookHash := tools.HookHash(hook)
+	name := tools.HookJobName(MacBook, phase, templateHash, hookHash)
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: MacBook.Namespace, Name: name}, job)
+	switch {
+	case apierrors.IsNotFound(err):
+		job, err = tools.NewHookJob(MacBook, phase, hook, templateHash)
+		if err != nil {
+			return mockv1beta1.HookStatus{}, terminalError("InvalidHooks", fmt.Errorf("spec.hooks.%s: %w", hookField(phase), err))
+		}
+		mergeConsumedEnv(ctx, job.Spec.Template.Spec.Containers)
+		if err := controllerutil.SetControllerReference(MacBook, job, r.Scheme); err != nil {
+			return mockv1beta1.HookStatus{}, terminalError("SetControllerReferenceFailed", err)
+		}
+		if err := r.Create(ctx, job); err != nil {
+			return mockv1beta1.HookStatus{}, classifyError("HookJobCreateFailed", err)
+		}
+		clog.Info("hook job create ok", "phase", phase, "job", name)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonHookStarted, "Started %s hook job %s for pod template %s", phase, name, templateHash)
+		if rerr := r.pruneHookJobs(ctx, clog, MacBook, phase, name); rerr != nil {
+			return mockv1beta1.HookStatus{}, rerr
+		}
+	case err != nil:
+		return mockv1beta1.HookStatus{}, classifyError("HookJobGetFailed", err)
+	case !metav1.IsControlledBy(job, MacBook):
+		return mockv1beta1.HookStatus{}, terminalError("HookJobConflict", fmt.Errorf("job %s exists and is not owned by MacBook %s", name, MacBook.Name))
+	}
+
+	st := hookStatus(phase, job, templateHash, hookHash)
+	var prev *mockv1beta1.HookStatus
+	for i := range MacBook.Status.Hooks {
+		if MacBook.Status.Hooks[i].Phase == phase {
+			prev = &MacBook.Status.Hooks[i]
+		}
+	}
+	// 结果第一次出现时记录事件
+	if prev == nil || prev.Result != st.Result {
+		switch st.Result {
+		case mockv1beta1.HookSucceeded:
+			r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonHookSucceeded, "%s hook job %s completed", phase, name)
+		case mockv1beta1.HookFailed:
+			r.recordEvent(ctx, MacBook, corev1.EventTypeWarning, EventReasonHookFailed, "%s hook job %s failed: %s", phase, name, st.Message)
+		}
+	}
+	if prev != nil {
+		*prev = st
+	} else {
+		MacBook.Status.Hooks = append(MacBook.Status.Hooks, st)
+	}
+	return st, nil
+}
+
+// hookStatus 根据 job 的 condition 判断 hook 的结果
+func hookStatus(phase string, job *batchv1.Job, templateHash, hookHash string) mockv1beta1.HookStatus {
+	st := mockv1beta1.HookStatus{
+		Phase:        phase,
+		Job:          job.Name,
+		TemplateHash: templateHash,
+		HookHash:     hookHash,
+		Result:       mockv1beta1.HookRunning,
+	}
+	if !job.CreationTimestamp.IsZero() {
+		start := job.CreationTimestamp
+		st.StartTime = &start
+	}
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			st.Result = mockv1beta1.HookSucceeded
+			st.CompletionTime = job.Status.CompletionTime
+		case batchv1.JobFailed:
+			st.Result = mockv1beta1.HookFailed
+			st.Message = fmt.Sprintf("%s: %s", c.Reason, c.Message)
+			finished := c.LastTransitionTime
+			st.CompletionTime = &finished
+		}
+	}
+	return st
+}
+
+// pruneHookJobs 删除 MacBook 同一阶段旧模板或旧 hook 的 job，pod 一起删除
+func (r *MacBookReconciler) pruneHookJobs(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, phase, keep string) *reconcileError {
+	jobs := &batchv1.JobList{}
+	if err := r.List(ctx, jobs, client.InNamespace(MacBook.Namespace), client.MatchingLabels{tools.MacBookLabel: MacBook.Name, tools.HookLabel: phase}); err != nil {
+		return classifyError("HookJobListFailed", err)
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if job.Name == keep || !metav1.IsControlledBy(job, MacBook) {
+			continue
+		}
+		if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !apierrors.IsNotFound(err) {
+			return classifyError("HookJobDeleteFailed", err)
+		}
+		clog.Info("hook job delete ok", "phase", phase, "job", job.Name)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// failedHookJob MacBook 拥有的已经失败的 hook job
+func failedHookJob(t *testing.T, MacBook *mockv1beta1.MacBook, phase string, hook *mockv1beta1.Hook, templateHash string) *batchv1.Job {
+	t.Helper()
+	job, err := tools.NewHookJob(MacBook, phase, hook, templateHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(MacBook, mockv1beta1.GroupVersion.WithKind("MacBook"))}
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded"}}
+	return job
+}
+
+func TestRunPreDeployHookAfterFailure(t *testing.T) {
+	failedHook := &mockv1beta1.Hook{Command: []string{"migrate", "--broken"}}
+	fixedHook := &mockv1beta1.Hook{Command: []string{"migrate"}}
+
+	tests := []struct {
+		name string
+		// failedPhase 失败的 hook 所在的阶段
+		failedPhase string
+		hooks       *mockv1beta1.MacBookHooks
+		wantProceed bool
+		wantFailed  bool
+		// wantNewJob 期望创建一个新的 preDeploy job，并删除失败的 job
+		wantNewJob bool
+	}{
+		{
+			name:        "unchanged preDeploy hook stays failed",
+			failedPhase: mockv1beta1.HookPreDeploy,
+			hooks:       &mockv1beta1.MacBookHooks{PreDeploy: failedHook},
+			wantFailed:  true,
+		},
+		{
+			name:        "edited preDeploy hook runs a new job",
+			failedPhase: mockv1beta1.HookPreDeploy,
+			hooks:       &mockv1beta1.MacBookHooks{PreDeploy: fixedHook},
+			wantNewJob:  true,
+		},
+		{
+			name:        "removed preDeploy hook retries the revision",
+			failedPhase: mockv1beta1.HookPreDeploy,
+			wantProceed: true,
+		},
+		{
+			name:        "unchanged postDeploy hook stays failed",
+			failedPhase: mockv1beta1.HookPostDeploy,
+			hooks:       &mockv1beta1.MacBookHooks{PostDeploy: failedHook},
+			wantProceed: true,
+			wantFailed:  true,
+		},
+		{
+			name:        "edited postDeploy hook retries the revision",
+			failedPhase: mockv1beta1.HookPostDeploy,
+			hooks:       &mockv1beta1.MacBookHooks{PostDeploy: fixedHook},
+			wantProceed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			MacBook := newTestMacBook()
+			MacBook.Spec.Hooks = tt.hooks
+			templateHash := desiredTemplateHash(ctx, MacBook)
+			reason := hookReasonPreDeployFailed
+			if tt.failedPhase == mockv1beta1.HookPostDeploy {
+				reason = hookReasonPostDeployFailed
+				// postDeploy 失败后回滚到可用版本
+				MacBook.Status.LastKnownGood = &mockv1beta1.KnownGoodRevision{TemplateHash: "good", Spec: *MacBook.Spec.DeepCopy()}
+			}
+			job := failedHookJob(t, MacBook, tt.failedPhase, failedHook, templateHash)
+			MacBook.Status.FailedRevision = &mockv1beta1.FailedRevision{
+				TemplateHash: templateHash,
+				Reason:       reason,
+				HookHash:     tools.HookHash(failedHook),
+			}
+			MacBook.Status.Hooks = []mockv1beta1.HookStatus{hookStatus(tt.failedPhase, job, templateHash, tools.HookHash(failedHook))}
+			r := newFakeReconciler(t, MacBook, job)
+
+			proceed, rerr := r.runPreDeployHook(ctx, ctrl.Log, MacBook)
+			if proceed != tt.wantProceed {
+				t.Errorf("proceed = %v, want %v", proceed, tt.wantProceed)
+			}
+			if terminal := rerr != nil && rerr.class == errorTerminal; terminal != (tt.wantFailed && !tt.wantProceed) || rerr != nil && !terminal {
+				t.Errorf("error = %v, want terminal %v", rerr, tt.wantFailed && !tt.wantProceed)
+			}
+			if failed := MacBook.Status.FailedRevision != nil; failed != tt.wantFailed {
+				t.Errorf("failed revision = %+v, want failed %v", MacBook.Status.FailedRevision, tt.wantFailed)
+			}
+
+			jobs := &batchv1.JobList{}
+			if err := r.List(ctx, jobs, client.InNamespace(MacBook.Namespace)); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantNewJob {
+				if len(jobs.Items) != 1 || jobs.Items[0].Name != job.Name {
+					t.Errorf("jobs = %v, want only the failed job %s", jobs.Items, job.Name)
+				}
+				return
+			}
+			want := tools.HookJobName(MacBook, mockv1beta1.HookPreDeploy, templateHash, tools.HookHash(fixedHook))
+			if want == job.Name {
+				t.Fatalf("edited hook reuses job name %s", want)
+			}
+			if len(jobs.Items) != 1 || jobs.Items[0].Name != want {
+				t.Errorf("jobs = %v, want only the new job %s", jobs.Items, want)
+			}
+			if len(MacBook.Status.Hooks) != 1 || MacBook.Status.Hooks[0].Job != want || MacBook.Status.Hooks[0].Result != mockv1beta1.HookRunning {
+				t.Errorf("status.hooks = %+v, want the running job %s", MacBook.Status.Hooks, want)
+			}
+		})
+	}
+}
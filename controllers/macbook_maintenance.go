@@ -0,0 +1,189 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/yaml"
+)
+
+// MaintenanceConfigKey 全局维护窗口 ConfigMap 中的 key，值是 MaintenanceWindow 的 YAML 列表
+const MaintenanceConfigKey = "windows"
+
+// applyMaintenance 计算当前是否处于维护窗口，结果写入 status.maintenance，并在窗口打开或关闭时重新调协。
+// 窗口外会重启 pod 的变化被暂缓，记录在 status.maintenance.pending 中，扩缩容不受影响
+func (r *MacBookReconciler) applyMaintenance(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) *reconcileError {
+	windows, rerr := r.maintenanceWindows(ctx, MacBook)
+	if rerr != nil {
+		return rerr
+	}
+	if len(windows) == 0 {
+		MacBook.Status.Maintenance = nil
+		removeCondition(&MacBook.Status.Conditions, mockv1beta1.ConditionPendingChanges)
+		return nil
+	}
+
+	now := time.Now()
+	st := &mockv1beta1.MaintenanceStatus{}
+	var next time.Time
+	for _, w := range windows {
+		if w.Duration.Duration <= 0 {
+			return terminalError("InvalidMaintenanceWindow", fmt.Errorf("maintenance window %q: duration must be positive", w.Schedule))
+		}
+		sched, err := tools.ParseSchedule(w.Schedule, w.TimeZone)
+		if err != nil {
+			return terminalError("InvalidMaintenanceWindow", fmt.Errorf("maintenance window %q: %w", w.Schedule, err))
+		}
+		in, end, start := sched.Window(now, w.Duration.Duration)
+		if in && (st.WindowEnd == nil || end.After(st.WindowEnd.Time)) {
+			st.InWindow = true
+			windowEnd := metav1.NewTime(end)
+			st.WindowEnd = &windowEnd
+		}
+		if !start.IsZero() && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	if !next.IsZero() {
+		nextWindow := metav1.NewTime(next)
+		st.NextWindow = &nextWindow
+	}
+	if prev := MacBook.Status.Maintenance; prev == nil || prev.InWindow != st.InWindow {
+		clog.Info("maintenance window changed", "inWindow", st.InWindow)
+	}
+	MacBook.Status.Maintenance = st
+
+	// 窗口打开时放出暂缓的变化，关闭时重新开始暂缓
+	switch {
+	case st.InWindow:
+		requeueAfter(ctx, st.WindowEnd.Sub(now))
+	case st.NextWindow != nil:
+		requeueAfter(ctx, st.NextWindow.Sub(now))
+	}
+	return nil
+}
+
+// maintenanceWindows MacBook 自己声明的窗口优先，否则使用全局 ConfigMap 中的窗口。
+// 全局 ConfigMap 不存在时没有窗口限制
+func (r *MacBookReconciler) maintenanceWindows(ctx context.Context, MacBook *mockv1beta1.MacBook) ([]mockv1beta1.MaintenanceWindow, *reconcileError) {
+	if len(MacBook.Spec.MaintenanceWindows) > 0 {
+		return MacBook.Spec.MaintenanceWindows, nil
+	}
+	if r.MaintenanceConfig.Name == "" {
+		return nil, nil
+	}
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, r.MaintenanceConfig, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, classifyError("MaintenanceConfigGetFailed", err)
+	}
+	var windows []mockv1beta1.MaintenanceWindow
+	if err := yaml.UnmarshalStrict([]byte(cm.Data[MaintenanceConfigKey]), &windows); err != nil {
+		return nil, terminalError("InvalidMaintenanceConfig", fmt.Errorf("configmap %s key %s: %w", r.MaintenanceConfig, MaintenanceConfigKey, err))
+	}
+	return windows, nil
+}
+
+// changesHeld 配置了维护窗口并且当前不在窗口内
+func changesHeld(MacBook *mockv1beta1.MacBook) bool {
+	st := MacBook.Status.Maintenance
+	return st != nil && !st.InWindow
+}
+
+// holdChange 记录一个被暂缓到下一个窗口的变化
+func holdChange(MacBook *mockv1beta1.MacBook, change string) {
+	st := MacBook.Status.Maintenance
+	st.Pending = append(st.Pending, change)
+}
+
+// templateHeld 本次调协暂缓了 pod 模板的变化
+func templateHeld(MacBook *mockv1beta1.MacBook) bool {
+	return changesHeld(MacBook) && len(MacBook.Status.Maintenance.Pending) > 0
+}
+
+// setPendingCondition 根据本次调协暂缓的变化设置 PendingChanges condition
+func setPendingCondition(MacBook *mockv1beta1.MacBook) {
+	st := MacBook.Status.Maintenance
+	if st == nil {
+		return
+	}
+	cond := metav1.Condition{
+		Type:               mockv1beta1.ConditionPendingChanges,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: MacBook.Generation,
+		Reason:             "NoPendingChanges",
+	}
+	if len(st.Pending) > 0 {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "OutsideMaintenanceWindow"
+		cond.Message = strings.Join(st.Pending, "; ")
+		if st.NextWindow != nil {
+			cond.Message += ", held until the maintenance window at " + st.NextWindow.UTC().Format(time.RFC3339)
+		}
+	}
+	meta.SetStatusCondition(&MacBook.Status.Conditions, cond)
+}
+
+// describeTemplateChange 描述 pod 模板的变化，优先列出镜像的修改
+func describeTemplateChange(name string, found, desired corev1.PodTemplateSpec) string {
+	images := make(map[string]string, len(found.Spec.Containers))
+	for _, c := range found.Spec.Containers {
+		images[c.Name] = c.Image
+	}
+	var changes []string
+	for _, c := range desired.Spec.Containers {
+		if image, ok := images[c.Name]; ok && image != c.Image {
+			changes = append(changes, fmt.Sprintf("%s image %s -> %s", c.Name, image, c.Image))
+		}
+	}
+	if len(changes) == 0 {
+		return fmt.Sprintf("pod template change of deployment %s", name)
+	}
+	return fmt.Sprintf("deployment %s: %s", name, strings.Join(changes, ", "))
+}
+
+// maintenanceConfigToMacBooks 全局维护窗口修改后重新调协所有 MacBook
+func (r *MacBookReconciler) maintenanceConfigToMacBooks(obj client.Object) []reconcile.Request {
+	if obj.GetNamespace() != r.MaintenanceConfig.Namespace || obj.GetName() != r.MaintenanceConfig.Name {
+		return nil
+	}
+	list := &mockv1beta1.MacBookList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "unable to list MacBooks for the maintenance config")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for i := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&list.Items[i])})
+	}
+	return requests
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestApplyMaintenance(t *testing.T) {
+	// alwaysOpen 每分钟打开两分钟，任何时候都在窗口内；neverOpen 永远不会打开
+	alwaysOpen := mockv1beta1.MaintenanceWindow{Schedule: "* * * * *", Duration: metav1.Duration{Duration: 2 * time.Minute}}
+	neverOpen := mockv1beta1.MaintenanceWindow{Schedule: "0 0 30 2 *", Duration: metav1.Duration{Duration: time.Hour}}
+	config := types.NamespacedName{Namespace: "system", Name: "maintenance-windows"}
+	configMap := func(windows string) runtime.Object {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: config.Namespace, Name: config.Name},
+			Data:       map[string]string{MaintenanceConfigKey: windows},
+		}
+	}
+	tests := []struct {
+		name    string
+		windows []mockv1beta1.MaintenanceWindow
+		// objs 为集群中已有的对象，非空时 reconciler 使用全局配置
+		objs         []runtime.Object
+		wantStatus   bool
+		wantInWindow bool
+		wantNext     bool
+		wantTerminal bool
+	}{
+		{name: "no windows"},
+		{name: "inside a window", windows: []mockv1beta1.MaintenanceWindow{alwaysOpen}, wantStatus: true, wantInWindow: true, wantNext: true},
+		{name: "outside every window", windows: []mockv1beta1.MaintenanceWindow{neverOpen}, wantStatus: true},
+		{name: "any open window counts", windows: []mockv1beta1.MaintenanceWindow{neverOpen, alwaysOpen}, wantStatus: true, wantInWindow: true, wantNext: true},
+		{
+			name:         "invalid duration",
+			windows:      []mockv1beta1.MaintenanceWindow{{Schedule: "0 2 * * 6"}},
+			wantTerminal: true,
+		},
+		{
+			name:         "invalid schedule",
+			windows:      []mockv1beta1.MaintenanceWindow{{Schedule: "every night", Duration: neverOpen.Duration}},
+			wantTerminal: true,
+		},
+		{
+			name:       "global windows",
+			objs:       []runtime.Object{configMap("- schedule: \"0 0 30 2 *\"\n  duration: 1h\n")},
+			wantStatus: true,
+		},
+		{
+			name:         "spec windows override global windows",
+			windows:      []mockv1beta1.MaintenanceWindow{alwaysOpen},
+			objs:         []runtime.Object{configMap("- schedule: \"0 0 30 2 *\"\n  duration: 1h\n")},
+			wantStatus:   true,
+			wantInWindow: true,
+			wantNext:     true,
+		},
+		{
+			name:         "invalid global windows",
+			objs:         []runtime.Object{configMap("- schedule: \"0 2 * * 6\"\n  length: 1h\n")},
+			wantTerminal: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.MaintenanceWindows = tt.windows
+			r := newFakeReconciler(t, tt.objs...)
+			if len(tt.objs) > 0 {
+				r.MaintenanceConfig = config
+			}
+			ctx := withRequeue(context.Background())
+
+			rerr := r.applyMaintenance(ctx, ctrl.Log, MacBook)
+
+			if terminal := rerr != nil && rerr.class == errorTerminal; terminal != tt.wantTerminal || rerr != nil && !terminal {
+				t.Fatalf("applyMaintenance error = %v, want terminal %v", rerr, tt.wantTerminal)
+			}
+			if rerr != nil {
+				return
+			}
+			st := MacBook.Status.Maintenance
+			if (st != nil) != tt.wantStatus {
+				t.Fatalf("status.maintenance = %+v, want set %v", st, tt.wantStatus)
+			}
+			if st == nil {
+				return
+			}
+			if st.InWindow != tt.wantInWindow || (st.WindowEnd != nil) != tt.wantInWindow {
+				t.Errorf("in window = %v, end %v, want %v", st.InWindow, st.WindowEnd, tt.wantInWindow)
+			}
+			if (st.NextWindow != nil) != tt.wantNext {
+				t.Errorf("next window = %v, want set %v", st.NextWindow, tt.wantNext)
+			}
+			if requeue := requeueResult(ctx).RequeueAfter > 0; requeue != (tt.wantInWindow || tt.wantNext) {
+				t.Errorf("requeue = %v, want %v", requeue, tt.wantInWindow || tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestSetPendingCondition(t *testing.T) {
+	next := metav1.NewTime(time.Date(2021, 6, 26, 2, 0, 0, 0, time.UTC))
+	tests := []struct {
+		name        string
+		st          *mockv1beta1.MaintenanceStatus
+		wantStatus  metav1.ConditionStatus
+		wantMessage string
+	}{
+		{name: "no maintenance windows"},
+		{name: "nothing held", st: &mockv1beta1.MaintenanceStatus{InWindow: true}, wantStatus: metav1.ConditionFalse},
+		{
+			name:        "held until the next window",
+			st:          &mockv1beta1.MaintenanceStatus{NextWindow: &next, Pending: []string{"image of deployment mac", "switch of service mac"}},
+			wantStatus:  metav1.ConditionTrue,
+			wantMessage: "image of deployment mac; switch of service mac, held until the maintenance window at 2021-06-26T02:00:00Z",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Status.Maintenance = tt.st
+			setPendingCondition(MacBook)
+			cond := meta.FindStatusCondition(MacBook.Status.Conditions, mockv1beta1.ConditionPendingChanges)
+			if tt.wantStatus == "" {
+				if cond != nil {
+					t.Errorf("condition = %+v, want none", cond)
+				}
+				return
+			}
+			if cond == nil || cond.Status != tt.wantStatus || cond.Message != tt.wantMessage {
+				t.Errorf("condition = %+v, want %s %q", cond, tt.wantStatus, tt.wantMessage)
+			}
+		})
+	}
+}
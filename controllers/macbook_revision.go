@@ -0,0 +1,211 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// defaultRevisionHistoryLimit spec.revisionHistoryLimit 为空时保留的 revision 数量
+const defaultRevisionHistoryLimit = 10
+
+// listRevisions 列出 MacBook 的所有 revision，按 revision 编号从小到大排序
+func (r *MacBookReconciler) listRevisions(ctx context.Context, MacBook *mockv1beta1.MacBook) ([]*mockv1beta1.MacBookRevision, error) {
+	list := &mockv1beta1.MacBookRevisionList{}
+	if err := r.List(ctx, list, client.InNamespace(MacBook.Namespace), client.MatchingLabels{mockv1beta1.MacBookRevisionLabel: MacBook.Name}); err != nil {
+		return nil, err
+	}
+	revisions := make([]*mockv1beta1.MacBookRevision, 0, len(list.Items))
+	for i := range list.Items {
+		// 同名的 MacBook 删除重建后，旧的 revision 还没被回收，这里只要自己的
+		if metav1.IsControlledBy(&list.Items[i], MacBook) {
+			revisions = append(revisions, &list.Items[i])
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Spec.Revision < revisions[j].Spec.Revision
+	})
+	return revisions, nil
+}
+
+// rollbackToRevision 处理 spec.rollbackTo，把对应 revision 保存的 spec 写回 MacBook 并清空 rollbackTo。
+// 返回 true 表示 MacBook 已经被修改，本次调协结束，新的 generation 会触发下一次调协
+func (r *MacBookReconciler) rollbackToRevision(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) (bool, *reconcileError) {
+	if MacBook.Spec.RollbackTo == nil {
+		return false, nil
+	}
+	target := *MacBook.Spec.RollbackTo
+
+	revisions, err := r.listRevisions(ctx, MacBook)
+	if err != nil {
+		return false, classifyError("RevisionListFailed", err)
+	}
+	var revision *mockv1beta1.MacBookRevision
+	for _, rev := range revisions {
+		if rev.Spec.Revision == target {
+			revision = rev
+			break
+		}
+	}
+
+	if revision == nil {
+		// 找不到对应的 revision，清空 rollbackTo 避免一直卡住
+		MacBook.Spec.RollbackTo = nil
+		if err := r.Update(ctx, MacBook); err != nil {
+			return false, classifyMacBookError("RollbackToFailed", err)
+		}
+		r.recordEvent(ctx, MacBook, corev1.EventTypeWarning, EventReasonRevisionNotFound, "Revision %d not found, rollbackTo ignored", target)
+		return true, nil
+	}
+
+	spec := revision.Spec.Spec.DeepCopy()
+	spec.RollbackTo = nil
+	// 历史数量限制是 MacBook 自身的设置，不随版本回退
+	spec.RevisionHistoryLimit = MacBook.Spec.RevisionHistoryLimit
+	MacBook.Spec = *spec
+	if err := r.Update(ctx, MacBook); err != nil {
+		return false, classifyMacBookError("RollbackToFailed", err)
+	}
+	clog.Info("restored spec from revision", "revision", target)
+	r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonRevisionRestored, "Restored spec from revision %d", target)
+	return true, nil
+}
+
+// recordRevision 当前 spec 与最新的 revision 不同时创建一个新的 revision，并清理超出历史数量限制的旧 revision
+func (r *MacBookReconciler) recordRevision(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) (*mockv1beta1.MacBookRevision, *reconcileError) {
+	revisions, err := r.listRevisions(ctx, MacBook)
+	if err != nil {
+		return nil, classifyError("RevisionListFailed", err)
+	}
+
+	hash := tools.SpecHash(&MacBook.Spec)
+	var latest *mockv1beta1.MacBookRevision
+	if len(revisions) > 0 {
+		latest = revisions[len(revisions)-1]
+	}
+	if latest != nil && latest.Spec.Hash == hash {
+		MacBook.Status.CurrentRevision = latest.Spec.Revision
+		return latest, nil
+	}
+
+	next := int64(1)
+	if latest != nil {
+		next = latest.Spec.Revision + 1
+	}
+	spec := MacBook.Spec.DeepCopy()
+	spec.RollbackTo = nil
+	revision := &mockv1beta1.MacBookRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", MacBook.Name, next),
+			Namespace: MacBook.Namespace,
+			Labels: map[string]string{
+				mockv1beta1.MacBookRevisionLabel: MacBook.Name,
+			},
+		},
+		Spec: mockv1beta1.MacBookRevisionSpec{
+			MacBook:  MacBook.Name,
+			Revision: next,
+			Hash:     hash,
+			Spec:     *spec,
+		},
+	}
+	if err := controllerutil.SetControllerReference(MacBook, revision, r.Scheme); err != nil {
+		return nil, terminalError("SetControllerReferenceFailed", err)
+	}
+	// 名称由 revision 编号决定，缓存滞后导致重复创建时会返回 AlreadyExists，重试即可
+	if err := r.Create(ctx, revision); err != nil {
+		return nil, classifyError("RevisionCreateFailed", err)
+	}
+	clog.Info("recorded revision", "revision", next, "hash", hash)
+	if rerr := r.setRevisionOutcome(ctx, revision, mockv1beta1.RevisionOutcomePending, "Rolling out"); rerr != nil {
+		return nil, rerr
+	}
+
+	// 上一个还没有结果的 revision 被新的 spec 取代
+	if latest != nil && (latest.Status.Outcome == "" || latest.Status.Outcome == mockv1beta1.RevisionOutcomePending) {
+		if rerr := r.setRevisionOutcome(ctx, latest, mockv1beta1.RevisionOutcomeSuperseded, fmt.Sprintf("Superseded by revision %d", next)); rerr != nil {
+			return nil, rerr
+		}
+	}
+	MacBook.Status.CurrentRevision = next
+
+	// 清理最旧的 revision，当前 revision 总是保留
+	limit := defaultRevisionHistoryLimit
+	if MacBook.Spec.RevisionHistoryLimit != nil {
+		limit = int(*MacBook.Spec.RevisionHistoryLimit)
+	}
+	revisions = append(revisions, revision)
+	for i := 0; i < len(revisions)-limit; i++ {
+		if err := r.Delete(ctx, revisions[i]); err != nil && !apierrors.IsNotFound(err) {
+			return nil, classifyError("RevisionPruneFailed", err)
+		}
+		clog.Info("pruned revision", "revision", revisions[i].Spec.Revision)
+	}
+	return revision, nil
+}
+
+// updateRevisionOutcome 根据发布检查的结果更新当前 revision 的 outcome，已经有最终结果的 revision 不再修改
+func (r *MacBookReconciler) updateRevisionOutcome(ctx context.Context, MacBook *mockv1beta1.MacBook, revision *mockv1beta1.MacBookRevision) *reconcileError {
+	if revision == nil || (revision.Status.Outcome != "" && revision.Status.Outcome != mockv1beta1.RevisionOutcomePending) {
+		return nil
+	}
+	// hook 的结果随 revision 一起记录
+	if !equality.Semantic.DeepEqual(revision.Status.Hooks, MacBook.Status.Hooks) {
+		revision.Status.Hooks = MacBook.Status.Hooks
+		if err := r.Status().Update(ctx, revision); err != nil {
+			return classifyError("RevisionStatusUpdateFailed", err)
+		}
+	}
+	templateHash := desiredTemplateHash(ctx, MacBook)
+
+	if failed := MacBook.Status.FailedRevision; failed != nil && failed.TemplateHash == templateHash {
+		return r.setRevisionOutcome(ctx, revision, mockv1beta1.RevisionOutcomeFailed, fmt.Sprintf("%s: %s", failed.Reason, failed.Message))
+	}
+	if good := MacBook.Status.LastKnownGood; good != nil && good.TemplateHash == templateHash {
+		return r.setRevisionOutcome(ctx, revision, mockv1beta1.RevisionOutcomeSucceeded, "Rollout completed")
+	}
+	return nil
+}
+
+func (r *MacBookReconciler) setRevisionOutcome(ctx context.Context, revision *mockv1beta1.MacBookRevision, outcome, message string) *reconcileError {
+	if revision.Status.Outcome == outcome && revision.Status.Message == message {
+		return nil
+	}
+	revision.Status.Outcome = outcome
+	revision.Status.Message = message
+	revision.Status.CompletedAt = nil
+	if outcome != mockv1beta1.RevisionOutcomePending {
+		now := metav1.Now()
+		revision.Status.CompletedAt = &now
+	}
+	if err := r.Status().Update(ctx, revision); err != nil {
+		return classifyError("RevisionStatusUpdateFailed", err)
+	}
+	return nil
+}
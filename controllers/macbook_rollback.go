@@ -0,0 +1,169 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// 判定一个版本失败的原因
+const (
+	rollbackReasonProgressDeadline = "ProgressDeadlineExceeded"
+	rollbackReasonCrashLoop        = "CrashLoopBackOff"
+)
+
+// applyKnownGood 当前 spec 生成的模板已经失败过时，期望状态改用最近一次可用版本的模板，
+// 直到用户再次修改模板为止。返回 true 表示正在使用可用版本
+func applyKnownGood(ctx context.Context, MacBook *mockv1beta1.MacBook, dep *appsv1.Deployment, templateHash string) bool {
+	failed := MacBook.Status.FailedRevision
+	if failed == nil {
+		return false
+	}
+	// 用户修改了模板，重新尝试新的版本
+	if failed.TemplateHash != templateHash {
+		MacBook.Status.FailedRevision = nil
+		return false
+	}
+	if MacBook.Status.LastKnownGood == nil {
+		return false
+	}
+	dep.Spec.Template = knownGoodTemplate(ctx, MacBook)
+	return true
+}
+
+// knownGoodTemplate 用最近一次可用的 spec 重新生成 pod 模板
+func knownGoodTemplate(ctx context.Context, MacBook *mockv1beta1.MacBook) corev1.PodTemplateSpec {
+	good := MacBook.DeepCopy()
+	good.Spec = *MacBook.Status.LastKnownGood.Spec.DeepCopy()
+	return injectConsumedEnv(ctx, tools.NewDeployMent(good, classFrom(ctx))).Spec.Template
+}
+
+// checkRollout 检查 deployment 上正在进行的发布：
+// 发布完成则把当前版本记为可用版本；超过 progress deadline 或者 pod 进入 CrashLoopBackOff
+// 则回滚到最近一次可用的模板，记录失败的版本并返回终止性错误，不再重试该版本
+func (r *MacBookReconciler) checkRollout(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, found *appsv1.Deployment, templateHash string, rolledBack bool) *reconcileError {
+	if rolledBack {
+		failed := MacBook.Status.FailedRevision
+		return terminalError("RevisionFailed", fmt.Errorf("revision %s failed with %s, running last known-good revision %s until the spec changes",
+			failed.TemplateHash, failed.Reason, MacBook.Status.LastKnownGood.TemplateHash))
+	}
+
+	// deployment 的 status 还没有反映最新的模板，等下一次事件
+	if found.Status.ObservedGeneration < found.Generation {
+		return nil
+	}
+
+	if deploymentComplete(found) {
+		// 没有运行 pod 时（休眠、计划缩容到 0 或者 replicas: 0）新版本没有被验证过，不记为可用版本
+		if !deploymentHealthy(found) {
+			return nil
+		}
+		if good := MacBook.Status.LastKnownGood; good == nil || good.TemplateHash != templateHash {
+			// postDeploy hook 成功后才记为可用版本
+			if passed, rerr := r.runPostDeployHook(ctx, clog, MacBook, found, templateHash); rerr != nil || !passed {
+				return rerr
+			}
+			MacBook.Status.LastKnownGood = &mockv1beta1.KnownGoodRevision{
+				TemplateHash: templateHash,
+				Spec:         *MacBook.Spec.DeepCopy(),
+				Time:         metav1.Now(),
+			}
+			clog.Info("revision is healthy", "templateHash", templateHash)
+		}
+		return nil
+	}
+
+	// 只有存在可用版本并且正在发布新版本时才回滚
+	good := MacBook.Status.LastKnownGood
+	if good == nil || good.TemplateHash == templateHash {
+		return nil
+	}
+	reason, message := rolloutFailure(found, MacBook.Status.Pods.Waiting)
+	if reason == "" {
+		return nil
+	}
+	return r.rollBack(ctx, clog, MacBook, found, templateHash, reason, message)
+}
+
+// rollBack 把模板记为失败的版本，有可用版本时把 deployment 回滚到可用版本的模板，返回终止性错误
+func (r *MacBookReconciler) rollBack(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, found *appsv1.Deployment, templateHash, reason, message string) *reconcileError {
+	if failed := MacBook.Status.FailedRevision; failed == nil || failed.TemplateHash != templateHash || failed.Reason != reason {
+		MacBook.Status.FailedRevision = &mockv1beta1.FailedRevision{
+			TemplateHash: templateHash,
+			Reason:       reason,
+			Message:      message,
+			Time:         metav1.Now(),
+		}
+	}
+	good := MacBook.Status.LastKnownGood
+	if good == nil {
+		return terminalError("RevisionFailed", fmt.Errorf("revision %s failed with %s: %s, no known-good revision to roll back to", templateHash, reason, message))
+	}
+	found.Spec.Template = knownGoodTemplate(ctx, MacBook)
+	if err := r.Update(ctx, found); err != nil {
+		return classifyError("RollbackFailed", err)
+	}
+	clog.Info("rolled back failed revision", "failed", templateHash, "knownGood", good.TemplateHash, "reason", reason)
+	r.recordEvent(ctx, MacBook, corev1.EventTypeWarning, EventReasonRolledBack, "Revision %s failed (%s: %s), rolled back to %s", templateHash, reason, message, good.TemplateHash)
+	r.recordEvent(ctx, found, corev1.EventTypeWarning, EventReasonRolledBack, "Rolled back to revision %s by MacBook %s", good.TemplateHash, MacBook.Name)
+
+	return terminalError("RevisionFailed", fmt.Errorf("revision %s failed with %s: %s", templateHash, reason, message))
+}
+
+// deploymentComplete 所有副本都已更新并可用，并且没有旧版本的 pod
+func deploymentComplete(dep *appsv1.Deployment) bool {
+	desired := desiredReplicas(dep)
+	return dep.Status.UpdatedReplicas == desired &&
+		dep.Status.AvailableReplicas == desired &&
+		dep.Status.Replicas == desired
+}
+
+// deploymentHealthy 发布完成并且至少有一个可用的 pod，只有这样模板才能记为可用版本。
+// 副本数为 0 时 deploymentComplete 也成立，但模板一个 pod 都没有运行过
+func deploymentHealthy(dep *appsv1.Deployment) bool {
+	return desiredReplicas(dep) > 0 && deploymentComplete(dep)
+}
+
+func desiredReplicas(dep *appsv1.Deployment) int32 {
+	if dep.Spec.Replicas != nil {
+		return *dep.Spec.Replicas
+	}
+	return 1
+}
+
+// rolloutFailure 返回发布失败的原因，没有失败返回空字符串。waiting 是这个 deployment 的 pod 中异常等待的容器
+func rolloutFailure(dep *appsv1.Deployment, waiting []mockv1beta1.ContainerWaiting) (string, string) {
+	for _, c := range dep.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Status == corev1.ConditionFalse && c.Reason == rollbackReasonProgressDeadline {
+			return rollbackReasonProgressDeadline, c.Message
+		}
+	}
+	for _, w := range waiting {
+		if w.Reason == rollbackReasonCrashLoop {
+			return rollbackReasonCrashLoop, fmt.Sprintf("container %s of pod %s: %s", w.Container, w.Pod, w.Message)
+		}
+	}
+	return "", ""
+}
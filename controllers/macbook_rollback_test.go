@@ -0,0 +1,205 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestRolloutFailure(t *testing.T) {
+	deadline := appsv1.DeploymentCondition{
+		Type:    appsv1.DeploymentProgressing,
+		Status:  corev1.ConditionFalse,
+		Reason:  rollbackReasonProgressDeadline,
+		Message: "progress deadline exceeded",
+	}
+	crashLoop := mockv1beta1.ContainerWaiting{Pod: "mac-1", Container: "web", Reason: rollbackReasonCrashLoop, Message: "back-off"}
+	tests := []struct {
+		name       string
+		conditions []appsv1.DeploymentCondition
+		waiting    []mockv1beta1.ContainerWaiting
+		want       string
+	}{
+		{"healthy", nil, nil, ""},
+		{"progress deadline", []appsv1.DeploymentCondition{deadline}, nil, rollbackReasonProgressDeadline},
+		{"crash loop", nil, []mockv1beta1.ContainerWaiting{crashLoop}, rollbackReasonCrashLoop},
+		{"progress deadline first", []appsv1.DeploymentCondition{deadline}, []mockv1beta1.ContainerWaiting{crashLoop}, rollbackReasonProgressDeadline},
+		{"image pull is not a failure", nil, []mockv1beta1.ContainerWaiting{{Pod: "mac-1", Container: "web", Reason: "ImagePullBackOff"}}, ""},
+		{
+			"still progressing",
+			[]appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionTrue, Reason: "ReplicaSetUpdated"}},
+			nil,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dep := &appsv1.Deployment{Status: appsv1.DeploymentStatus{Conditions: tt.conditions}}
+			if got, _ := rolloutFailure(dep, tt.waiting); got != tt.want {
+				t.Errorf("rolloutFailure = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeploymentComplete(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas *int32
+		status   appsv1.DeploymentStatus
+		want     bool
+	}{
+		{"all updated and available", int32Ptr(2), appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2}, true},
+		{"old pods still running", int32Ptr(2), appsv1.DeploymentStatus{Replicas: 3, UpdatedReplicas: 2, AvailableReplicas: 2}, false},
+		{"not available", int32Ptr(2), appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 1}, false},
+		{"replicas default to one", nil, appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}, true},
+		{"scaled to zero", int32Ptr(0), appsv1.DeploymentStatus{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dep := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: tt.replicas}, Status: tt.status}
+			if got := deploymentComplete(dep); got != tt.want {
+				t.Errorf("deploymentComplete = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeploymentHealthy(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas *int32
+		status   appsv1.DeploymentStatus
+		want     bool
+	}{
+		{"all updated and available", int32Ptr(2), appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2}, true},
+		{"not available", int32Ptr(2), appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 1}, false},
+		// 副本数为 0 时模板没有运行过
+		{"scaled to zero", int32Ptr(0), appsv1.DeploymentStatus{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dep := &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: tt.replicas}, Status: tt.status}
+			if got := deploymentHealthy(dep); got != tt.want {
+				t.Errorf("deploymentHealthy = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRollout(t *testing.T) {
+	goodSpec := mockv1beta1.MacBookSpec{Replicas: int32Ptr(2), Image: "nginx:1.19"}
+	tests := []struct {
+		name string
+		// status 为 deployment 的状态，waiting 为 pod 中异常等待的容器
+		replicas     *int32
+		status       appsv1.DeploymentStatus
+		waiting      []mockv1beta1.ContainerWaiting
+		knownGood    string
+		wantGood     string
+		wantFailed   string
+		wantTerminal bool
+		wantImage    string
+	}{
+		{
+			name:      "completed rollout becomes known good",
+			status:    appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2},
+			knownGood: "v1",
+			wantGood:  "v2",
+			wantImage: "nginx:1.20",
+		},
+		{
+			name:      "rollout scaled to zero is not known good",
+			replicas:  int32Ptr(0),
+			knownGood: "v1",
+			wantGood:  "v1",
+			wantImage: "nginx:1.20",
+		},
+		{
+			name:      "first rollout scaled to zero is not known good",
+			replicas:  int32Ptr(0),
+			wantImage: "nginx:1.20",
+		},
+		{
+			name:      "progressing rollout is left alone",
+			status:    appsv1.DeploymentStatus{Replicas: 3, UpdatedReplicas: 1, AvailableReplicas: 2},
+			knownGood: "v1",
+			wantGood:  "v1",
+			wantImage: "nginx:1.20",
+		},
+		{
+			name:         "crash loop rolls back",
+			status:       appsv1.DeploymentStatus{Replicas: 3, UpdatedReplicas: 1, AvailableReplicas: 2},
+			waiting:      []mockv1beta1.ContainerWaiting{{Pod: "mac-1", Container: "web", Reason: rollbackReasonCrashLoop}},
+			knownGood:    "v1",
+			wantGood:     "v1",
+			wantFailed:   "v2",
+			wantTerminal: true,
+			wantImage:    "nginx:1.19",
+		},
+		{
+			name:      "first rollout is never rolled back",
+			status:    appsv1.DeploymentStatus{Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 0},
+			waiting:   []mockv1beta1.ContainerWaiting{{Pod: "mac-1", Container: "web", Reason: rollbackReasonCrashLoop}},
+			wantImage: "nginx:1.20",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec.Image = "nginx:1.20"
+			if tt.replicas != nil {
+				MacBook.Spec.Replicas = tt.replicas
+			}
+			MacBook.Status.Pods.Waiting = tt.waiting
+			if tt.knownGood != "" {
+				MacBook.Status.LastKnownGood = &mockv1beta1.KnownGoodRevision{TemplateHash: tt.knownGood, Spec: goodSpec}
+			}
+			found := completeDeployment(MacBook, tools.NewDeployMent(MacBook, nil))
+			found.Status = tt.status
+			r := newFakeReconciler(t, found.DeepCopy())
+			ctx := context.Background()
+
+			rerr := r.checkRollout(ctx, ctrl.Log, MacBook, found, "v2", false)
+
+			if terminal := rerr != nil && rerr.class == errorTerminal; terminal != tt.wantTerminal || rerr != nil && !terminal {
+				t.Fatalf("checkRollout error = %v, want terminal %v", rerr, tt.wantTerminal)
+			}
+			if good := MacBook.Status.LastKnownGood; tt.wantGood == "" && good != nil || tt.wantGood != "" && (good == nil || good.TemplateHash != tt.wantGood) {
+				t.Errorf("last known good = %+v, want %q", good, tt.wantGood)
+			}
+			if failed := MacBook.Status.FailedRevision; tt.wantFailed == "" && failed != nil || tt.wantFailed != "" && (failed == nil || failed.TemplateHash != tt.wantFailed) {
+				t.Errorf("failed revision = %+v, want %q", failed, tt.wantFailed)
+			}
+			dep := &appsv1.Deployment{}
+			if err := r.Get(ctx, types.NamespacedName{Namespace: "default", Name: "mac"}, dep); err != nil {
+				t.Fatal(err)
+			}
+			if image := dep.Spec.Template.Spec.Containers[0].Image; image != tt.wantImage {
+				t.Errorf("deployment image = %s, want %s", image, tt.wantImage)
+			}
+		})
+	}
+}
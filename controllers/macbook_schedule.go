@@ -0,0 +1,76 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// applySchedules 找出最近一次触发的扩缩容计划写入 status.schedule，它的副本数优先于 spec.replicas，
+// 并请求在下一次触发时重新调协，不需要轮询
+func (r *MacBookReconciler) applySchedules(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) *reconcileError {
+	prev := MacBook.Status.Schedule
+	if len(MacBook.Spec.Schedules) == 0 {
+		MacBook.Status.Schedule = nil
+		return nil
+	}
+
+	now := time.Now()
+	st := &mockv1beta1.ScheduleStatus{}
+	var lastTime, nextTime time.Time
+	for _, s := range MacBook.Spec.Schedules {
+		schedule, err := tools.ParseSchedule(s.Schedule, s.TimeZone)
+		if err != nil {
+			return terminalError("InvalidSchedule", fmt.Errorf("schedule %s: %v", s.Name, err))
+		}
+		// 同时触发时排在前面的计划生效
+		if last := schedule.Last(now); !last.IsZero() && last.After(lastTime) {
+			lastTime = last
+			replicas := s.Replicas
+			st.Active = s.Name
+			st.Replicas = &replicas
+		}
+		if next := schedule.Next(now); !next.IsZero() && (nextTime.IsZero() || next.Before(nextTime)) {
+			nextTime = next
+			st.Next = s.Name
+		}
+	}
+	if !lastTime.IsZero() {
+		since := metav1.NewTime(lastTime.UTC())
+		st.ActiveSince = &since
+	}
+	if !nextTime.IsZero() {
+		next := metav1.NewTime(nextTime.UTC())
+		st.NextTime = &next
+		requeueAfter(ctx, nextTime.Sub(now))
+	}
+	MacBook.Status.Schedule = st
+
+	if st.Active != "" && (prev == nil || prev.Active != st.Active || !lastTime.Equal(prev.ActiveSince.Time)) {
+		clog.Info("scaling schedule fired", "schedule", st.Active, "replicas", *st.Replicas, "next", st.Next)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonScheduleActivated, "Schedule %s set replicas to %d", st.Active, *st.Replicas)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// reconcileService 创建或修正 MacBook 的 service。
+// blue/green 发布时 service 只选择 active 颜色的 pod，另一个颜色由 <name>-preview service 暴露
+func (r *MacBookReconciler) reconcileService(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) *reconcileError {
+	svc := tools.NewService(MacBook)
+	st := blueGreenStatus(MacBook)
+	if st != nil {
+		svc.Spec.Selector[tools.ColorLabel] = st.ActiveColor
+	}
+	if err := controllerutil.SetControllerReference(MacBook, svc, r.Scheme); err != nil {
+		return terminalError("SetControllerReferenceFailed", err)
+	}
+	if rerr := r.applyService(ctx, clog, MacBook, svc); rerr != nil {
+		return rerr
+	}
+
+	if st == nil {
+		return r.deleteService(ctx, clog, MacBook, tools.PreviewServiceName(MacBook), "")
+	}
+	preview := tools.NewPreviewService(MacBook, tools.OtherColor(st.ActiveColor))
+	if err := controllerutil.SetControllerReference(MacBook, preview, r.Scheme); err != nil {
+		return terminalError("SetControllerReferenceFailed", err)
+	}
+	return r.applyService(ctx, clog, MacBook, preview)
+}
+
+// applyService service 不存在就创建，selector 或端口被修改则改回期望状态。
+// 同名的 service 不属于 MacBook 时按 claimService 处理，不会直接改写
+func (r *MacBookReconciler) applyService(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, svc *corev1.Service) *reconcileError {
+	found := &corev1.Service{}
+	err := r.Get(ctx, client.ObjectKeyFromObject(svc), found)
+	switch {
+	case apierrors.IsNotFound(err):
+		if err := r.Create(ctx, svc); err != nil {
+			return classifyError("ServiceCreateFailed", err)
+		}
+		clog.Info("service create ok", "service-name", svc.Name)
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonCreated, "Created service %s", svc.Name)
+		return nil
+	case err != nil:
+		return classifyError("ServiceGetFailed", err)
+	}
+	// 接管后改成期望状态是计划内的修改
+	adopted := !metav1.IsControlledBy(found, MacBook)
+	if rerr := r.claimService(ctx, clog, MacBook, svc, found); rerr != nil {
+		return rerr
+	}
+
+	// clusterIP、nodePort 等由 apiserver 分配，DeepDerivative 只比较期望中设置的字段
+	if equality.Semantic.DeepEqual(svc.Spec.Selector, found.Spec.Selector) && equality.Semantic.DeepDerivative(svc.Spec.Ports, found.Spec.Ports) {
+		return nil
+	}
+	// blue/green 切换颜色是计划内的修改，事件由 stepBlueGreen 记录
+	switched := found.Spec.Selector[tools.ColorLabel] != svc.Spec.Selector[tools.ColorLabel]
+	found.Spec.Selector = svc.Spec.Selector
+	found.Spec.Ports = svc.Spec.Ports
+	if err := r.Update(ctx, found); err != nil {
+		return classifyError("ServiceUpdateFailed", err)
+	}
+	clog.Info("service update ok", "service-name", found.Name, "selector", found.Spec.Selector)
+	if !switched && !adopted {
+		r.recordEvent(ctx, MacBook, corev1.EventTypeNormal, EventReasonDriftCorrected, "Reverted changes to service %s", found.Name)
+	}
+	return nil
+}
+
+// deleteService 删除 MacBook 拥有的指定名称的 service，不存在时忽略。component 和 deleteDeployment 一样
+func (r *MacBookReconciler) deleteService(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook, name, component string) *reconcileError {
+	found := &corev1.Service{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: MacBook.Namespace, Name: name}, found); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return classifyError("ServiceGetFailed", err)
+	}
+	if !metav1.IsControlledBy(found, MacBook) || found.Labels[tools.ComponentLabel] != component {
+		return nil
+	}
+	if err := r.Delete(ctx, found); err != nil && !apierrors.IsNotFound(err) {
+		return classifyError("ServiceDeleteFailed", err)
+	}
+	clog.Info("service delete ok", "service-name", found.Name)
+	return nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// 这些 waiting reason 是容器启动的正常阶段，不计入异常
+var normalWaitingReasons = map[string]bool{
+	"ContainerCreating": true,
+	"PodInitializing":   true,
+}
+
+// updatePodStatus 通过 MacBookLabel 列出 MacBook 的 pod，把就绪数、重启次数、
+// CrashLoopBackOff/ImagePullBackOff 等等待原因以及最近一次退出信息汇总到 status 中
+func (r *MacBookReconciler) updatePodStatus(ctx context.Context, MacBook *mockv1beta1.MacBook, dep *appsv1.Deployment) *reconcileError {
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(MacBook.Namespace), client.MatchingLabelsSelector{Selector: tools.PodSelector(MacBook)}); err != nil {
+		return classifyError("PodListFailed", err)
+	}
+
+	MacBook.Status.Pods = summarizePods(podList.Items)
+	setReadyCondition(MacBook, dep)
+	return nil
+}
+
+// waitingContainers 列出 selector 选中的 pod 中异常等待的容器，用于单独评估 canary 或预览的 pod
+func (r *MacBookReconciler) waitingContainers(ctx context.Context, MacBook *mockv1beta1.MacBook, selector labels.Selector) ([]mockv1beta1.ContainerWaiting, *reconcileError) {
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(MacBook.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, classifyError("PodListFailed", err)
+	}
+	return summarizePods(podList.Items).Waiting, nil
+}
+
+func summarizePods(pods []corev1.Pod) mockv1beta1.PodSummary {
+	summary := mockv1beta1.PodSummary{}
+	for i := range pods {
+		pod := &pods[i]
+		// 正在删除的 pod 不参与统计
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		summary.Total++
+		if isPodReady(pod) {
+			summary.Ready++
+		}
+		for _, cs := range pod.Status.ContainerStatuses {
+			summary.Restarts += cs.RestartCount
+			if w := cs.State.Waiting; w != nil && !normalWaitingReasons[w.Reason] {
+				summary.Waiting = append(summary.Waiting, mockv1beta1.ContainerWaiting{
+					Pod:       pod.Name,
+					Container: cs.Name,
+					Reason:    w.Reason,
+					Message:   w.Message,
+				})
+			}
+			t := cs.LastTerminationState.Terminated
+			if t == nil {
+				t = cs.State.Terminated
+			}
+			if t != nil && (summary.LastTermination == nil || summary.LastTermination.FinishedAt.Before(&t.FinishedAt)) {
+				summary.LastTermination = &mockv1beta1.ContainerTermination{
+					Pod:        pod.Name,
+					Container:  cs.Name,
+					Reason:     t.Reason,
+					ExitCode:   t.ExitCode,
+					Message:    t.Message,
+					FinishedAt: t.FinishedAt,
+				}
+			}
+		}
+	}
+	// 保证顺序稳定，避免 status 无意义的更新
+	sort.Slice(summary.Waiting, func(i, j int) bool {
+		if summary.Waiting[i].Pod != summary.Waiting[j].Pod {
+			return summary.Waiting[i].Pod < summary.Waiting[j].Pod
+		}
+		return summary.Waiting[i].Container < summary.Waiting[j].Container
+	})
+	return summary
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// setReadyCondition 期望的副本全部就绪并且没有异常等待的容器时 Ready 为 True
+func setReadyCondition(MacBook *mockv1beta1.MacBook, dep *appsv1.Deployment) {
+	desired := int32(1)
+	if dep.Spec.Replicas != nil {
+		desired = *dep.Spec.Replicas
+	}
+	pods := MacBook.Status.Pods
+
+	cond := metav1.Condition{
+		Type:               mockv1beta1.ConditionReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: MacBook.Generation,
+	}
+	switch {
+	case len(pods.Waiting) > 0:
+		cond.Reason = pods.Waiting[0].Reason
+		cond.Message = fmt.Sprintf("container %s of pod %s is waiting: %s", pods.Waiting[0].Container, pods.Waiting[0].Pod, pods.Waiting[0].Message)
+	case dep.Status.UpdatedReplicas < desired || pods.Ready < desired:
+		cond.Reason = "PodsNotReady"
+		cond.Message = fmt.Sprintf("%d/%d pods ready", pods.Ready, desired)
+	default:
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "PodsReady"
+		cond.Message = fmt.Sprintf("%d/%d pods ready", pods.Ready, desired)
+	}
+	meta.SetStatusCondition(&MacBook.Status.Conditions, cond)
+}
+
+// removeCondition 删除指定类型的 condition。apimachinery v0.19 的 meta.RemoveStatusCondition
+// 在列表为空时会 panic，新建的 MacBook 还没有任何 condition
+func removeCondition(conditions *[]metav1.Condition, conditionType string) {
+	if len(*conditions) == 0 {
+		return
+	}
+	meta.RemoveStatusCondition(conditions, conditionType)
+}
+
+// podToMacBook 把带有 MacBookLabel 的 pod 的事件映射到 MacBook，其他 pod 不触发调协
+func podToMacBook(obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[tools.MacBookLabel]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Namespace: obj.GetNamespace(), Name: name}}}
+}
@@ -0,0 +1,390 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// waitForKey MacBook 上 spec.waitFor 的索引，值为等待的对象的 group/kind/name。
+// 不含 namespace，集群级别的对象没有 namespace，映射时再比较
+const waitForKey = ".spec.waitFor"
+
+const (
+	// waitForKindRetry 等待的 kind 还没有注册（例如 CRD 还没安装）或者无法 watch 时重新尝试的间隔
+	waitForKindRetry = time.Minute
+	// waitForPollInterval 没有 watch 的 kind 不满足时重新检查的间隔
+	waitForPollInterval = 30 * time.Second
+	// waitForReadTimeout 单次读取等待对象的超时，apiserver 没有响应时不阻塞调协
+	waitForReadTimeout = 10 * time.Second
+)
+
+var (
+	configMapGVK = schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	secretGVK    = schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+	jobGVK       = schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}
+)
+
+// waitForWatches 为 spec.waitFor 引用到的 kind 按需建立 watch，对象变化后立即重新检查等待它的 MacBook。
+// watch 只接收 metadata，不缓存 Secret 的内容或者大对象的 spec；判断是否满足仍然通过 APIReader 读取完整的对象。
+// 没有 list 权限的 kind 不建立 watch，由调用方定期重新检查，之后再重新尝试
+type waitForWatches struct {
+	client     metadata.Interface
+	controller controller.Controller
+	// handler 返回某个 kind 的对象变化后重新调协的事件处理
+	handler func(gvk schema.GroupVersionKind) handler.EventHandler
+	log     logr.Logger
+
+	mu sync.Mutex
+	// ctx manager 启动后才有，watch 随 manager 一起停止
+	ctx     context.Context
+	watched map[schema.GroupResource]bool
+	retryAt map[schema.GroupResource]time.Time
+}
+
+func newWaitForWatches(c metadata.Interface, ctrl controller.Controller, h func(gvk schema.GroupVersionKind) handler.EventHandler, log logr.Logger) *waitForWatches {
+	return &waitForWatches{
+		client:     c,
+		controller: ctrl,
+		handler:    h,
+		log:        log,
+		watched:    map[schema.GroupResource]bool{},
+		retryAt:    map[schema.GroupResource]time.Time{},
+	}
+}
+
+// Start 记录 manager 的 ctx，之后建立的 watch 随它停止
+func (w *waitForWatches) Start(ctx context.Context) error {
+	w.mu.Lock()
+	w.ctx = ctx
+	w.mu.Unlock()
+	<-ctx.Done()
+	return nil
+}
+
+// ensure 确保 mapping 对应的 resource 已经被 watch，返回 false 时调用方需要定期重新检查。
+// 建立 watch 前先 list 一次确认有权限，informer 不会因为没有权限一直重试；
+// 不等待 informer 同步，同步时每个已有对象的 Add 事件会补上读取之后发生的变化
+func (w *waitForWatches) ensure(ctx context.Context, gvk schema.GroupVersionKind, mapping *meta.RESTMapping) bool {
+	if w == nil {
+		return false
+	}
+	gr := mapping.Resource.GroupResource()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watched[gr] {
+		return true
+	}
+	if w.ctx == nil || time.Now().Before(w.retryAt[gr]) {
+		return false
+	}
+
+	listCtx, cancel := context.WithTimeout(ctx, waitForReadTimeout)
+	defer cancel()
+	if _, err := w.client.Resource(mapping.Resource).List(listCtx, metav1.ListOptions{Limit: 1}); err != nil {
+		w.log.Info("unable to watch waitFor kind, polling it", "resource", gr, "error", err.Error())
+		w.retryAt[gr] = time.Now().Add(waitForKindRetry)
+		return false
+	}
+	informer := metadatainformer.NewFilteredMetadataInformer(w.client, mapping.Resource, metav1.NamespaceAll, 0, toolscache.Indexers{}, nil).Informer()
+	if err := w.controller.Watch(&source.Informer{Informer: informer}, w.handler(gvk)); err != nil {
+		w.log.Error(err, "unable to watch waitFor kind, polling it", "resource", gr)
+		w.retryAt[gr] = time.Now().Add(waitForKindRetry)
+		return false
+	}
+	go informer.Run(w.ctx.Done())
+	w.watched[gr] = true
+	w.log.Info("watching waitFor kind", "resource", gr)
+	return true
+}
+
+// waitForTarget spec.waitFor 中一项等待的对象
+type waitForTarget struct {
+	gvk         schema.GroupVersionKind
+	key         types.NamespacedName
+	description string
+}
+
+// indexKey 索引中的值，和 waitForObjectToMacBooks 中的计算方式一致
+func (t waitForTarget) indexKey() string {
+	return t.gvk.Group + "/" + t.gvk.Kind + "/" + t.key.Name
+}
+
+// waitForTargetOf 解析 spec.waitFor 中的一项，必须正好设置一个字段
+func waitForTargetOf(MacBook *mockv1beta1.MacBook, w *mockv1beta1.WaitForCondition) (waitForTarget, error) {
+	var targets []waitForTarget
+	if w.ConfigMapKey != nil {
+		targets = append(targets, waitForTarget{
+			gvk:         configMapGVK,
+			key:         types.NamespacedName{Namespace: MacBook.Namespace, Name: w.ConfigMapKey.Name},
+			description: fmt.Sprintf("ConfigMap %s key %s", w.ConfigMapKey.Name, w.ConfigMapKey.Key),
+		})
+	}
+	if w.Secret != nil {
+		targets = append(targets, waitForTarget{
+			gvk:         secretGVK,
+			key:         types.NamespacedName{Namespace: MacBook.Namespace, Name: w.Secret.Name},
+			description: fmt.Sprintf("Secret %s", w.Secret.Name),
+		})
+	}
+	if w.JobComplete != nil {
+		targets = append(targets, waitForTarget{
+			gvk:         jobGVK,
+			key:         types.NamespacedName{Namespace: MacBook.Namespace, Name: w.JobComplete.Name},
+			description: fmt.Sprintf("Job %s complete", w.JobComplete.Name),
+		})
+	}
+	if c := w.Condition; c != nil {
+		gv, err := schema.ParseGroupVersion(c.APIVersion)
+		if err != nil {
+			return waitForTarget{}, err
+		}
+		namespace := c.Namespace
+		if namespace == "" {
+			namespace = MacBook.Namespace
+		}
+		targets = append(targets, waitForTarget{
+			gvk:         gv.WithKind(c.Kind),
+			key:         types.NamespacedName{Namespace: namespace, Name: c.Name},
+			description: fmt.Sprintf("%s %s condition %s=%s", c.Kind, c.Name, c.Type, waitForConditionStatus(c)),
+		})
+	}
+	if len(targets) != 1 {
+		return waitForTarget{}, errors.New("exactly one of configMapKey, secret, jobComplete and condition must be set")
+	}
+	return targets[0], nil
+}
+
+func waitForConditionStatus(c *mockv1beta1.ObjectCondition) metav1.ConditionStatus {
+	if c.Status == "" {
+		return metav1.ConditionTrue
+	}
+	return c.Status
+}
+
+// checkWaitFor 检查 spec.waitFor 中的每一项，结果写入 status.waitFor 和 WaitingForObjects condition。
+// 只暂缓 deployment 的创建：deployment 已经存在时返回 false，之后不满足的项只在 status 中报告
+func (r *MacBookReconciler) checkWaitFor(ctx context.Context, clog logr.Logger, MacBook *mockv1beta1.MacBook) (bool, *reconcileError) {
+	if len(MacBook.Spec.WaitFor) == 0 {
+		MacBook.Status.WaitFor = nil
+		removeCondition(&MacBook.Status.Conditions, mockv1beta1.ConditionWaitingForObjects)
+		return false, nil
+	}
+
+	statuses := make([]mockv1beta1.WaitForStatus, 0, len(MacBook.Spec.WaitFor))
+	var unmet []string
+	for i := range MacBook.Spec.WaitFor {
+		w := &MacBook.Spec.WaitFor[i]
+		target, err := waitForTargetOf(MacBook, w)
+		if err != nil {
+			return false, terminalError("InvalidWaitFor", fmt.Errorf("spec.waitFor[%d]: %w", i, err))
+		}
+		st := mockv1beta1.WaitForStatus{Description: target.description}
+		st.Met, st.Message, err = r.evaluateWaitFor(ctx, w, target)
+		if err != nil {
+			return false, classifyError("WaitForGetFailed", err)
+		}
+		if !st.Met {
+			unmet = append(unmet, fmt.Sprintf("%s: %s", target.description, st.Message))
+		}
+		statuses = append(statuses, st)
+	}
+	MacBook.Status.WaitFor = statuses
+
+	cond := metav1.Condition{
+		Type:               mockv1beta1.ConditionWaitingForObjects,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: MacBook.Generation,
+		Reason:             "ObjectsReady",
+	}
+	held := false
+	if len(unmet) > 0 {
+		exists, err := r.deploymentExists(ctx, MacBook)
+		if err != nil {
+			return false, classifyError("DeploymentGetFailed", err)
+		}
+		if exists {
+			cond.Reason = "DeploymentCreated"
+			cond.Message = "spec.waitFor only holds the creation of the Deployment"
+		} else {
+			held = true
+			cond.Status = metav1.ConditionTrue
+			cond.Reason = "ObjectsNotReady"
+			cond.Message = strings.Join(unmet, "; ")
+			clog.Info("waiting for objects", "waiting", unmet)
+		}
+	}
+	meta.SetStatusCondition(&MacBook.Status.Conditions, cond)
+	return held, nil
+}
+
+// evaluateWaitFor 读取等待的对象并判断是否满足，不满足时返回原因。
+// 对象统一按 unstructured 通过 APIReader 直接从 apiserver 读取，watch 只用来触发重新检查；
+// 无法 watch 的 kind 不满足时定期重新检查
+func (r *MacBookReconciler) evaluateWaitFor(ctx context.Context, w *mockv1beta1.WaitForCondition, target waitForTarget) (bool, string, error) {
+	mapping, err := r.RESTMapper().RESTMapping(target.gvk.GroupKind(), target.gvk.Version)
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			// kind 注册后不会产生事件，定期重新检查
+			requeueAfter(ctx, waitForKindRetry)
+			return false, fmt.Sprintf("kind %s is not served by the cluster", target.gvk), nil
+		}
+		return false, "", err
+	}
+	met, message, err := r.readWaitFor(ctx, w, target, mapping)
+	if err == nil && !met && !r.waitForWatches.ensure(ctx, target.gvk, mapping) {
+		requeueAfter(ctx, waitForPollInterval)
+	}
+	return met, message, err
+}
+
+func (r *MacBookReconciler) readWaitFor(ctx context.Context, w *mockv1beta1.WaitForCondition, target waitForTarget, mapping *meta.RESTMapping) (bool, string, error) {
+	key := target.key
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		key.Namespace = ""
+	}
+
+	readCtx, cancel := context.WithTimeout(ctx, waitForReadTimeout)
+	defer cancel()
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(target.gvk)
+	if err := r.APIReader.Get(readCtx, key, obj); err != nil {
+		switch {
+		case apierrors.IsNotFound(err):
+			return false, "not found", nil
+		case apierrors.IsForbidden(err):
+			// 控制器没有读取这个 kind 的权限，授权后由定期检查发现
+			return false, fmt.Sprintf("forbidden: %v", err), nil
+		}
+		return false, "", err
+	}
+
+	switch {
+	case w.ConfigMapKey != nil:
+		for _, field := range []string{"data", "binaryData"} {
+			if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, field, w.ConfigMapKey.Key); found {
+				return true, "", nil
+			}
+		}
+		return false, "key not found", nil
+	case w.Secret != nil:
+		return true, "", nil
+	case w.JobComplete != nil:
+		if status, _ := objectCondition(obj, "Complete"); status == string(metav1.ConditionTrue) {
+			return true, "", nil
+		}
+		if status, message := objectCondition(obj, "Failed"); status == string(metav1.ConditionTrue) {
+			return false, fmt.Sprintf("job failed: %s", message), nil
+		}
+		return false, "job has not completed", nil
+	default:
+		want := waitForConditionStatus(w.Condition)
+		status, _ := objectCondition(obj, w.Condition.Type)
+		if status == string(want) {
+			return true, "", nil
+		}
+		if status == "" {
+			return false, fmt.Sprintf("condition %s not reported", w.Condition.Type), nil
+		}
+		return false, fmt.Sprintf("condition %s is %s", w.Condition.Type, status), nil
+	}
+}
+
+// objectCondition 读取对象 status.conditions 中某个类型的 status 和 message，没有时返回空字符串
+func objectCondition(obj *unstructured.Unstructured, conditionType string) (string, string) {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if t, _, _ := unstructured.NestedString(cond, "type"); t != conditionType {
+			continue
+		}
+		status, _, _ := unstructured.NestedString(cond, "status")
+		message, _, _ := unstructured.NestedString(cond, "message")
+		return status, message
+	}
+	return "", ""
+}
+
+// deploymentExists MacBook 的 deployment 是否已经创建
+func (r *MacBookReconciler) deploymentExists(ctx context.Context, MacBook *mockv1beta1.MacBook) (bool, error) {
+	err := r.Get(ctx, client.ObjectKeyFromObject(MacBook), &appsv1.Deployment{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// waitForObjectToMacBooks 等待的对象变化后通过索引找到等待它的 MacBook 重新调协，kind 由建立 watch 时传入
+func (r *MacBookReconciler) waitForObjectToMacBooks(gvk schema.GroupVersionKind) handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		return r.waitingMacBooks(gvk, obj)
+	})
+}
+
+func (r *MacBookReconciler) waitingMacBooks(gvk schema.GroupVersionKind, obj client.Object) []reconcile.Request {
+	list := &mockv1beta1.MacBookList{}
+	if err := r.List(context.Background(), list, client.MatchingFields{waitForKey: gvk.Group + "/" + gvk.Kind + "/" + obj.GetName()}); err != nil {
+		r.Log.Error(err, "unable to list waiting MacBooks", "kind", gvk, "name", obj.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range list.Items {
+		MacBook := &list.Items[i]
+		// 索引不含 namespace，集群级别的对象没有 namespace，和所有同名的引用匹配
+		if obj.GetNamespace() != "" && !waitsForNamespace(MacBook, obj.GetNamespace()) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(MacBook)})
+	}
+	return requests
+}
+
+// waitsForNamespace MacBook 的 spec.waitFor 是否引用了某个 namespace 中的对象
+func waitsForNamespace(MacBook *mockv1beta1.MacBook, namespace string) bool {
+	for i := range MacBook.Spec.WaitFor {
+		if target, err := waitForTargetOf(MacBook, &MacBook.Spec.WaitFor[i]); err == nil && target.key.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	clienttesting "k8s.io/client-go/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// mapperClient 补上 fake client 没有实现的 RESTMapper
+type mapperClient struct {
+	client.Client
+	mapper meta.RESTMapper
+}
+
+func (c mapperClient) RESTMapper() meta.RESTMapper {
+	return c.mapper
+}
+
+// watchRecorder 记录注册的 watch，代替真正的 controller
+type watchRecorder struct {
+	controller.Controller
+	sources []source.Source
+}
+
+func (c *watchRecorder) Watch(src source.Source, _ handler.EventHandler, _ ...predicate.Predicate) error {
+	c.sources = append(c.sources, src)
+	return nil
+}
+
+// newTestWaitForWatches 使用 fake metadata client 的 waitForWatches，已经随 manager 启动
+func newTestWaitForWatches(t *testing.T, r *MacBookReconciler) (*waitForWatches, *metadatafake.FakeMetadataClient, *watchRecorder) {
+	t.Helper()
+	mc := metadatafake.NewSimpleMetadataClient(runtime.NewScheme())
+	rec := &watchRecorder{}
+	w := newWaitForWatches(mc, rec, r.waitForObjectToMacBooks, ctrl.Log)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	w.ctx = ctx
+	return w, mc, rec
+}
+
+func newWaitForReconciler(t *testing.T, objs ...runtime.Object) *MacBookReconciler {
+	t.Helper()
+	r := newFakeReconciler(t, objs...)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, gvk := range []schema.GroupVersionKind{configMapGVK, secretGVK, jobGVK} {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+	r.Client = mapperClient{Client: r.Client, mapper: mapper}
+	r.APIReader = r.Client
+	r.waitForWatches, _, _ = newTestWaitForWatches(t, r)
+	return r
+}
+
+func TestCheckWaitFor(t *testing.T) {
+	config := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "default"},
+		Data:       map[string]string{"db-url": "postgres://db"},
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "default"}}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-migrate", Namespace: "default"},
+		Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+			{Type: batchv1.JobComplete, Status: corev1.ConditionTrue},
+		}},
+	}
+
+	tests := []struct {
+		name        string
+		waitFor     mockv1beta1.WaitForCondition
+		objs        []runtime.Object
+		noWatch     bool
+		wantHeld    bool
+		wantMessage string
+		wantRequeue time.Duration
+	}{
+		{
+			name:    "config map key present",
+			waitFor: mockv1beta1.WaitForCondition{ConfigMapKey: &mockv1beta1.ConfigMapKeyReference{Name: "app-config", Key: "db-url"}},
+			objs:    []runtime.Object{config},
+		},
+		{
+			// 建立了 watch，不需要定期检查
+			name:        "config map key missing",
+			waitFor:     mockv1beta1.WaitForCondition{ConfigMapKey: &mockv1beta1.ConfigMapKeyReference{Name: "app-config", Key: "other"}},
+			objs:        []runtime.Object{config},
+			wantHeld:    true,
+			wantMessage: "key not found",
+		},
+		{
+			name:    "secret present",
+			waitFor: mockv1beta1.WaitForCondition{Secret: &corev1.LocalObjectReference{Name: "creds"}},
+			objs:    []runtime.Object{secret},
+		},
+		{
+			name:        "secret missing",
+			waitFor:     mockv1beta1.WaitForCondition{Secret: &corev1.LocalObjectReference{Name: "creds"}},
+			wantHeld:    true,
+			wantMessage: "not found",
+		},
+		{
+			// 没有 watch 时定期重新读取
+			name:        "secret missing without a watch",
+			waitFor:     mockv1beta1.WaitForCondition{Secret: &corev1.LocalObjectReference{Name: "creds"}},
+			noWatch:     true,
+			wantHeld:    true,
+			wantMessage: "not found",
+			wantRequeue: waitForPollInterval,
+		},
+		{
+			name:    "job complete",
+			waitFor: mockv1beta1.WaitForCondition{JobComplete: &corev1.LocalObjectReference{Name: "db-migrate"}},
+			objs:    []runtime.Object{job},
+		},
+		{
+			name:        "kind not served",
+			waitFor:     mockv1beta1.WaitForCondition{Condition: &mockv1beta1.ObjectCondition{APIVersion: "example.com/v1", Kind: "Database", Name: "db", Type: "Ready"}},
+			wantHeld:    true,
+			wantMessage: "kind example.com/v1, Kind=Database is not served by the cluster",
+			wantRequeue: waitForKindRetry,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newWaitForReconciler(t, tt.objs...)
+			if tt.noWatch {
+				r.waitForWatches = nil
+			}
+			MacBook := newTestMacBook()
+			MacBook.Spec.WaitFor = []mockv1beta1.WaitForCondition{tt.waitFor}
+			ctx := withRequeue(context.Background())
+
+			held, rerr := r.checkWaitFor(ctx, ctrl.Log, MacBook)
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			if held != tt.wantHeld {
+				t.Errorf("held = %v, want %v", held, tt.wantHeld)
+			}
+			if st := MacBook.Status.WaitFor[0]; st.Met == tt.wantHeld || st.Message != tt.wantMessage {
+				t.Errorf("status = %+v, want met %v message %q", st, !tt.wantHeld, tt.wantMessage)
+			}
+			if got := requeueResult(ctx).RequeueAfter; got != tt.wantRequeue {
+				t.Errorf("requeue after %v, want %v", got, tt.wantRequeue)
+			}
+		})
+	}
+}
+
+func TestCheckWaitForDeploymentExists(t *testing.T) {
+	MacBook := newTestMacBook()
+	MacBook.Spec.WaitFor = []mockv1beta1.WaitForCondition{{Secret: &corev1.LocalObjectReference{Name: "creds"}}}
+	dep := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: MacBook.Name, Namespace: MacBook.Namespace}}
+	r := newWaitForReconciler(t, dep)
+
+	held, rerr := r.checkWaitFor(withRequeue(context.Background()), ctrl.Log, MacBook)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if held {
+		t.Error("existing deployment is held by spec.waitFor")
+	}
+	cond := meta.FindStatusCondition(MacBook.Status.Conditions, mockv1beta1.ConditionWaitingForObjects)
+	if cond == nil || cond.Reason != "DeploymentCreated" {
+		t.Errorf("WaitingForObjects condition = %+v, want reason DeploymentCreated", cond)
+	}
+}
+
+func TestCheckWaitForWithoutConditions(t *testing.T) {
+	MacBook := newTestMacBook()
+	r := newWaitForReconciler(t)
+
+	held, rerr := r.checkWaitFor(context.Background(), ctrl.Log, MacBook)
+	if rerr != nil || held {
+		t.Errorf("checkWaitFor = %v, %v, want not held", held, rerr)
+	}
+}
+
+func TestWaitForWatchesEnsure(t *testing.T) {
+	configMaps := &meta.RESTMapping{
+		Resource:         schema.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+		GroupVersionKind: configMapGVK,
+		Scope:            meta.RESTScopeNamespace,
+	}
+	databases := func(version string) *meta.RESTMapping {
+		return &meta.RESTMapping{
+			Resource:         schema.GroupVersionResource{Group: "example.com", Version: version, Resource: "databases"},
+			GroupVersionKind: schema.GroupVersionKind{Group: "example.com", Version: version, Kind: "Database"},
+			Scope:            meta.RESTScopeNamespace,
+		}
+	}
+	r := newFakeReconciler(t)
+	ctx := context.Background()
+
+	t.Run("manager not started", func(t *testing.T) {
+		w, _, rec := newTestWaitForWatches(t, r)
+		w.ctx = nil
+		if w.ensure(ctx, configMapGVK, configMaps) || len(rec.sources) != 0 {
+			t.Errorf("watch registered before the manager started: %d sources", len(rec.sources))
+		}
+	})
+
+	t.Run("one watch per resource", func(t *testing.T) {
+		w, _, rec := newTestWaitForWatches(t, r)
+		for _, mapping := range []*meta.RESTMapping{configMaps, databases("v1"), configMaps, databases("v1beta1")} {
+			if !w.ensure(ctx, mapping.GroupVersionKind, mapping) {
+				t.Errorf("%s is not watched", mapping.Resource)
+			}
+		}
+		if len(rec.sources) != 2 {
+			t.Errorf("registered %d watches, want 2", len(rec.sources))
+		}
+	})
+
+	t.Run("forbidden resource is polled", func(t *testing.T) {
+		w, mc, rec := newTestWaitForWatches(t, r)
+		lists := 0
+		mc.PrependReactor("list", "databases", func(clienttesting.Action) (bool, runtime.Object, error) {
+			lists++
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "example.com", Resource: "databases"}, "", errors.New("no RBAC"))
+		})
+		for i := 0; i < 2; i++ {
+			if w.ensure(ctx, databases("v1").GroupVersionKind, databases("v1")) {
+				t.Error("forbidden resource is watched")
+			}
+		}
+		// 重试间隔内不再尝试
+		if lists != 1 || len(rec.sources) != 0 {
+			t.Errorf("listed %d times and registered %d watches, want 1 and 0", lists, len(rec.sources))
+		}
+		w.retryAt[databases("v1").Resource.GroupResource()] = time.Now().Add(-time.Second)
+		w.ensure(ctx, databases("v1").GroupVersionKind, databases("v1"))
+		if lists != 2 {
+			t.Errorf("listed %d times after the retry interval, want 2", lists)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// accessRecordInterval 两次记录访问时间的最小间隔，避免每个请求都更新 MacBook
+const accessRecordInterval = 10 * time.Second
+
+// wakeSubresource 调用唤醒接口需要 MacBook 这个子资源的 update 权限，
+// 和 pods/exec 一样只用于 RBAC 授权，apiserver 上并没有这个子资源
+const wakeSubresource = "wake"
+
+//+kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// WakeUpServer 提供唤醒休眠 MacBook 的 http 接口，由 manager 启动。
+// POST /wake/<namespace>/<name> 记录一次访问，MacBook 休眠时被唤醒，请求一直等到有 pod 就绪；
+// 带上 ?wait=false 只记录访问立即返回，可以作为上报访问时间的 webhook。
+// 请求需要带上 bearer token，token 由 TokenReview 认证，调用者需要 macbooks/wake 的 update 权限
+type WakeUpServer struct {
+	Client client.Client
+	Log    logr.Logger
+	// Addr 监听地址，例如 :8082
+	Addr string
+	// Timeout 等待 pod 就绪的最长时间
+	Timeout time.Duration
+}
+
+// Start 实现 manager.Runnable，ctx 结束时关闭 http server
+func (s *WakeUpServer) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle("/wake/", s)
+	srv := &http.Server{Addr: s.Addr, Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() {
+		s.Log.Info("starting wake-up server", "addr", s.Addr)
+		errCh <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
+
+// NeedLeaderElection 每个 manager 副本都提供唤醒接口
+func (s *WakeUpServer) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *WakeUpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// 唤醒会修改 MacBook，只接受 POST，避免被爬虫或者预取的 GET 请求唤醒
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/wake/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "expected /wake/<namespace>/<name>", http.StatusNotFound)
+		return
+	}
+	key := client.ObjectKey{Namespace: parts[0], Name: parts[1]}
+	log := s.Log.WithValues("macbook", key)
+
+	ctx := req.Context()
+	if code, err := s.authorize(ctx, req, key); err != nil {
+		log.Info("wake-up request rejected", "reason", err.Error())
+		http.Error(w, err.Error(), code)
+		return
+	}
+	MacBook := &mockv1beta1.MacBook{}
+	if err := s.Client.Get(ctx, key, MacBook); err != nil {
+		if apierrors.IsNotFound(err) {
+			http.Error(w, fmt.Sprintf("MacBook %s not found", key), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.recordAccess(ctx, MacBook); err != nil {
+		log.Error(err, "unable to record access")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.URL.Query().Get("wait") == "false" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	err := wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		if err := s.Client.Get(ctx, key, MacBook); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		return awake(MacBook), nil
+	}, ctx.Done())
+	if err != nil {
+		log.Info("wake-up timed out", "timeout", s.Timeout.String())
+		http.Error(w, fmt.Sprintf("timed out waiting for MacBook %s to become ready", key), http.StatusGatewayTimeout)
+		return
+	}
+	fmt.Fprintf(w, "MacBook %s is ready\n", key)
+}
+
+// authorize 用 TokenReview 认证请求的 bearer token，再用 SubjectAccessReview 检查调用者能否 update
+// MacBook 的 wake 子资源。失败时返回应答的状态码和原因
+func (s *WakeUpServer) authorize(ctx context.Context, req *http.Request, key client.ObjectKey) (int, error) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == req.Header.Get("Authorization") {
+		return http.StatusUnauthorized, fmt.Errorf("a bearer token is required")
+	}
+	review := &authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token}}
+	if err := s.Client.Create(ctx, review); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("unable to review token: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return http.StatusUnauthorized, fmt.Errorf("invalid bearer token")
+	}
+
+	user := review.Status.User
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	access := &authorizationv1.SubjectAccessReview{Spec: authorizationv1.SubjectAccessReviewSpec{
+		User:   user.Username,
+		UID:    user.UID,
+		Groups: user.Groups,
+		Extra:  extra,
+		ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Namespace:   key.Namespace,
+			Name:        key.Name,
+			Verb:        "update",
+			Group:       mockv1beta1.GroupVersion.Group,
+			Resource:    "macbooks",
+			Subresource: wakeSubresource,
+		},
+	}}
+	if err := s.Client.Create(ctx, access); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("unable to review access: %w", err)
+	}
+	if !access.Status.Allowed {
+		return http.StatusForbidden, fmt.Errorf("user %q cannot update macbooks/%s of MacBook %s", user.Username, wakeSubresource, key)
+	}
+	return 0, nil
+}
+
+// recordAccess 把当前时间写入 last-access 注解，控制器收到注解变化后唤醒 MacBook
+func (s *WakeUpServer) recordAccess(ctx context.Context, MacBook *mockv1beta1.MacBook) error {
+	now := time.Now().UTC()
+	if t, err := time.Parse(time.RFC3339, MacBook.Annotations[LastAccessAnnotation]); err == nil && now.Sub(t) < accessRecordInterval {
+		return nil
+	}
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, LastAccessAnnotation, now.Format(time.RFC3339)))
+	return s.Client.Patch(ctx, MacBook, client.RawPatch(types.MergePatchType, patch))
+}
+
+// awake MacBook 没有休眠并且至少有一个 pod 就绪
+func awake(MacBook *mockv1beta1.MacBook) bool {
+	if h := MacBook.Status.Hibernation; h != nil && h.Hibernated {
+		return false
+	}
+	return MacBook.Status.Pods.Ready > 0
+}
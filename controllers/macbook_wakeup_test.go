@@ -0,0 +1,99 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// reviewingClient 模拟 apiserver 对 TokenReview 和 SubjectAccessReview 的应答：
+// token "valid" 认证为 alice，alice 只能唤醒 allowed 中的 MacBook
+type reviewingClient struct {
+	client.Client
+	allowed string
+}
+
+func (c *reviewingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	switch review := obj.(type) {
+	case *authenticationv1.TokenReview:
+		if review.Spec.Token == "valid" {
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "alice"}}
+		}
+		return nil
+	case *authorizationv1.SubjectAccessReview:
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "alice" && attrs.Verb == "update" &&
+			attrs.Resource == "macbooks" && attrs.Subresource == wakeSubresource && attrs.Name == c.allowed
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestWakeUpServer(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantCode   int
+		wantAccess bool
+	}{
+		{"get is not allowed", http.MethodGet, "/wake/default/mac", "valid", http.StatusMethodNotAllowed, false},
+		{"missing token", http.MethodPost, "/wake/default/mac", "", http.StatusUnauthorized, false},
+		{"invalid token", http.MethodPost, "/wake/default/mac", "stolen", http.StatusUnauthorized, false},
+		{"not allowed to wake this MacBook", http.MethodPost, "/wake/default/other", "valid", http.StatusForbidden, false},
+		{"bad path", http.MethodPost, "/wake/default", "valid", http.StatusNotFound, false},
+		{"allowed", http.MethodPost, "/wake/default/mac", "valid", http.StatusAccepted, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			other := newTestMacBook()
+			other.Name, other.UID = "other", "other-uid"
+			r := newFakeReconciler(t, MacBook, other)
+			s := &WakeUpServer{Client: &reviewingClient{Client: r.Client, allowed: "mac"}, Log: ctrl.Log}
+
+			req := httptest.NewRequest(tt.method, tt.path+"?wait=false", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d (%s), want %d", rec.Code, rec.Body.String(), tt.wantCode)
+			}
+			got := &mockv1beta1.MacBook{}
+			if err := r.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "mac"}, got); err != nil {
+				t.Fatal(err)
+			}
+			if _, recorded := got.Annotations[LastAccessAnnotation]; recorded != tt.wantAccess {
+				t.Errorf("access recorded = %v, want %v", recorded, tt.wantAccess)
+			}
+		})
+	}
+}
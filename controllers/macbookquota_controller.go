@@ -0,0 +1,172 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// MacBookQuotaReconciler reconciles a MacBookQuota object
+type MacBookQuotaReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=mock.dong.com,resources=macbookquotas,verbs=get;list;watch
+//+kubebuilder:rbac:groups=mock.dong.com,resources=macbookquotas/status,verbs=get;update;patch
+
+// Reconcile 计算 namespace 中 MacBook 的用量写入 quota 的 status，限制由 admission webhook 执行
+func (r *MacBookQuotaReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	quota := &mockv1beta1.MacBookQuota{}
+	if err := r.Get(ctx, req.NamespacedName, quota); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	used, err := namespaceUsage(ctx, r.Client, quota.Namespace, "")
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	before := quota.Status.DeepCopy()
+	quota.Status.Used = used
+	quota.Status.ObservedGeneration = quota.Generation
+	if !equality.Semantic.DeepEqual(before, &quota.Status) {
+		if err := r.Status().Update(ctx, quota); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+		r.Log.V(1).Info("quota usage updated", "quota", req.NamespacedName, "macbooks", used.MacBooks, "replicas", used.Replicas)
+	}
+	return ctrl.Result{}, nil
+}
+
+// namespaceUsage 通过 namespace 索引汇总 MacBook 的用量，skip 指定的 MacBook 不计入，删除中的 MacBook 也不计入
+func namespaceUsage(ctx context.Context, c client.Reader, namespace, skip string) (mockv1beta1.MacBookQuotaUsage, error) {
+	var used mockv1beta1.MacBookQuotaUsage
+	list := &mockv1beta1.MacBookList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace), client.MatchingFields{nsKey: namespace}); err != nil {
+		return used, err
+	}
+	for i := range list.Items {
+		item := &list.Items[i]
+		if item.Name == skip || !item.DeletionTimestamp.IsZero() {
+			continue
+		}
+		addUsage(&used, macBookUsage(ctx, c, item))
+	}
+	return used, nil
+}
+
+// macBookUsage 一个 MacBook 请求的用量：副本数取 spec.replicas 和扩缩容计划中最大的一个，加上组件的副本数，
+// CPU 和内存是每个 pod 的 requests（没有时取 limits）乘以副本数，MacBook 没有设置资源时使用 class 的默认值
+func macBookUsage(ctx context.Context, c client.Reader, MacBook *mockv1beta1.MacBook) mockv1beta1.MacBookQuotaUsage {
+	replicas := int32(1)
+	if MacBook.Spec.Replicas != nil {
+		replicas = *MacBook.Spec.Replicas
+	}
+	for _, s := range MacBook.Spec.Schedules {
+		if s.Replicas > replicas {
+			replicas = s.Replicas
+		}
+	}
+	used := mockv1beta1.MacBookQuotaUsage{MacBooks: 1, Replicas: replicas}
+
+	resources := MacBook.Spec.Resources
+	if resources == nil {
+		// class 的错误由 MacBook 的调协报告，这里只是没有默认资源
+		if class, err := findClass(ctx, c, MacBook); err == nil && class != nil {
+			resources = class.Spec.Resources
+		}
+	}
+	if resources != nil {
+		cpu := podRequest(resources, corev1.ResourceCPU)
+		used.CPU = *resource.NewMilliQuantity(cpu.MilliValue()*int64(replicas), resource.DecimalSI)
+		memory := podRequest(resources, corev1.ResourceMemory)
+		used.Memory = *resource.NewQuantity(memory.Value()*int64(replicas), resource.BinarySI)
+	}
+	// 组件的副本和资源也计入 MacBook 的用量
+	for i := range MacBook.Spec.Components {
+		comp := &MacBook.Spec.Components[i]
+		componentReplicas := int32(1)
+		if comp.Replicas != nil {
+			componentReplicas = *comp.Replicas
+		}
+		used.Replicas += componentReplicas
+		if comp.Resources != nil {
+			cpu := podRequest(comp.Resources, corev1.ResourceCPU)
+			used.CPU.Add(*resource.NewMilliQuantity(cpu.MilliValue()*int64(componentReplicas), resource.DecimalSI))
+			memory := podRequest(comp.Resources, corev1.ResourceMemory)
+			used.Memory.Add(*resource.NewQuantity(memory.Value()*int64(componentReplicas), resource.BinarySI))
+		}
+	}
+	return used
+}
+
+// podRequest 容器对某种资源的请求，只设置了 limits 时 requests 默认等于 limits
+func podRequest(resources *corev1.ResourceRequirements, name corev1.ResourceName) resource.Quantity {
+	if q, ok := resources.Requests[name]; ok {
+		return q
+	}
+	return resources.Limits[name]
+}
+
+func addUsage(total *mockv1beta1.MacBookQuotaUsage, u mockv1beta1.MacBookQuotaUsage) {
+	total.MacBooks += u.MacBooks
+	total.Replicas += u.Replicas
+	total.CPU.Add(u.CPU)
+	total.Memory.Add(u.Memory)
+}
+
+// macBookToQuotas MacBook 变化后重新计算所在 namespace 的所有 quota
+func (r *MacBookQuotaReconciler) macBookToQuotas(obj client.Object) []reconcile.Request {
+	list := &mockv1beta1.MacBookQuotaList{}
+	if err := r.List(context.Background(), list, client.InNamespace(obj.GetNamespace())); err != nil {
+		r.Log.Error(err, "unable to list MacBookQuotas", "namespace", obj.GetNamespace())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for i := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&list.Items[i])})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *MacBookQuotaReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// 和 deployment 一样按 namespace 索引 MacBook，quota 的 status 和 admission webhook 都通过它汇总用量
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &mockv1beta1.MacBook{}, nsKey, func(rawObj client.Object) []string {
+		return []string{rawObj.GetNamespace()}
+	}); err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&mockv1beta1.MacBookQuota{}).
+		Watches(&source.Kind{Type: &mockv1beta1.MacBook{}}, handler.EnqueueRequestsFromMapFunc(r.macBookToQuotas)).
+		Complete(r)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// MacBookQuotaWebhookPath is where the MacBookQuotaValidator is served.
+const MacBookQuotaWebhookPath = "/validate-mock-dong-com-v1beta1-macbook"
+
+//+kubebuilder:webhook:path=/validate-mock-dong-com-v1beta1-macbook,mutating=false,failurePolicy=fail,sideEffects=None,groups=mock.dong.com,resources=macbooks,verbs=create;update,versions=v1beta1,name=vmacbookquota.dong.com,admissionReviewVersions={v1,v1beta1}
+
+// MacBookQuotaValidator rejects MacBooks that would raise the usage of their namespace
+// above a limit of one of its MacBookQuotas.
+type MacBookQuotaValidator struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+// InjectDecoder injects the decoder.
+func (v *MacBookQuotaValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle 计算 namespace 中其它 MacBook 的用量加上这个 MacBook 的用量，超过 quota 时拒绝。
+// 更新时只有增加的维度超过限制才拒绝，quota 调低后已有的 MacBook 仍然可以修改其它字段或缩容
+func (v *MacBookQuotaValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	MacBook := &mockv1beta1.MacBook{}
+	if err := v.decoder.Decode(req, MacBook); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// 删除中的 MacBook 只会更新 finalizer 等字段
+	if !MacBook.DeletionTimestamp.IsZero() {
+		return admission.Allowed("")
+	}
+
+	quotas := &mockv1beta1.MacBookQuotaList{}
+	if err := v.Client.List(ctx, quotas, client.InNamespace(req.Namespace)); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(quotas.Items) == 0 {
+		return admission.Allowed("")
+	}
+
+	others, err := namespaceUsage(ctx, v.Client, req.Namespace, MacBook.Name)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	after := others
+	addUsage(&after, macBookUsage(ctx, v.Client, MacBook))
+	// 创建时 before 是没有这个 MacBook 的用量
+	before := others
+	if req.Operation == admissionv1.Update {
+		old := &mockv1beta1.MacBook{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		addUsage(&before, macBookUsage(ctx, v.Client, old))
+	}
+
+	for i := range quotas.Items {
+		if exceeded := exceededLimits(&quotas.Items[i].Spec, before, after); len(exceeded) > 0 {
+			return admission.Denied(fmt.Sprintf("exceeds MacBookQuota %s: %s", quotas.Items[i].Name, strings.Join(exceeded, ", ")))
+		}
+	}
+	return admission.Allowed("")
+}
+
+// exceededLimits 返回 after 超过限制并且比 before 增加了的维度
+func exceededLimits(spec *mockv1beta1.MacBookQuotaSpec, before, after mockv1beta1.MacBookQuotaUsage) []string {
+	var exceeded []string
+	count := func(name string, limit *int32, before, after int32) {
+		if limit != nil && after > *limit && after > before {
+			exceeded = append(exceeded, fmt.Sprintf("%s %d > %d", name, after, *limit))
+		}
+	}
+	quantity := func(name string, limit *resource.Quantity, before, after resource.Quantity) {
+		if limit != nil && after.Cmp(*limit) > 0 && after.Cmp(before) > 0 {
+			exceeded = append(exceeded, fmt.Sprintf("%s %s > %s", name, after.String(), limit.String()))
+		}
+	}
+	count("macbooks", spec.MaxMacBooks, before.MacBooks, after.MacBooks)
+	count("replicas", spec.MaxReplicas, before.Replicas, after.Replicas)
+	quantity("cpu", spec.MaxCPU, before.CPU, after.CPU)
+	quantity("memory", spec.MaxMemory, before.Memory, after.Memory)
+	return exceeded
+}
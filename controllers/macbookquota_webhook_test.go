@@ -0,0 +1,138 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExceededLimits(t *testing.T) {
+	usage := func(macbooks, replicas int32, cpu, memory string) mockv1beta1.MacBookQuotaUsage {
+		return mockv1beta1.MacBookQuotaUsage{
+			MacBooks: macbooks,
+			Replicas: replicas,
+			CPU:      resource.MustParse(cpu),
+			Memory:   resource.MustParse(memory),
+		}
+	}
+	quantity := func(s string) *resource.Quantity {
+		q := resource.MustParse(s)
+		return &q
+	}
+	spec := &mockv1beta1.MacBookQuotaSpec{
+		MaxMacBooks: int32Ptr(2),
+		MaxReplicas: int32Ptr(10),
+		MaxCPU:      quantity("2"),
+		MaxMemory:   quantity("4Gi"),
+	}
+	tests := []struct {
+		name   string
+		spec   *mockv1beta1.MacBookQuotaSpec
+		before mockv1beta1.MacBookQuotaUsage
+		after  mockv1beta1.MacBookQuotaUsage
+		want   []string
+	}{
+		{"within limits", spec, usage(1, 4, "1", "2Gi"), usage(2, 10, "2", "4Gi"), nil},
+		{"too many macbooks", spec, usage(2, 4, "1", "2Gi"), usage(3, 5, "1500m", "3Gi"), []string{"macbooks 3 > 2"}},
+		{"too many replicas", spec, usage(1, 10, "1", "2Gi"), usage(1, 12, "1", "2Gi"), []string{"replicas 12 > 10"}},
+		{"too much cpu and memory", spec, usage(1, 4, "1", "2Gi"), usage(1, 4, "2500m", "5Gi"), []string{"cpu 2500m > 2", "memory 5Gi > 4Gi"}},
+		// quota 调低后，没有增加的维度不拒绝
+		{"already above but not growing", spec, usage(1, 12, "3", "2Gi"), usage(1, 12, "3", "2Gi"), nil},
+		{"already above and shrinking", spec, usage(1, 12, "3", "2Gi"), usage(1, 11, "2500m", "2Gi"), nil},
+		{"already above and growing", spec, usage(1, 12, "1", "2Gi"), usage(1, 13, "1", "2Gi"), []string{"replicas 13 > 10"}},
+		{"no limits", &mockv1beta1.MacBookQuotaSpec{}, usage(0, 0, "0", "0"), usage(100, 1000, "100", "100Gi"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exceededLimits(tt.spec, tt.before, tt.after); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("exceededLimits = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMacBookUsage(t *testing.T) {
+	resources := func(cpu, memory string) *corev1.ResourceRequirements {
+		return &corev1.ResourceRequirements{Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(memory),
+		}}
+	}
+	class := &mockv1beta1.MacBookClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "small"},
+		Spec:       mockv1beta1.MacBookClassSpec{Resources: resources("100m", "128Mi")},
+	}
+	tests := []struct {
+		name string
+		spec mockv1beta1.MacBookSpec
+		// want 为 replicas/cpu/memory
+		want string
+	}{
+		{"one replica by default", mockv1beta1.MacBookSpec{}, "1/0/0"},
+		{"resources times replicas", mockv1beta1.MacBookSpec{Replicas: int32Ptr(3), Resources: resources("250m", "256Mi")}, "3/750m/768Mi"},
+		{
+			"limits when there are no requests",
+			mockv1beta1.MacBookSpec{Replicas: int32Ptr(2), Resources: &corev1.ResourceRequirements{Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("500m"),
+				corev1.ResourceMemory: resource.MustParse("1Gi"),
+			}}},
+			"2/1/2Gi",
+		},
+		{
+			"largest scaling schedule",
+			mockv1beta1.MacBookSpec{
+				Replicas:  int32Ptr(2),
+				Resources: resources("100m", "100Mi"),
+				Schedules: []mockv1beta1.ScalingSchedule{{Name: "peak", Schedule: "0 9 * * *", Replicas: 5}, {Name: "night", Schedule: "0 20 * * *", Replicas: 0}},
+			},
+			"5/500m/500Mi",
+		},
+		{"class default resources", mockv1beta1.MacBookSpec{Replicas: int32Ptr(2), ClassName: "small"}, "2/200m/256Mi"},
+		{
+			"components",
+			mockv1beta1.MacBookSpec{
+				Replicas:  int32Ptr(2),
+				Resources: resources("100m", "100Mi"),
+				Components: []mockv1beta1.Component{
+					{Name: "api", Image: "api", Replicas: int32Ptr(3), Resources: resources("200m", "200Mi")},
+					{Name: "worker", Image: "worker"},
+				},
+			},
+			"6/800m/800Mi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MacBook := newTestMacBook()
+			MacBook.Spec = tt.spec
+			r := newFakeReconciler(t, class)
+
+			used := macBookUsage(context.Background(), r.Client, MacBook)
+
+			if got := fmt.Sprintf("%d/%s/%s", used.Replicas, used.CPU.String(), used.Memory.String()); used.MacBooks != 1 || got != tt.want {
+				t.Errorf("usage = %d macbooks %s, want 1 macbooks %s", used.MacBooks, got, tt.want)
+			}
+		})
+	}
+}
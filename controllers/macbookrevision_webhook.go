@@ -0,0 +1,62 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// MacBookRevisionWebhookPath is where the MacBookRevisionValidator is served.
+const MacBookRevisionWebhookPath = "/validate-mock-dong-com-v1beta1-macbookrevision"
+
+//+kubebuilder:webhook:path=/validate-mock-dong-com-v1beta1-macbookrevision,mutating=false,failurePolicy=fail,sideEffects=None,groups=mock.dong.com,resources=macbookrevisions,verbs=update,versions=v1beta1,name=vmacbookrevision.dong.com,admissionReviewVersions={v1,v1beta1}
+
+// MacBookRevisionValidator rejects changes to the spec of a MacBookRevision.
+type MacBookRevisionValidator struct {
+	decoder *admission.Decoder
+}
+
+// InjectDecoder injects the decoder.
+func (v *MacBookRevisionValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle spec.rollbackTo 从 revision 恢复 spec，修改过的 revision 会变成回滚的内容，所以 spec 不允许修改。
+// 标签、注解和 finalizer 可以修改，status 是子资源，不经过这个 webhook
+func (v *MacBookRevisionValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+	revision, old := &mockv1beta1.MacBookRevision{}, &mockv1beta1.MacBookRevision{}
+	if err := v.decoder.Decode(req, revision); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if !equality.Semantic.DeepEqual(revision.Spec, old.Spec) {
+		return admission.Denied("spec of a MacBookRevision is immutable")
+	}
+	return admission.Allowed("")
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"alex-opr/controllers/tools"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// SetTemplateHashAnnotation MacBookSet 创建的 MacBook 上记录生成它的模板哈希
+const SetTemplateHashAnnotation = "mock.dong.com/set-template-hash"
+
+// MacBookSetReconciler reconciles a MacBookSet object
+type MacBookSetReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=mock.dong.com,resources=macbooksets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=mock.dong.com,resources=macbooksets/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=mock.dong.com,resources=macbooks,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// Reconcile 在选中的每个 namespace 中按模板创建或更新 MacBook，删除不再选中的 namespace 中的 MacBook，
+// 并把每个 namespace 的就绪状态汇总到 status。MacBook 通过 owner reference 随 set 一起删除
+func (r *MacBookSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	clog := r.Log.WithValues("macbookset", req.Name)
+
+	set := &mockv1beta1.MacBookSet{}
+	if err := r.Get(ctx, req.NamespacedName, set); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !set.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	before := set.Status.DeepCopy()
+	cond := metav1.Condition{
+		Type:               mockv1beta1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: set.Generation,
+		Reason:             "MacBooksReady",
+	}
+	selector, err := metav1.LabelSelectorAsSelector(&set.Spec.NamespaceSelector)
+	if err != nil {
+		// selector 不合法时不修改已有的 MacBook，等 spec 修正后重新调协
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "InvalidSelector"
+		cond.Message = err.Error()
+		return ctrl.Result{}, r.updateSetStatus(ctx, set, before, cond)
+	}
+	namespaces, err := r.selectedNamespaces(ctx, selector)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	owned, err := r.ownedMacBooks(ctx, set)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	hash := tools.MacBookTemplateHash(&set.Spec.Template)
+	allowed, requeue := r.planWave(clog, set, namespaces, owned, hash)
+	set.Status.Namespaces = nil
+	var notReady []string
+	for _, ns := range namespaces {
+		st, err := r.syncMacBook(ctx, clog, set, ns, owned[ns], hash, allowed == nil || allowed[ns])
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !st.Ready {
+			notReady = append(notReady, ns)
+		}
+		set.Status.Namespaces = append(set.Status.Namespaces, st)
+	}
+	if err := r.pruneMacBooks(ctx, clog, set, namespaces, owned); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if len(notReady) > 0 {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "MacBooksNotReady"
+		cond.Message = fmt.Sprintf("MacBooks not ready in %s", strings.Join(notReady, ", "))
+	}
+	return ctrl.Result{RequeueAfter: requeue}, r.updateSetStatus(ctx, set, before, cond)
+}
+
+// selectedNamespaces 按名称排序返回 selector 选中的、没有在删除中的 namespace
+func (r *MacBookSetReconciler) selectedNamespaces(ctx context.Context, selector labels.Selector) ([]string, error) {
+	list := &corev1.NamespaceList{}
+	if err := r.List(ctx, list, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, ns := range list.Items {
+		if ns.DeletionTimestamp.IsZero() {
+			names = append(names, ns.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ownedMacBooks 按 namespace 返回 set 拥有的 MacBook
+func (r *MacBookSetReconciler) ownedMacBooks(ctx context.Context, set *mockv1beta1.MacBookSet) (map[string]*mockv1beta1.MacBook, error) {
+	list := &mockv1beta1.MacBookList{}
+	if err := r.List(ctx, list, client.MatchingLabels{mockv1beta1.MacBookSetLabel: set.Name}); err != nil {
+		return nil, err
+	}
+	owned := make(map[string]*mockv1beta1.MacBook, len(list.Items))
+	for i := range list.Items {
+		if metav1.IsControlledBy(&list.Items[i], set) {
+			owned[list.Items[i].Namespace] = &list.Items[i]
+		}
+	}
+	return owned, nil
+}
+
+// syncMacBook 创建 namespace 中还不存在的 MacBook，模板变化后 update 为 true 时更新已有的 MacBook。
+// 同名 MacBook 属于别人时不做修改，只在 status 中报告
+func (r *MacBookSetReconciler) syncMacBook(ctx context.Context, clog logr.Logger, set *mockv1beta1.MacBookSet, namespace string, MacBook *mockv1beta1.MacBook, hash string, update bool) (mockv1beta1.MacBookSetNamespaceStatus, error) {
+	st := mockv1beta1.MacBookSetNamespaceStatus{Name: namespace}
+
+	if MacBook == nil {
+		existing := &mockv1beta1.MacBook{}
+		err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: set.Name}, existing)
+		switch {
+		case err == nil:
+			st.Message = "MacBook exists and is not owned by the set"
+			return st, nil
+		case !apierrors.IsNotFound(err):
+			return st, err
+		}
+		MacBook = &mockv1beta1.MacBook{ObjectMeta: metav1.ObjectMeta{Name: set.Name, Namespace: namespace}}
+		applySetTemplate(set, MacBook, hash)
+		if err := controllerutil.SetControllerReference(set, MacBook, r.Scheme); err != nil {
+			return st, err
+		}
+		if err := r.Create(ctx, MacBook); err != nil {
+			return st, err
+		}
+		clog.Info("MacBook create ok", "namespace", namespace)
+		r.Recorder.Eventf(set, corev1.EventTypeNormal, EventReasonCreated, "Created MacBook %s/%s", namespace, set.Name)
+	} else if MacBook.Annotations[SetTemplateHashAnnotation] != hash && update {
+		applySetTemplate(set, MacBook, hash)
+		if err := r.Update(ctx, MacBook); err != nil {
+			return st, err
+		}
+		clog.Info("MacBook update ok", "namespace", namespace)
+		r.Recorder.Eventf(set, corev1.EventTypeNormal, EventReasonUpdated, "Updated MacBook %s/%s", namespace, set.Name)
+	}
+
+	st.Ready, st.Message = setMacBookReady(MacBook, hash)
+	return st, nil
+}
+
+// applySetTemplate 把模板的标签、注解和 spec 写入 MacBook，MacBook 上其它的标签和注解保留
+func applySetTemplate(set *mockv1beta1.MacBookSet, MacBook *mockv1beta1.MacBook, hash string) {
+	template := set.Spec.Template
+	if MacBook.Labels == nil {
+		MacBook.Labels = map[string]string{}
+	}
+	for k, v := range template.Labels {
+		MacBook.Labels[k] = v
+	}
+	MacBook.Labels[mockv1beta1.MacBookSetLabel] = set.Name
+	if MacBook.Annotations == nil {
+		MacBook.Annotations = map[string]string{}
+	}
+	for k, v := range template.Annotations {
+		MacBook.Annotations[k] = v
+	}
+	MacBook.Annotations[SetTemplateHashAnnotation] = hash
+	MacBook.Spec = *template.Spec.DeepCopy()
+}
+
+// setMacBookReady MacBook 已经使用当前模板、控制器已经处理了最新的 spec 并且 Ready 为 True 时就绪
+func setMacBookReady(MacBook *mockv1beta1.MacBook, hash string) (bool, string) {
+	if MacBook.Annotations[SetTemplateHashAnnotation] != hash {
+		return false, "MacBook is not updated to the current template"
+	}
+	if MacBook.Status.ObservedGeneration < MacBook.Generation {
+		return false, "MacBook spec is not observed yet"
+	}
+	// 发布失败回滚后 pod 可能是就绪的，但运行的不是当前的 spec
+	if degraded := meta.FindStatusCondition(MacBook.Status.Conditions, mockv1beta1.ConditionDegraded); degraded != nil && degraded.Status == metav1.ConditionTrue {
+		return false, degraded.Message
+	}
+	cond := meta.FindStatusCondition(MacBook.Status.Conditions, mockv1beta1.ConditionReady)
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		if cond != nil && cond.Message != "" {
+			return false, cond.Message
+		}
+		return false, "MacBook is not ready"
+	}
+	return true, ""
+}
+
+// pruneMacBooks 删除不再被选中的 namespace 中的 MacBook
+func (r *MacBookSetReconciler) pruneMacBooks(ctx context.Context, clog logr.Logger, set *mockv1beta1.MacBookSet, namespaces []string, owned map[string]*mockv1beta1.MacBook) error {
+	selected := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		selected[ns] = true
+	}
+	for ns, MacBook := range owned {
+		if selected[ns] || !MacBook.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if err := r.Delete(ctx, MacBook); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		clog.Info("MacBook delete ok", "namespace", ns)
+		r.Recorder.Eventf(set, corev1.EventTypeNormal, EventReasonMacBookDeleted, "Deleted MacBook %s/%s, the namespace is no longer selected", ns, set.Name)
+	}
+	return nil
+}
+
+// updateSetStatus 汇总 MacBook 的数量，status 有变化时才更新
+func (r *MacBookSetReconciler) updateSetStatus(ctx context.Context, set *mockv1beta1.MacBookSet, before *mockv1beta1.MacBookSetStatus, cond metav1.Condition) error {
+	set.Status.MacBooks, set.Status.ReadyMacBooks = 0, 0
+	for _, st := range set.Status.Namespaces {
+		set.Status.MacBooks++
+		if st.Ready {
+			set.Status.ReadyMacBooks++
+		}
+	}
+	meta.SetStatusCondition(&set.Status.Conditions, cond)
+	set.Status.ObservedGeneration = set.Generation
+	if equality.Semantic.DeepEqual(before, &set.Status) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Status().Update(ctx, set))
+}
+
+// namespaceToSets namespace 创建或者标签变化后重新调协所有的 set，
+// 旧标签已经无法得知，不能只调协新标签选中的 set
+func (r *MacBookSetReconciler) namespaceToSets(obj client.Object) []reconcile.Request {
+	list := &mockv1beta1.MacBookSetList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "unable to list MacBookSets")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for i := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&list.Items[i])})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *MacBookSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&mockv1beta1.MacBookSet{}).
+		Owns(&mockv1beta1.MacBook{}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}}, handler.EnqueueRequestsFromMapFunc(r.namespaceToSets)).
+		Complete(r)
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestMacBookSetFanOut(t *testing.T) {
+	set := &mockv1beta1.MacBookSet{
+		TypeMeta:   metav1.TypeMeta{APIVersion: mockv1beta1.GroupVersion.String(), Kind: "MacBookSet"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", UID: "set-uid"},
+		Spec: mockv1beta1.MacBookSetSpec{
+			NamespaceSelector: metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}},
+			Template: mockv1beta1.MacBookTemplate{
+				Labels: map[string]string{"team": "shop"},
+				Spec:   mockv1beta1.MacBookSpec{Image: "nginx:1.21", Replicas: int32Ptr(3)},
+			},
+		},
+	}
+	namespace := func(name, env string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"env": env}}}
+	}
+	// owned set 在 namespace 中创建的 MacBook，使用旧的模板
+	owned := func(ns string) *mockv1beta1.MacBook {
+		return &mockv1beta1.MacBook{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            set.Name,
+				Namespace:       ns,
+				Labels:          map[string]string{mockv1beta1.MacBookSetLabel: set.Name, "owner": "kept"},
+				Annotations:     map[string]string{SetTemplateHashAnnotation: "old"},
+				OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(set, mockv1beta1.GroupVersion.WithKind("MacBookSet"))},
+			},
+			Spec: mockv1beta1.MacBookSpec{Image: "nginx:1.20", Replicas: int32Ptr(1)},
+		}
+	}
+	foreign := &mockv1beta1.MacBook{
+		ObjectMeta: metav1.ObjectMeta{Name: set.Name, Namespace: "shop-d"},
+		Spec:       mockv1beta1.MacBookSpec{Image: "httpd"},
+	}
+	fr := newFakeReconciler(t,
+		set.DeepCopy(),
+		namespace("shop-a", "prod"),
+		namespace("shop-b", "prod"),
+		namespace("shop-c", "dev"),
+		namespace("shop-d", "prod"),
+		owned("shop-b"),
+		owned("shop-c"),
+		foreign.DeepCopy(),
+	)
+	r := &MacBookSetReconciler{Client: fr.Client, Log: ctrl.Log, Scheme: fr.Scheme, Recorder: fr.Recorder}
+	ctx := context.Background()
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Name: set.Name}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 新选中的 namespace 中创建 MacBook，已有的 MacBook 更新到当前模板并保留自己的标签
+	for _, ns := range []string{"shop-a", "shop-b"} {
+		MacBook := &mockv1beta1.MacBook{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: ns, Name: set.Name}, MacBook); err != nil {
+			t.Fatalf("MacBook in %s: %v", ns, err)
+		}
+		if !metav1.IsControlledBy(MacBook, set) {
+			t.Errorf("MacBook in %s is not owned by the set", ns)
+		}
+		if MacBook.Spec.Image != "nginx:1.21" || *MacBook.Spec.Replicas != 3 {
+			t.Errorf("MacBook in %s has spec %+v, want the template", ns, MacBook.Spec)
+		}
+		if MacBook.Labels["team"] != "shop" || MacBook.Labels[mockv1beta1.MacBookSetLabel] != set.Name {
+			t.Errorf("MacBook in %s has labels %v", ns, MacBook.Labels)
+		}
+		if hash := MacBook.Annotations[SetTemplateHashAnnotation]; hash == "" || hash == "old" {
+			t.Errorf("MacBook in %s has template hash %q", ns, hash)
+		}
+	}
+	kept := &mockv1beta1.MacBook{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "shop-b", Name: set.Name}, kept); err != nil || kept.Labels["owner"] != "kept" {
+		t.Errorf("labels of the updated MacBook = %v (%v), want owner=kept kept", kept.Labels, err)
+	}
+
+	// 不再选中的 namespace 中的 MacBook 被删除
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "shop-c", Name: set.Name}, &mockv1beta1.MacBook{}); !apierrors.IsNotFound(err) {
+		t.Errorf("MacBook in unselected namespace: %v, want not found", err)
+	}
+
+	// 同名的 MacBook 属于别人时保持不变
+	got := &mockv1beta1.MacBook{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: "shop-d", Name: set.Name}, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Spec.Image != foreign.Spec.Image || len(got.OwnerReferences) != 0 {
+		t.Errorf("foreign MacBook was modified: %+v", got)
+	}
+
+	if err := r.Get(ctx, client.ObjectKey{Name: set.Name}, set); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, st := range set.Status.Namespaces {
+		names = append(names, st.Name)
+		if st.Ready {
+			t.Errorf("namespace %s is ready before its MacBook is", st.Name)
+		}
+		if st.Name == "shop-d" && st.Message == "" {
+			t.Error("conflicting MacBook in shop-d is not reported")
+		}
+	}
+	if len(names) != 3 || names[0] != "shop-a" || names[1] != "shop-b" || names[2] != "shop-d" {
+		t.Errorf("status namespaces = %v, want [shop-a shop-b shop-d]", names)
+	}
+	if set.Status.MacBooks != 3 || set.Status.ReadyMacBooks != 0 {
+		t.Errorf("macbooks/ready = %d/%d, want 3/0", set.Status.MacBooks, set.Status.ReadyMacBooks)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// defaultWaveTimeout 一批 MacBook 变为就绪的默认时间
+const defaultWaveTimeout = 10 * time.Minute
+
+// planWave 决定本次调协可以把哪些 namespace 中的 MacBook 更新到新模板，返回 nil 表示全部可以更新。
+// 上一批的 MacBook 全部就绪后才开始下一批；失败的 MacBook 达到阈值后停止发布，直到模板再次修改。
+// 第二个返回值是检查当前批次是否超时的等待时间
+func (r *MacBookSetReconciler) planWave(clog logr.Logger, set *mockv1beta1.MacBookSet, namespaces []string, owned map[string]*mockv1beta1.MacBook, hash string) (map[string]bool, time.Duration) {
+	rollout := set.Spec.Rollout
+	if rollout == nil {
+		set.Status.Rollout = nil
+		return nil, 0
+	}
+	st := set.Status.Rollout
+	if st == nil || st.TemplateHash != hash {
+		st = &mockv1beta1.MacBookSetRolloutStatus{TemplateHash: hash}
+		set.Status.Rollout = st
+	}
+	timeout := defaultWaveTimeout
+	if rollout.WaveTimeout != nil {
+		timeout = rollout.WaveTimeout.Duration
+	}
+	var elapsed time.Duration
+	if st.WaveStartTime != nil {
+		elapsed = time.Since(st.WaveStartTime.Time)
+	}
+
+	// 失败在同一个模板的所有批次中保留，每个 namespace 只记录一次，模板修改后重新开始
+	failed := make(map[string]bool, len(st.Failed))
+	for _, ns := range st.Failed {
+		failed[ns] = true
+	}
+	var outdated []string
+	pending := 0
+	st.UpdatedMacBooks = 0
+	for _, ns := range namespaces {
+		MacBook := owned[ns]
+		// 新的 namespace 直接按当前模板创建，不参与分批
+		if MacBook == nil {
+			continue
+		}
+		if MacBook.Annotations[SetTemplateHashAnnotation] != hash {
+			outdated = append(outdated, ns)
+			continue
+		}
+		st.UpdatedMacBooks++
+		// 已经失败的 namespace 不再检查，之后批次的超时也不会重复计算它
+		if failed[ns] {
+			continue
+		}
+		if ready, _ := setMacBookReady(MacBook, hash); ready {
+			continue
+		}
+		// 新模板的发布失败会被 MacBook 回滚并报告 Degraded，卡住的 MacBook 在批次超时后算作失败。
+		// 没有达到阈值时失败的 MacBook 不阻塞下一批
+		degraded := MacBook.Status.ObservedGeneration >= MacBook.Generation &&
+			meta.IsStatusConditionTrue(MacBook.Status.Conditions, mockv1beta1.ConditionDegraded)
+		if degraded || (st.WaveStartTime != nil && elapsed >= timeout) {
+			failed[ns] = true
+			st.Failed = append(st.Failed, ns)
+			continue
+		}
+		pending++
+	}
+
+	threshold := int(rollout.FailureThreshold)
+	if threshold < 1 {
+		threshold = 1
+	}
+	if !st.Halted && len(st.Failed) >= threshold {
+		st.Halted = true
+		clog.Info("rollout halted", "templateHash", hash, "failed", st.Failed)
+		r.Recorder.Eventf(set, corev1.EventTypeWarning, EventReasonRolloutHalted, "Rollout of template %s halted in wave %d, MacBooks failed in %s",
+			hash, st.Wave, strings.Join(st.Failed, ", "))
+	}
+	if st.Halted || len(outdated) == 0 {
+		return map[string]bool{}, 0
+	}
+	if pending > 0 {
+		if st.WaveStartTime == nil {
+			return map[string]bool{}, 0
+		}
+		return map[string]bool{}, timeout - elapsed
+	}
+
+	batch, err := intstr.GetValueFromIntOrPercent(&rollout.BatchSize, len(namespaces), true)
+	if err != nil || batch < 1 {
+		batch = 1
+	}
+	if batch > len(outdated) {
+		batch = len(outdated)
+	}
+	allowed := make(map[string]bool, batch)
+	for _, ns := range outdated[:batch] {
+		allowed[ns] = true
+	}
+	now := metav1.Now()
+	st.Wave++
+	st.WaveStartTime = &now
+	st.UpdatedMacBooks += int32(batch)
+	clog.Info("rollout wave started", "templateHash", hash, "wave", st.Wave, "namespaces", outdated[:batch])
+	r.Recorder.Eventf(set, corev1.EventTypeNormal, EventReasonWaveStarted, "Wave %d of template %s updates MacBooks in %s",
+		st.Wave, hash, strings.Join(outdated[:batch], ", "))
+	return allowed, timeout
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestPlanWave(t *testing.T) {
+	r := &MacBookSetReconciler{Recorder: record.NewFakeRecorder(100)}
+	set := &mockv1beta1.MacBookSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec: mockv1beta1.MacBookSetSpec{Rollout: &mockv1beta1.MacBookSetRollout{
+			BatchSize:        intstr.FromInt(1),
+			FailureThreshold: 2,
+			WaveTimeout:      &metav1.Duration{Duration: time.Minute},
+		}},
+	}
+	namespaces := []string{"a", "b", "c"}
+	owned := map[string]*mockv1beta1.MacBook{}
+	for _, ns := range namespaces {
+		owned[ns] = &mockv1beta1.MacBook{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "web", Annotations: map[string]string{SetTemplateHashAnnotation: "old"}}}
+	}
+	// update 模拟控制器把 MacBook 更新到新模板，condition 为 Ready 或 Degraded
+	update := func(ns, condition string) {
+		MacBook := owned[ns]
+		MacBook.Annotations[SetTemplateHashAnnotation] = "new"
+		meta.SetStatusCondition(&MacBook.Status.Conditions, metav1.Condition{Type: condition, Status: metav1.ConditionTrue, Reason: condition})
+	}
+	plan := func() string {
+		allowed, _ := r.planWave(ctrl.Log, set, namespaces, owned, "new")
+		var names []string
+		for _, ns := range namespaces {
+			if allowed[ns] {
+				names = append(names, ns)
+			}
+		}
+		st := set.Status.Rollout
+		return fmt.Sprintf("allowed=%v wave=%d failed=%v halted=%v", names, st.Wave, st.Failed, st.Halted)
+	}
+	expect := func(step, want string) {
+		t.Helper()
+		if got := plan(); got != want {
+			t.Errorf("%s: %s, want %s", step, got, want)
+		}
+	}
+
+	expect("first wave", "allowed=[a] wave=1 failed=[] halted=false")
+	owned["a"].Annotations[SetTemplateHashAnnotation] = "new"
+	expect("waiting for the wave", "allowed=[] wave=1 failed=[] halted=false")
+
+	// a 在批次超时前没有就绪，记为失败，没有达到阈值时继续下一批
+	expired := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+	set.Status.Rollout.WaveStartTime = &expired
+	expect("timed out wave", "allowed=[b] wave=2 failed=[a] halted=false")
+
+	// 新的批次开始后 a 不再检查，也不会阻塞之后的批次
+	update("b", mockv1beta1.ConditionReady)
+	expect("failure kept across waves", "allowed=[c] wave=3 failed=[a] halted=false")
+	owned["c"].Annotations[SetTemplateHashAnnotation] = "new"
+	expect("failure recorded once", "allowed=[] wave=3 failed=[a] halted=false")
+
+	update("c", mockv1beta1.ConditionDegraded)
+	expect("threshold reached", "allowed=[] wave=3 failed=[a c] halted=true")
+
+	// 模板修改后重新开始
+	allowed, _ := r.planWave(ctrl.Log, set, namespaces, owned, "newer")
+	if st := set.Status.Rollout; len(allowed) != 1 || st.Wave != 1 || st.Halted || len(st.Failed) != 0 {
+		t.Errorf("new template: allowed %v, status %+v", allowed, st)
+	}
+}
@@ -0,0 +1,415 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// tenantFinalizer 删除 tenant 时先删除它的 namespace
+	tenantFinalizer = "mock.dong.com/tenant-finalizer"
+	// tenant 在每个 namespace 中创建的对象名称
+	tenantQuotaName       = "tenant-quota"
+	tenantLimitRangeName  = "tenant-limits"
+	tenantRoleBindingName = "tenant-admins"
+	// tenantDeletePollInterval 等待 namespace 删除完成的间隔
+	tenantDeletePollInterval = 5 * time.Second
+)
+
+// TenantReconciler reconciles a Tenant object
+type TenantReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=mock.dong.com,resources=tenants,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=mock.dong.com,resources=tenants/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=mock.dong.com,resources=tenants/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=resourcequotas,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=limitranges,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=bind
+
+// Reconcile 创建并维护 tenant 的 namespace，以及每个 namespace 中的 ResourceQuota、LimitRange、
+// 管理员的 RoleBinding 和初始的 MacBook，结果汇总到 tenant 的 status
+func (r *TenantReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	clog := r.Log.WithValues("tenant", req.Name)
+
+	tenant := &mockv1beta1.Tenant{}
+	if err := r.Get(ctx, req.NamespacedName, tenant); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !tenant.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, clog, tenant)
+	}
+	if !containsString(tenant.Finalizers, tenantFinalizer) {
+		tenant.Finalizers = append(tenant.Finalizers, tenantFinalizer)
+		if err := r.Update(ctx, tenant); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+	}
+
+	before := tenant.Status.DeepCopy()
+	tenant.Status.Namespaces = nil
+	var problems []string
+	for _, name := range tenant.Spec.Namespaces {
+		nsStatus, err := r.reconcileNamespace(ctx, clog, tenant, name)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if nsStatus.Phase != mockv1beta1.TenantNamespaceActive {
+			problems = append(problems, fmt.Sprintf("namespace %s is %s", name, strings.ToLower(nsStatus.Phase)))
+		}
+		tenant.Status.Namespaces = append(tenant.Status.Namespaces, nsStatus)
+	}
+	seedProblems, err := r.seedMacBooks(ctx, clog, tenant)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	problems = append(problems, seedProblems...)
+	if err := r.pruneNamespaces(ctx, clog, tenant); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.countMacBooks(ctx, tenant); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	cond := metav1.Condition{
+		Type:               mockv1beta1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: tenant.Generation,
+		Reason:             "NamespacesReady",
+	}
+	if len(problems) > 0 {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "NamespacesNotReady"
+		cond.Message = strings.Join(problems, "; ")
+	}
+	meta.SetStatusCondition(&tenant.Status.Conditions, cond)
+	tenant.Status.ObservedGeneration = tenant.Generation
+	if !equality.Semantic.DeepEqual(before, &tenant.Status) {
+		if err := r.Status().Update(ctx, tenant); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// reconcileNamespace 创建或修正 tenant 的一个 namespace 和其中的对象。
+// 同名 namespace 属于别人时不做任何修改，只在 status 中报告冲突
+func (r *TenantReconciler) reconcileNamespace(ctx context.Context, clog logr.Logger, tenant *mockv1beta1.Tenant, name string) (mockv1beta1.TenantNamespaceStatus, error) {
+	st := mockv1beta1.TenantNamespaceStatus{Name: name, Phase: mockv1beta1.TenantNamespaceActive}
+
+	ns := &corev1.Namespace{}
+	err := r.Get(ctx, client.ObjectKey{Name: name}, ns)
+	switch {
+	case apierrors.IsNotFound(err):
+		ns = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: tenantLabels(tenant)}}
+		if err := controllerutil.SetControllerReference(tenant, ns, r.Scheme); err != nil {
+			return st, err
+		}
+		if err := r.Create(ctx, ns); err != nil {
+			return st, err
+		}
+		addedNamespaces.Inc()
+		clog.Info("namespace create ok", "namespace", name)
+		r.Recorder.Eventf(tenant, corev1.EventTypeNormal, EventReasonCreated, "Created namespace %s", name)
+	case err != nil:
+		return st, err
+	case !metav1.IsControlledBy(ns, tenant):
+		st.Phase = mockv1beta1.TenantNamespaceConflict
+		st.Message = "namespace exists and is not owned by the tenant"
+		return st, nil
+	case !ns.DeletionTimestamp.IsZero():
+		st.Phase = mockv1beta1.TenantNamespaceTerminating
+		return st, nil
+	default:
+		changed := false
+		if ns.Labels == nil {
+			ns.Labels = map[string]string{}
+		}
+		for k, v := range tenantLabels(tenant) {
+			if ns.Labels[k] != v {
+				ns.Labels[k] = v
+				changed = true
+			}
+		}
+		if changed {
+			if err := r.Update(ctx, ns); err != nil {
+				return st, err
+			}
+		}
+	}
+
+	if err := r.reconcileQuota(ctx, tenant, name); err != nil {
+		return st, err
+	}
+	if err := r.reconcileLimitRange(ctx, tenant, name); err != nil {
+		return st, err
+	}
+	return st, r.reconcileAdmins(ctx, tenant, name)
+}
+
+func (r *TenantReconciler) reconcileQuota(ctx context.Context, tenant *mockv1beta1.Tenant, namespace string) error {
+	quota := &corev1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: tenantQuotaName, Namespace: namespace}}
+	if tenant.Spec.ResourceQuota == nil {
+		return r.deleteOwned(ctx, tenant, quota)
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, quota, func() error {
+		quota.Labels = tenantLabels(tenant)
+		quota.Spec = *tenant.Spec.ResourceQuota.DeepCopy()
+		return controllerutil.SetControllerReference(tenant, quota, r.Scheme)
+	})
+	return err
+}
+
+func (r *TenantReconciler) reconcileLimitRange(ctx context.Context, tenant *mockv1beta1.Tenant, namespace string) error {
+	limits := &corev1.LimitRange{ObjectMeta: metav1.ObjectMeta{Name: tenantLimitRangeName, Namespace: namespace}}
+	if tenant.Spec.LimitRange == nil {
+		return r.deleteOwned(ctx, tenant, limits)
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, limits, func() error {
+		limits.Labels = tenantLabels(tenant)
+		limits.Spec = *tenant.Spec.LimitRange.DeepCopy()
+		return controllerutil.SetControllerReference(tenant, limits, r.Scheme)
+	})
+	return err
+}
+
+func (r *TenantReconciler) reconcileAdmins(ctx context.Context, tenant *mockv1beta1.Tenant, namespace string) error {
+	binding := &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: tenantRoleBindingName, Namespace: namespace}}
+	if len(tenant.Spec.Admins) == 0 {
+		return r.deleteOwned(ctx, tenant, binding)
+	}
+	role := tenant.Spec.AdminRole
+	if role == "" {
+		role = "admin"
+	}
+	// roleRef 不能修改，修改了 adminRole 时重新创建
+	if err := r.Get(ctx, client.ObjectKeyFromObject(binding), binding); err == nil && binding.RoleRef.Name != role {
+		if err := r.deleteOwned(ctx, tenant, binding); err != nil {
+			return err
+		}
+		binding = &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: tenantRoleBindingName, Namespace: namespace}}
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, binding, func() error {
+		binding.Labels = tenantLabels(tenant)
+		binding.RoleRef = rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: role}
+		binding.Subjects = tenant.Spec.Admins
+		return controllerutil.SetControllerReference(tenant, binding, r.Scheme)
+	})
+	return err
+}
+
+// deleteOwned 删除 tenant 拥有的对象，不存在或者属于别人时忽略
+func (r *TenantReconciler) deleteOwned(ctx context.Context, tenant *mockv1beta1.Tenant, obj client.Object) error {
+	if err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, tenant) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, obj))
+}
+
+// seedMacBooks 创建还不存在的初始 MacBook，已经存在的不再修改
+func (r *TenantReconciler) seedMacBooks(ctx context.Context, clog logr.Logger, tenant *mockv1beta1.Tenant) ([]string, error) {
+	active := map[string]bool{}
+	for _, st := range tenant.Status.Namespaces {
+		active[st.Name] = st.Phase == mockv1beta1.TenantNamespaceActive
+	}
+	var problems []string
+	for _, seed := range tenant.Spec.MacBooks {
+		ok, known := active[seed.Namespace]
+		if !known {
+			problems = append(problems, fmt.Sprintf("MacBook %s/%s is not in a namespace of the tenant", seed.Namespace, seed.Name))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		MacBook := &mockv1beta1.MacBook{}
+		err := r.Get(ctx, client.ObjectKey{Namespace: seed.Namespace, Name: seed.Name}, MacBook)
+		if err == nil {
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		MacBook = &mockv1beta1.MacBook{
+			ObjectMeta: metav1.ObjectMeta{Name: seed.Name, Namespace: seed.Namespace, Labels: map[string]string{mockv1beta1.TenantLabel: tenant.Name}},
+			Spec:       *seed.Spec.DeepCopy(),
+		}
+		if err := r.Create(ctx, MacBook); err != nil && !apierrors.IsAlreadyExists(err) {
+			return nil, err
+		}
+		clog.Info("seed MacBook create ok", "macbook", client.ObjectKeyFromObject(MacBook))
+		r.Recorder.Eventf(tenant, corev1.EventTypeNormal, EventReasonCreated, "Created MacBook %s/%s", seed.Namespace, seed.Name)
+	}
+	return problems, nil
+}
+
+// pruneNamespaces 删除从 spec.namespaces 中移除的 namespace
+func (r *TenantReconciler) pruneNamespaces(ctx context.Context, clog logr.Logger, tenant *mockv1beta1.Tenant) error {
+	namespaces, err := r.ownedNamespaces(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	for i := range namespaces {
+		ns := &namespaces[i]
+		if containsString(tenant.Spec.Namespaces, ns.Name) || !ns.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if err := r.Delete(ctx, ns); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		clog.Info("namespace delete ok", "namespace", ns.Name)
+		r.Recorder.Eventf(tenant, corev1.EventTypeNormal, EventReasonNamespaceDeleted, "Deleted namespace %s removed from the tenant", ns.Name)
+	}
+	return nil
+}
+
+// countMacBooks 汇总每个 namespace 中 MacBook 的数量和就绪数量
+func (r *TenantReconciler) countMacBooks(ctx context.Context, tenant *mockv1beta1.Tenant) error {
+	tenant.Status.MacBooks, tenant.Status.ReadyMacBooks = 0, 0
+	for i := range tenant.Status.Namespaces {
+		st := &tenant.Status.Namespaces[i]
+		if st.Phase == mockv1beta1.TenantNamespaceConflict {
+			continue
+		}
+		list := &mockv1beta1.MacBookList{}
+		if err := r.List(ctx, list, client.InNamespace(st.Name)); err != nil {
+			return err
+		}
+		for _, item := range list.Items {
+			st.MacBooks++
+			if meta.IsStatusConditionTrue(item.Status.Conditions, mockv1beta1.ConditionReady) {
+				st.ReadyMacBooks++
+			}
+		}
+		tenant.Status.MacBooks += st.MacBooks
+		tenant.Status.ReadyMacBooks += st.ReadyMacBooks
+	}
+	return nil
+}
+
+// finalize 删除 tenant 的所有 namespace，等它们真正消失后再移除 finalizer
+func (r *TenantReconciler) finalize(ctx context.Context, clog logr.Logger, tenant *mockv1beta1.Tenant) (ctrl.Result, error) {
+	if !containsString(tenant.Finalizers, tenantFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	namespaces, err := r.ownedNamespaces(ctx, tenant)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	for i := range namespaces {
+		ns := &namespaces[i]
+		if !ns.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if err := r.Delete(ctx, ns); err != nil && !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		clog.Info("namespace delete ok", "namespace", ns.Name)
+	}
+	if len(namespaces) > 0 {
+		clog.Info("waiting for namespaces to be deleted", "remaining", len(namespaces))
+		return ctrl.Result{RequeueAfter: tenantDeletePollInterval}, nil
+	}
+
+	tenant.Finalizers = removeString(tenant.Finalizers, tenantFinalizer)
+	if err := r.Update(ctx, tenant); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	clog.Info("tenant cleaned up")
+	return ctrl.Result{}, nil
+}
+
+// ownedNamespaces 带有 tenant 标签并且属于 tenant 的 namespace
+func (r *TenantReconciler) ownedNamespaces(ctx context.Context, tenant *mockv1beta1.Tenant) ([]corev1.Namespace, error) {
+	list := &corev1.NamespaceList{}
+	if err := r.List(ctx, list, client.MatchingLabels{mockv1beta1.TenantLabel: tenant.Name}); err != nil {
+		return nil, err
+	}
+	var owned []corev1.Namespace
+	for _, ns := range list.Items {
+		if metav1.IsControlledBy(&ns, tenant) {
+			owned = append(owned, ns)
+		}
+	}
+	return owned, nil
+}
+
+// tenantLabels spec.labels 加上 tenant 标签
+func tenantLabels(tenant *mockv1beta1.Tenant) map[string]string {
+	labels := make(map[string]string, len(tenant.Spec.Labels)+1)
+	for k, v := range tenant.Spec.Labels {
+		labels[k] = v
+	}
+	labels[mockv1beta1.TenantLabel] = tenant.Name
+	return labels
+}
+
+// macBookToTenant MacBook 的就绪状态变化后更新所在 namespace 的 tenant 的 status
+func (r *TenantReconciler) macBookToTenant(obj client.Object) []reconcile.Request {
+	ns := &corev1.Namespace{}
+	if err := r.Get(context.Background(), client.ObjectKey{Name: obj.GetNamespace()}, ns); err != nil {
+		return nil
+	}
+	name, ok := ns.Labels[mockv1beta1.TenantLabel]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: name}}}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *TenantReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&mockv1beta1.Tenant{}).
+		Owns(&corev1.Namespace{}).
+		Owns(&corev1.ResourceQuota{}).
+		Owns(&corev1.LimitRange{}).
+		Owns(&rbacv1.RoleBinding{}).
+		Watches(&source.Kind{Type: &mockv1beta1.MacBook{}}, handler.EnqueueRequestsFromMapFunc(r.macBookToTenant)).
+		Complete(r)
+}
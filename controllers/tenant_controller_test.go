@@ -0,0 +1,128 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestTenantNamespaceConflict(t *testing.T) {
+	other := &mockv1beta1.Tenant{ObjectMeta: metav1.ObjectMeta{Name: "other", UID: "other-uid"}}
+	tests := []struct {
+		name string
+		// shared 集群中已有的 shared namespace，nil 表示不存在
+		shared    *corev1.Namespace
+		wantPhase string
+	}{
+		{
+			name:      "missing namespace is created",
+			wantPhase: mockv1beta1.TenantNamespaceActive,
+		},
+		{
+			name:      "foreign namespace is left alone",
+			shared:    &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shared", Labels: map[string]string{"team": "platform"}}},
+			wantPhase: mockv1beta1.TenantNamespaceConflict,
+		},
+		{
+			name: "namespace of another tenant is left alone",
+			shared: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:            "shared",
+				Labels:          map[string]string{mockv1beta1.TenantLabel: other.Name},
+				OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(other, mockv1beta1.GroupVersion.WithKind("Tenant"))},
+			}},
+			wantPhase: mockv1beta1.TenantNamespaceConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant := &mockv1beta1.Tenant{
+				TypeMeta:   metav1.TypeMeta{APIVersion: mockv1beta1.GroupVersion.String(), Kind: "Tenant"},
+				ObjectMeta: metav1.ObjectMeta{Name: "acme", UID: "acme-uid"},
+				Spec: mockv1beta1.TenantSpec{
+					Namespaces:    []string{"acme-dev", "shared"},
+					ResourceQuota: &corev1.ResourceQuotaSpec{},
+					MacBooks: []mockv1beta1.TenantMacBook{
+						{Name: "web", Namespace: "acme-dev"},
+						{Name: "web", Namespace: "shared"},
+					},
+				},
+			}
+			// legacy 带有 tenant 标签但不属于 tenant，不在 spec 中也不能被删除
+			legacy := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "legacy", Labels: map[string]string{mockv1beta1.TenantLabel: tenant.Name}}}
+			objs := []runtime.Object{tenant, legacy}
+			if tt.shared != nil {
+				objs = append(objs, tt.shared.DeepCopy())
+			}
+			fr := newFakeReconciler(t, objs...)
+			r := &TenantReconciler{Client: fr.Client, Log: ctrl.Log, Scheme: fr.Scheme, Recorder: fr.Recorder}
+			ctx := context.Background()
+
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKey{Name: tenant.Name}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := r.Get(ctx, client.ObjectKey{Name: tenant.Name}, tenant); err != nil {
+				t.Fatal(err)
+			}
+			phases := map[string]string{}
+			for _, st := range tenant.Status.Namespaces {
+				phases[st.Name] = st.Phase
+			}
+			if phases["acme-dev"] != mockv1beta1.TenantNamespaceActive || phases["shared"] != tt.wantPhase {
+				t.Errorf("namespace phases = %v, want acme-dev %s and shared %s", phases, mockv1beta1.TenantNamespaceActive, tt.wantPhase)
+			}
+			wantReady := tt.wantPhase == mockv1beta1.TenantNamespaceActive
+			if ready := meta.IsStatusConditionTrue(tenant.Status.Conditions, mockv1beta1.ConditionReady); ready != wantReady {
+				t.Errorf("ready = %v, want %v", ready, wantReady)
+			}
+
+			shared := &corev1.Namespace{}
+			if err := r.Get(ctx, client.ObjectKey{Name: "shared"}, shared); err != nil {
+				t.Fatal(err)
+			}
+			if owned := metav1.IsControlledBy(shared, tenant); owned != wantReady {
+				t.Errorf("shared namespace owned by the tenant = %v, want %v", owned, wantReady)
+			}
+			if tt.shared != nil && !equality.Semantic.DeepEqual(shared.Labels, tt.shared.Labels) {
+				t.Errorf("shared namespace labels = %v, want unchanged %v", shared.Labels, tt.shared.Labels)
+			}
+			for name, obj := range map[string]client.Object{tenantQuotaName: &corev1.ResourceQuota{}, "web": &mockv1beta1.MacBook{}} {
+				err := r.Get(ctx, client.ObjectKey{Namespace: "shared", Name: name}, obj)
+				if exists := err == nil; exists != wantReady {
+					t.Errorf("%T in shared namespace exists = %v (%v), want %v", obj, exists, err, wantReady)
+				}
+			}
+
+			if err := r.Get(ctx, client.ObjectKey{Name: legacy.Name}, legacy); apierrors.IsNotFound(err) {
+				t.Error("namespace not owned by the tenant was pruned")
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
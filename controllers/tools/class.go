@@ -0,0 +1,59 @@
+/*
+ *@Description     合并 MacBookClass 的默认值和 MacBook 的设置
+ *@author          lirui
+ *@create          2021-06-27 15:20
+ */
+package tools
+
+import (
+	"strings"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// applyClass 把 class 的默认值合并到 web 容器，MacBook 自己的设置优先。class 为 nil 时只使用 MacBook 的设置
+func applyClass(c *apiv1.Container, ins *mockv1beta1.MacBook, class *mockv1beta1.MacBookClass) {
+	var cs mockv1beta1.MacBookClassSpec
+	if class != nil {
+		cs = class.Spec
+	}
+	if cs.ImageRegistry != "" && ImageRegistry(c.Image) == "" {
+		c.Image = strings.TrimSuffix(cs.ImageRegistry, "/") + "/" + c.Image
+	}
+	if r := ins.Spec.Resources; r != nil {
+		c.Resources = *r.DeepCopy()
+	} else if r := cs.Resources; r != nil {
+		c.Resources = *r.DeepCopy()
+	}
+	c.LivenessProbe = firstProbe(ins.Spec.LivenessProbe, cs.LivenessProbe)
+	c.ReadinessProbe = firstProbe(ins.Spec.ReadinessProbe, cs.ReadinessProbe)
+	if sc := ins.Spec.SecurityContext; sc != nil {
+		c.SecurityContext = sc.DeepCopy()
+	} else if sc := cs.SecurityContext; sc != nil {
+		c.SecurityContext = sc.DeepCopy()
+	}
+}
+
+func firstProbe(probes ...*apiv1.Probe) *apiv1.Probe {
+	for _, p := range probes {
+		if p != nil {
+			return p.DeepCopy()
+		}
+	}
+	return nil
+}
+
+// ImageRegistry 返回镜像引用中的 registry，没有写 registry（使用 Docker Hub）时返回空。
+// 和 docker 的规则一样，第一段包含 . 或 : 或者是 localhost 时才是 registry
+func ImageRegistry(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return ""
+	}
+	first := image[:i]
+	if strings.ContainsAny(first, ".:") || first == "localhost" {
+		return first
+	}
+	return ""
+}
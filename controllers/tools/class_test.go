@@ -0,0 +1,140 @@
+/*
+ *@Description     MacBookClass 默认值合并和镜像 registry 的测试
+ *@author          lirui
+ *@create          2021-06-27 16:05
+ */
+package tools
+
+import (
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestImageRegistry(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"nginx", ""},
+		{"library/nginx:1.21", ""},
+		{"registry.example.com/web:v1", "registry.example.com"},
+		{"localhost:5000/web", "localhost:5000"},
+		{"localhost/web", "localhost"},
+	}
+	for _, tt := range tests {
+		if got := ImageRegistry(tt.image); got != tt.want {
+			t.Errorf("ImageRegistry(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestApplyClass(t *testing.T) {
+	classResources := &apiv1.ResourceRequirements{Limits: apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("1")}}
+	ownResources := &apiv1.ResourceRequirements{Limits: apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("2")}}
+	classProbe := &apiv1.Probe{InitialDelaySeconds: 5}
+	ownProbe := &apiv1.Probe{InitialDelaySeconds: 30}
+	nonRoot, root := true, false
+	class := &mockv1beta1.MacBookClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "standard"},
+		Spec: mockv1beta1.MacBookClassSpec{
+			ImageRegistry:   "registry.example.com/",
+			Resources:       classResources,
+			LivenessProbe:   classProbe,
+			ReadinessProbe:  classProbe,
+			SecurityContext: &apiv1.SecurityContext{RunAsNonRoot: &nonRoot},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		class *mockv1beta1.MacBookClass
+		// setup 修改 MacBook 的 spec
+		setup         func(spec *mockv1beta1.MacBookSpec)
+		wantImage     string
+		wantResources *apiv1.ResourceRequirements
+		wantLiveness  *apiv1.Probe
+		wantReadiness *apiv1.Probe
+		wantNonRoot   *bool
+	}{
+		{
+			name:      "no class",
+			wantImage: "nginx",
+		},
+		{
+			name:          "class defaults",
+			class:         class,
+			wantImage:     "registry.example.com/nginx",
+			wantResources: classResources,
+			wantLiveness:  classProbe,
+			wantReadiness: classProbe,
+			wantNonRoot:   &nonRoot,
+		},
+		{
+			name:  "image with a registry is kept",
+			class: class,
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.Image = "other.example.com/nginx"
+			},
+			wantImage:     "other.example.com/nginx",
+			wantResources: classResources,
+			wantLiveness:  classProbe,
+			wantReadiness: classProbe,
+			wantNonRoot:   &nonRoot,
+		},
+		{
+			name:  "MacBook settings win over the class",
+			class: class,
+			setup: func(spec *mockv1beta1.MacBookSpec) {
+				spec.Resources = ownResources
+				spec.LivenessProbe = ownProbe
+				spec.SecurityContext = &apiv1.SecurityContext{RunAsNonRoot: &root}
+			},
+			wantImage:     "registry.example.com/nginx",
+			wantResources: ownResources,
+			wantLiveness:  ownProbe,
+			wantReadiness: classProbe,
+			wantNonRoot:   &root,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ins := &mockv1beta1.MacBook{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+				Spec:       mockv1beta1.MacBookSpec{Image: "nginx"},
+			}
+			if tt.setup != nil {
+				tt.setup(&ins.Spec)
+			}
+			c := NewDeployMent(ins, tt.class).Spec.Template.Spec.Containers[0]
+
+			if c.Image != tt.wantImage {
+				t.Errorf("image = %q, want %q", c.Image, tt.wantImage)
+			}
+			wantResources := apiv1.ResourceRequirements{}
+			if tt.wantResources != nil {
+				wantResources = *tt.wantResources
+			}
+			if !equality.Semantic.DeepEqual(c.Resources, wantResources) {
+				t.Errorf("resources = %+v, want %+v", c.Resources, wantResources)
+			}
+			if !equality.Semantic.DeepEqual(c.LivenessProbe, tt.wantLiveness) {
+				t.Errorf("liveness probe = %+v, want %+v", c.LivenessProbe, tt.wantLiveness)
+			}
+			if !equality.Semantic.DeepEqual(c.ReadinessProbe, tt.wantReadiness) {
+				t.Errorf("readiness probe = %+v, want %+v", c.ReadinessProbe, tt.wantReadiness)
+			}
+			var nonRoot *bool
+			if c.SecurityContext != nil {
+				nonRoot = c.SecurityContext.RunAsNonRoot
+			}
+			if !equality.Semantic.DeepEqual(nonRoot, tt.wantNonRoot) {
+				t.Errorf("runAsNonRoot = %v, want %v", nonRoot, tt.wantNonRoot)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ *@Description     pod 模板和 spec 的哈希，用来识别同一个版本
+ *@author          lirui
+ *@create          2021-06-06 10:20
+ */
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// TemplateHash 计算 pod 模板的哈希，模板相同哈希就相同
+func TemplateHash(template *apiv1.PodTemplateSpec) string {
+	return hashObject(template)
+}
+
+// SpecHash 计算 MacBook spec 的哈希，rollbackTo 和 revisionHistoryLimit 不属于工作负载，不参与计算
+func SpecHash(spec *mockv1beta1.MacBookSpec) string {
+	s := spec.DeepCopy()
+	s.RollbackTo = nil
+	s.RevisionHistoryLimit = nil
+	return hashObject(s)
+}
+
+// MacBookTemplateHash 计算 MacBookSet 模板的哈希，模板修改后哈希变化，用来判断 MacBook 是否已经更新
+func MacBookTemplateHash(template *mockv1beta1.MacBookTemplate) string {
+	return hashObject(template)
+}
+
+// HookHash 计算 hook 的哈希，hook 修改后哈希变化，用来重新运行失败的 hook。没有 hook 时返回空字符串
+func HookHash(hook *mockv1beta1.Hook) string {
+	if hook == nil {
+		return ""
+	}
+	return hashObject(hook)
+}
+
+func hashObject(obj interface{}) string {
+	hasher := fnv.New32a()
+	// 结构体按字段顺序、map 按 key 排序序列化，结果是稳定的
+	data, _ := json.Marshal(obj)
+	hasher.Write(data)
+	return fmt.Sprintf("%08x", hasher.Sum32())
+}
@@ -0,0 +1,127 @@
+/*
+ *@Description     spec.components 中每个组件的 deployment 和 service
+ *@author          lirui
+ *@create          2021-07-10 11:05
+ */
+package tools
+
+import (
+	"fmt"
+	"strings"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// ComponentLabel 组件的 deployment、service 和 pod 上的标签，值为组件名称
+	ComponentLabel = "mock.dong.com/component"
+)
+
+// ComponentName 组件的 deployment 和 service 的名称 <macbook>-<component>
+func ComponentName(ins *mockv1beta1.MacBook, component string) string {
+	return ins.Name + "-" + component
+}
+
+// ReservedComponentName 组件的名称会和 canary、green deployment 或者预览 service 重名
+func ReservedComponentName(ins *mockv1beta1.MacBook, component string) bool {
+	name := ComponentName(ins, component)
+	return name == CanaryName(ins) || name == ColorName(ins, ColorGreen) || name == PreviewServiceName(ins)
+}
+
+// ComponentSelector 选择组件的 pod，按 MacBookLabel 和 ComponentLabel 选择
+func ComponentSelector(ins *mockv1beta1.MacBook, component string) map[string]string {
+	return map[string]string{
+		MacBookLabel:   ins.Name,
+		ComponentLabel: component,
+	}
+}
+
+// NewComponentDeployMent 生成组件的 deployment，休眠时副本数和 MacBook 一起缩为 0。
+// pod 没有 AppLabel，<macbook>-<component> 可能是别的 MacBook 的名称，带上 AppLabel 会被它的 service 选中
+func NewComponentDeployMent(ins *mockv1beta1.MacBook, c *mockv1beta1.Component) *appsv1.Deployment {
+	name := ComponentName(ins, c.Name)
+	replicas := int32(1)
+	if c.Replicas != nil {
+		replicas = *c.Replicas
+	}
+	if h := ins.Status.Hibernation; h != nil && h.Hibernated {
+		replicas = 0
+	}
+	container := apiv1.Container{
+		Name:  c.Name,
+		Image: c.Image,
+		Ports: c.Ports,
+		Env:   c.Env,
+	}
+	if c.Resources != nil {
+		container.Resources = *c.Resources.DeepCopy()
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ins.Namespace,
+			Labels:    componentLabels(ins, c.Name),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas:                int32Ptr(replicas),
+			ProgressDeadlineSeconds: copyInt32Ptr(ins.Spec.ProgressDeadlineSeconds),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: ComponentSelector(ins, c.Name),
+			},
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: componentLabels(ins, c.Name),
+				},
+				Spec: apiv1.PodSpec{
+					TerminationGracePeriodSeconds: int64Ptr(0),
+					Containers:                    []apiv1.Container{container},
+				},
+			},
+		},
+	}
+}
+
+// NewComponentService 暴露组件容器的所有端口，多个端口时 service 端口必须有名称，没有名称的按协议和端口号命名
+func NewComponentService(ins *mockv1beta1.MacBook, c *mockv1beta1.Component) *apiv1.Service {
+	name := ComponentName(ins, c.Name)
+	ports := make([]apiv1.ServicePort, 0, len(c.Ports))
+	for _, p := range c.Ports {
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = apiv1.ProtocolTCP
+		}
+		portName := p.Name
+		if portName == "" {
+			portName = fmt.Sprintf("%s-%d", strings.ToLower(string(protocol)), p.ContainerPort)
+		}
+		ports = append(ports, apiv1.ServicePort{
+			Name:       portName,
+			Protocol:   protocol,
+			Port:       p.ContainerPort,
+			TargetPort: intstr.FromInt(int(p.ContainerPort)),
+		})
+	}
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ins.Namespace,
+			Labels:    componentLabels(ins, c.Name),
+		},
+		Spec: apiv1.ServiceSpec{
+			Selector: ComponentSelector(ins, c.Name),
+			Ports:    ports,
+		},
+	}
+}
+
+func componentLabels(ins *mockv1beta1.MacBook, component string) map[string]string {
+	return map[string]string{
+		MacBookLabel:   ins.Name,
+		ComponentLabel: component,
+	}
+}
@@ -10,51 +10,178 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
 )
 
-func NewDeployMent(ins *mockv1beta1.MacBook) *appsv1.Deployment {
+const (
+	// DefaultImage spec.image 为空时使用的镜像
+	DefaultImage = "nginx:1.12"
+	// AppLabel pod 上的标签，值为 MacBook 的名称，deployment 通过它选择 pod，service 同时按 MacBookLabel 选择
+	AppLabel = "app"
+	// MacBookLabel MacBook 创建的 pod 以及组件的 deployment、service 上的标签，值为 MacBook 的名称。
+	// app 是通用的标签，其他工作负载也可能使用，控制器通过这个标签找到 MacBook 的 pod
+	MacBookLabel = "mock.dong.com/macbook"
+	// TrackLabel 区分 canary 的 pod，stable 的 pod 没有这个标签
+	TrackLabel = "track"
+	// TrackCanary canary pod 上 TrackLabel 的值
+	TrackCanary = "canary"
+	// TrackStable stable pod 上 TrackLabel 的值，和 canary 的 selector 不重叠
+	TrackStable = "stable"
+	// ColorLabel blue/green 发布时区分两组 pod，service 通过它选择 active 的一组
+	ColorLabel = "color"
+	// ColorBlue 使用 MacBook 同名的 deployment
+	ColorBlue = "blue"
+	// ColorGreen 使用 <name>-green deployment
+	ColorGreen = "green"
+)
+
+// NewDeployMent 生成 MacBook 的 deployment，web 容器合并 class 的默认值，class 可以为 nil
+func NewDeployMent(ins *mockv1beta1.MacBook, class *mockv1beta1.MacBookClass) *appsv1.Deployment {
+	image := ins.Spec.Image
+	if image == "" {
+		image = DefaultImage
+	}
+	replicas := int32Ptr(DesiredReplicas(ins))
+	web := apiv1.Container{
+		Name:  "web",
+		Image: image,
+		Ports: []apiv1.ContainerPort{
+			{
+				Name:          "http",
+				Protocol:      apiv1.ProtocolTCP,
+				ContainerPort: 80,
+			},
+		},
+	}
+	applyClass(&web, ins, class)
 
 	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      ins.Name,
 			Namespace: ins.Namespace,
 			Labels: map[string]string{
-				"app": ins.Name,
+				AppLabel: ins.Name,
 			},
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: int32Ptr(1),
+			Replicas:                replicas,
+			ProgressDeadlineSeconds: copyInt32Ptr(ins.Spec.ProgressDeadlineSeconds),
+			// selector 创建后不能修改，已有的 deployment 保留原来只有 AppLabel 的 selector
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
-					"app": ins.Name,
+					AppLabel:   ins.Name,
+					TrackLabel: TrackStable,
 				},
 			},
 			Template: apiv1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: map[string]string{
-						"app": ins.Name,
+						AppLabel:     ins.Name,
+						MacBookLabel: ins.Name,
+						TrackLabel:   TrackStable,
 					},
 				},
 				Spec: apiv1.PodSpec{
 					TerminationGracePeriodSeconds: int64Ptr(0),
-					Containers: []apiv1.Container{
-						{
-							Name:  "web",
-							Image: "nginx:1.12",
-							Ports: []apiv1.ContainerPort{
-								{
-									Name:          "http",
-									Protocol:      apiv1.ProtocolTCP,
-									ContainerPort: 80,
-								},
-							},
-						},
-					},
+					Containers:                    []apiv1.Container{web},
 				},
 			},
 		},
 	}
 }
 
+// PodSelector 选择 MacBook 自己的 web pod，组件和 hook job 的 pod 也带有 MacBookLabel，需要排除；
+// canary 的 pod 单独评估，也不包括在内
+func PodSelector(ins *mockv1beta1.MacBook) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{MacBookLabel: ins.Name}).
+		Add(mustRequirement(ComponentLabel, selection.DoesNotExist)).
+		Add(mustRequirement(HookLabel, selection.DoesNotExist)).
+		Add(mustRequirement(TrackLabel, selection.NotIn, TrackCanary))
+}
+
+// CanaryPodSelector 选择 canary deployment 的 pod
+func CanaryPodSelector(ins *mockv1beta1.MacBook) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{MacBookLabel: ins.Name, TrackLabel: TrackCanary})
+}
+
+// ColorPodSelector 选择 blue/green 发布中某个颜色的 pod
+func ColorPodSelector(ins *mockv1beta1.MacBook, color string) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{MacBookLabel: ins.Name, ColorLabel: color})
+}
+
+func mustRequirement(key string, op selection.Operator, values ...string) labels.Requirement {
+	req, err := labels.NewRequirement(key, op, values)
+	if err != nil {
+		panic(err)
+	}
+	return *req
+}
+
+// NewCanaryDeployMent canary deployment 名称为 <name>-canary，pod 带有 track=canary 标签，
+// 和 stable 的 selector 不重叠；仍然带有 AppLabel，所以和 stable 的 pod 一起在 service 后端
+func NewCanaryDeployMent(ins *mockv1beta1.MacBook, class *mockv1beta1.MacBookClass) *appsv1.Deployment {
+	dep := NewDeployMent(ins, class)
+	dep.Name = CanaryName(ins)
+	dep.Labels[TrackLabel] = TrackCanary
+	dep.Spec.Selector.MatchLabels[TrackLabel] = TrackCanary
+	dep.Spec.Template.Labels[TrackLabel] = TrackCanary
+	return dep
+}
+
+// CanaryName canary deployment 的名称
+func CanaryName(ins *mockv1beta1.MacBook) string {
+	return ins.Name + "-canary"
+}
+
+// NewColorDeployMent blue/green 发布中某个颜色的 deployment，pod 带有 ColorLabel。
+// blue 沿用 MacBook 同名的 deployment，它的 selector 不能修改，所以不带颜色
+func NewColorDeployMent(ins *mockv1beta1.MacBook, class *mockv1beta1.MacBookClass, color string) *appsv1.Deployment {
+	dep := NewDeployMent(ins, class)
+	dep.Name = ColorName(ins, color)
+	dep.Labels[ColorLabel] = color
+	dep.Spec.Template.Labels[ColorLabel] = color
+	if color != ColorBlue {
+		dep.Spec.Selector.MatchLabels[ColorLabel] = color
+	}
+	return dep
+}
+
+// ColorName 某个颜色的 deployment 名称
+func ColorName(ins *mockv1beta1.MacBook, color string) string {
+	if color == ColorBlue {
+		return ins.Name
+	}
+	return ins.Name + "-" + color
+}
+
+// OtherColor 返回另一个颜色
+func OtherColor(color string) string {
+	if color == ColorBlue {
+		return ColorGreen
+	}
+	return ColorBlue
+}
+
+// DesiredReplicas 期望的副本数，休眠时为 0，其次是生效的扩缩容计划，最后是 spec.replicas
+func DesiredReplicas(ins *mockv1beta1.MacBook) int32 {
+	if h := ins.Status.Hibernation; h != nil && h.Hibernated {
+		return 0
+	}
+	if s := ins.Status.Schedule; s != nil && s.Replicas != nil {
+		return *s.Replicas
+	}
+	if ins.Spec.Replicas != nil {
+		return *ins.Spec.Replicas
+	}
+	return 1
+}
+
 func int32Ptr(i int32) *int32 { return &i }
+func copyInt32Ptr(i *int32) *int32 {
+	if i == nil {
+		return nil
+	}
+	return int32Ptr(*i)
+}
 func int64Ptr(i int64) *int64 { return &i }
@@ -0,0 +1,153 @@
+/*
+ *@Description     spec.hooks 中 preDeploy 和 postDeploy 的 job
+ *@author          lirui
+ *@create          2021-07-18 15:30
+ */
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// HookLabel hook job 上的标签，值为 hook 的阶段 PreDeploy 或 PostDeploy
+	HookLabel = "mock.dong.com/hook"
+	// TemplateHashLabel hook job 上的标签，值为 hook 所属的 pod 模板的哈希
+	TemplateHashLabel = "mock.dong.com/template-hash"
+	// HookHashLabel hook job 上的标签，值为运行的 hook 的哈希
+	HookHashLabel = "mock.dong.com/hook-hash"
+)
+
+// maxJobNameLength job 的名称会作为 pod 的 job-name 标签，不能超过标签值的长度
+const maxJobNameLength = 63
+
+// HookJobName hook job 的名称 <macbook>-pre-deploy-<模板哈希>-<hook 哈希>，每个 pod 模板和 hook 只运行一次，
+// 修改失败的 hook 后使用新的 job。超过 63 个字符时截短 MacBook 的名称，并加上完整名称的哈希避免重名
+func HookJobName(ins *mockv1beta1.MacBook, phase, templateHash, hookHash string) string {
+	suffix := "-post-deploy-"
+	if phase == mockv1beta1.HookPreDeploy {
+		suffix = "-pre-deploy-"
+	}
+	suffix += templateHash + "-" + hookHash
+	name := ins.Name
+	if len(name)+len(suffix) > maxJobNameLength {
+		nameHash := "-" + hashObject(ins.Name)
+		name = strings.TrimRight(name[:maxJobNameLength-len(suffix)-len(nameHash)], "-.") + nameHash
+	}
+	return name + suffix
+}
+
+// HookJobTemplate 解析 hook 的 template，未知字段报错，避免拼错的字段被静默忽略
+func HookJobTemplate(hook *mockv1beta1.Hook) (*batchv1beta1.JobTemplateSpec, error) {
+	if hook.Template == nil {
+		return nil, nil
+	}
+	if hook.Image != "" || len(hook.Command) > 0 || len(hook.Args) > 0 || len(hook.Env) > 0 {
+		return nil, errors.New("template is mutually exclusive with image, command, args and env")
+	}
+	template := &batchv1beta1.JobTemplateSpec{}
+	decoder := json.NewDecoder(bytes.NewReader(hook.Template.Raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(template); err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	if len(template.Spec.Template.Spec.Containers) == 0 {
+		return nil, errors.New("template has no containers")
+	}
+	return template, nil
+}
+
+// NewHookJob 生成 hook 的 job，镜像默认和 MacBook 相同，失败的 pod 不重启。
+// 设置了 template 时以它为基础，补上标签、镜像、重启策略和 hook 的重试次数、超时
+func NewHookJob(ins *mockv1beta1.MacBook, phase string, hook *mockv1beta1.Hook, templateHash string) (*batchv1.Job, error) {
+	template, err := HookJobTemplate(hook)
+	if err != nil {
+		return nil, err
+	}
+	image := hook.Image
+	if image == "" {
+		image = ins.Spec.Image
+	}
+	if image == "" {
+		image = DefaultImage
+	}
+	backoffLimit := int32(0)
+	if hook.BackoffLimit != nil {
+		backoffLimit = *hook.BackoffLimit
+	}
+	deadline := int64(600)
+	if hook.ActiveDeadlineSeconds != nil {
+		deadline = *hook.ActiveDeadlineSeconds
+	}
+	labels := map[string]string{
+		MacBookLabel:      ins.Name,
+		HookLabel:         phase,
+		TemplateHashLabel: templateHash,
+		HookHashLabel:     HookHash(hook),
+	}
+
+	if template == nil {
+		template = &batchv1beta1.JobTemplateSpec{
+			Spec: batchv1.JobSpec{
+				Template: apiv1.PodTemplateSpec{
+					Spec: apiv1.PodSpec{
+						Containers: []apiv1.Container{{
+							Name:    strings.ToLower(phase),
+							Command: hook.Command,
+							Args:    hook.Args,
+							Env:     hook.Env,
+						}},
+					},
+				},
+			},
+		}
+	}
+	spec := template.Spec
+	if spec.BackoffLimit == nil {
+		spec.BackoffLimit = int32Ptr(backoffLimit)
+	}
+	if spec.ActiveDeadlineSeconds == nil {
+		spec.ActiveDeadlineSeconds = int64Ptr(deadline)
+	}
+	if spec.Template.Spec.RestartPolicy == "" {
+		spec.Template.Spec.RestartPolicy = apiv1.RestartPolicyNever
+	}
+	spec.Template.Labels = mergeLabels(spec.Template.Labels, labels)
+	for i := range spec.Template.Spec.Containers {
+		if spec.Template.Spec.Containers[i].Image == "" {
+			spec.Template.Spec.Containers[i].Image = image
+		}
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        HookJobName(ins, phase, templateHash, HookHash(hook)),
+			Namespace:   ins.Namespace,
+			Labels:      mergeLabels(template.Labels, labels),
+			Annotations: template.Annotations,
+		},
+		Spec: spec,
+	}, nil
+}
+
+// mergeLabels 在 template 的标签上加上控制器的标签，控制器的标签优先
+func mergeLabels(base, labels map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(labels))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
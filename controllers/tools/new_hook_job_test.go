@@ -0,0 +1,151 @@
+/*
+ *@Description     hook job 的名称和 template 的测试
+ *@author          lirui
+ *@create          2021-07-18 16:10
+ */
+package tools
+
+import (
+	"strings"
+	"testing"
+
+	mockv1beta1 "alex-opr/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestHookJobName(t *testing.T) {
+	long := strings.Repeat("a", 60)
+	tests := []struct {
+		name  string
+		phase string
+		want  string
+	}{
+		{"web", mockv1beta1.HookPreDeploy, "web-pre-deploy-0123abcd-4567cdef"},
+		{"web", mockv1beta1.HookPostDeploy, "web-post-deploy-0123abcd-4567cdef"},
+		{long, mockv1beta1.HookPreDeploy, ""},
+		{long + "b", mockv1beta1.HookPostDeploy, ""},
+		// 截短的位置是 "-" 时去掉它
+		{strings.Repeat("a", 32) + "-" + long, mockv1beta1.HookPostDeploy, ""},
+	}
+	seen := map[string]string{}
+	for _, tt := range tests {
+		ins := &mockv1beta1.MacBook{ObjectMeta: metav1.ObjectMeta{Name: tt.name}}
+		got := HookJobName(ins, tt.phase, "0123abcd", "4567cdef")
+		if tt.want != "" && got != tt.want {
+			t.Errorf("HookJobName(%s, %s) = %s, want %s", tt.name, tt.phase, got, tt.want)
+		}
+		if errs := validation.IsDNS1123Label(got); len(errs) > 0 {
+			t.Errorf("HookJobName(%s, %s) = %s is not a valid label value: %v", tt.name, tt.phase, got, errs)
+		}
+		if !strings.HasSuffix(got, "-0123abcd-4567cdef") {
+			t.Errorf("HookJobName(%s, %s) = %s lost the template or hook hash", tt.name, tt.phase, got)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("MacBooks %s and %s share hook job %s", other, tt.name, got)
+		}
+		seen[got] = tt.name
+	}
+}
+
+func TestNewHookJobTemplate(t *testing.T) {
+	ins := &mockv1beta1.MacBook{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       mockv1beta1.MacBookSpec{Image: "web:v2"},
+	}
+	backoffLimit, deadline := int32(0), int64(600)
+	tests := []struct {
+		name    string
+		hook    mockv1beta1.Hook
+		wantErr string
+		check   func(t *testing.T, job *batchv1.Job)
+	}{
+		{
+			name: "single container",
+			hook: mockv1beta1.Hook{Command: []string{"migrate"}, BackoffLimit: &backoffLimit, ActiveDeadlineSeconds: &deadline},
+			check: func(t *testing.T, job *batchv1.Job) {
+				spec := job.Spec.Template.Spec
+				if *job.Spec.ActiveDeadlineSeconds != 600 {
+					t.Errorf("activeDeadlineSeconds = %d, want 600", *job.Spec.ActiveDeadlineSeconds)
+				}
+				if len(spec.Containers) != 1 || spec.Containers[0].Image != "web:v2" || spec.Containers[0].Name != "predeploy" {
+					t.Errorf("containers = %+v", spec.Containers)
+				}
+			},
+		},
+		{
+			name: "template",
+			hook: mockv1beta1.Hook{
+				BackoffLimit:          &backoffLimit,
+				ActiveDeadlineSeconds: &deadline,
+				Template: &runtime.RawExtension{Raw: []byte(`{
+					"metadata": {"labels": {"team": "db"}},
+					"spec": {"activeDeadlineSeconds": 60, "template": {"spec": {
+						"serviceAccountName": "migrator",
+						"containers": [{"name": "migrate"}, {"name": "proxy", "image": "proxy:v1"}],
+						"volumes": [{"name": "scratch", "emptyDir": {}}]
+					}}}
+				}`)},
+			},
+			check: func(t *testing.T, job *batchv1.Job) {
+				spec := job.Spec.Template.Spec
+				if *job.Spec.ActiveDeadlineSeconds != 60 || job.Labels["team"] != "db" {
+					t.Errorf("job = %+v, want the deadline and labels of the template", job)
+				}
+				if spec.ServiceAccountName != "migrator" || len(spec.Volumes) != 1 {
+					t.Errorf("pod spec of the template was not kept: %+v", spec)
+				}
+				if spec.Containers[0].Image != "web:v2" || spec.Containers[1].Image != "proxy:v1" {
+					t.Errorf("containers = %+v, want the MacBook's image only where none is set", spec.Containers)
+				}
+				if spec.RestartPolicy != apiv1.RestartPolicyNever {
+					t.Errorf("restart policy = %s, want Never", spec.RestartPolicy)
+				}
+			},
+		},
+		{
+			name:    "template with image",
+			hook:    mockv1beta1.Hook{Image: "other", Template: &runtime.RawExtension{Raw: []byte(`{"spec": {}}`)}},
+			wantErr: "mutually exclusive",
+		},
+		{
+			name:    "unknown field",
+			hook:    mockv1beta1.Hook{Template: &runtime.RawExtension{Raw: []byte(`{"spec": {"template": {"spec": {"container": [{"name": "a"}]}}}}`)}},
+			wantErr: "unknown field",
+		},
+		{
+			name:    "no containers",
+			hook:    mockv1beta1.Hook{Template: &runtime.RawExtension{Raw: []byte(`{"spec": {}}`)}},
+			wantErr: "no containers",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, err := NewHookJob(ins, mockv1beta1.HookPreDeploy, &tt.hook, "0123abcd")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewHookJob() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, labels := range []map[string]string{job.Labels, job.Spec.Template.Labels} {
+				if labels[MacBookLabel] != "web" || labels[HookLabel] != mockv1beta1.HookPreDeploy || labels[TemplateHashLabel] != "0123abcd" || labels[HookHashLabel] != HookHash(&tt.hook) {
+					t.Errorf("labels = %v, want the hook labels", labels)
+				}
+			}
+			if job.Name != HookJobName(ins, mockv1beta1.HookPreDeploy, "0123abcd", HookHash(&tt.hook)) {
+				t.Errorf("job name = %s, want the name of the template and hook hashes", job.Name)
+			}
+			if *job.Spec.BackoffLimit != 0 {
+				t.Errorf("backoffLimit = %d, want 0", *job.Spec.BackoffLimit)
+			}
+			tt.check(t, job)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ *@Description     MacBook 的 service，选择 MacBook 所有的 pod
+ *@author          lirui
+ *@create          2021-06-12 15:02
+ */
+package tools
+
+import (
+	mockv1beta1 "alex-opr/api/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// NewService 创建和 MacBook 同名的 service，stable 和 canary 的 pod 都在后端。
+// AppLabel 是通用的标签，别的工作负载也可能使用，同时按 MacBookLabel 选择；
+// 组件和 hook job 的 pod 虽然带有 MacBookLabel，但没有 AppLabel
+func NewService(ins *mockv1beta1.MacBook) *apiv1.Service {
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ins.Name,
+			Namespace: ins.Namespace,
+			Labels: map[string]string{
+				AppLabel: ins.Name,
+			},
+		},
+		Spec: apiv1.ServiceSpec{
+			Selector: map[string]string{
+				AppLabel:     ins.Name,
+				MacBookLabel: ins.Name,
+			},
+			Ports: []apiv1.ServicePort{
+				{
+					Name:       "http",
+					Protocol:   apiv1.ProtocolTCP,
+					Port:       80,
+					TargetPort: intstr.FromString("http"),
+				},
+			},
+		},
+	}
+}
+
+// NewPreviewService blue/green 发布时暴露预览颜色的 service，名称为 <name>-preview
+func NewPreviewService(ins *mockv1beta1.MacBook, color string) *apiv1.Service {
+	svc := NewService(ins)
+	svc.Name = PreviewServiceName(ins)
+	svc.Spec.Selector[ColorLabel] = color
+	return svc
+}
+
+// PreviewServiceName 预览 service 的名称
+func PreviewServiceName(ins *mockv1beta1.MacBook) string {
+	return ins.Name + "-preview"
+}
@@ -0,0 +1,72 @@
+/*
+ *@Description     cron 表达式的上一次和下一次触发时间
+ *@author          lirui
+ *@create          2021-06-20 09:40
+ */
+package tools
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// scheduleLookback 往前查找上一次触发时间的最大范围，一年内没有触发过的计划视为不生效
+const scheduleLookback = 366 * 24 * time.Hour
+
+// CronSchedule 带时区的 cron 表达式
+type CronSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+// ParseSchedule 解析标准的 5 段 cron 表达式，timeZone 为 IANA 时区名称，为空时使用 UTC
+func ParseSchedule(expr, timeZone string) (*CronSchedule, error) {
+	loc := time.UTC
+	if timeZone != "" {
+		l, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone %q: %v", timeZone, err)
+		}
+		loc = l
+	}
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", expr, err)
+	}
+	return &CronSchedule{schedule: schedule, location: loc}, nil
+}
+
+// Next now 之后的下一次触发时间
+func (s *CronSchedule) Next(now time.Time) time.Time {
+	return s.schedule.Next(now.In(s.location))
+}
+
+// Last 不晚于 now 的最近一次触发时间，范围内没有触发过返回零值。
+// cron 只能往后计算，这里把查找窗口逐步加倍，找到有触发的窗口后再往后逐个计算
+func (s *CronSchedule) Last(now time.Time) time.Time {
+	for window := time.Minute; window <= 2*scheduleLookback; window *= 2 {
+		t := s.Next(now.Add(-window))
+		if t.After(now) {
+			continue
+		}
+		for {
+			next := s.schedule.Next(t)
+			if next.After(now) || next.IsZero() {
+				return t
+			}
+			t = next
+		}
+	}
+	return time.Time{}
+}
+
+// Window 以每次触发为起点、持续 d 的窗口。返回 now 是否在窗口内、当前窗口的结束时间以及下一个窗口的开始时间
+func (s *CronSchedule) Window(now time.Time, d time.Duration) (bool, time.Time, time.Time) {
+	next := s.Next(now)
+	if last := s.Last(now); !last.IsZero() && now.Before(last.Add(d)) {
+		return true, last.Add(d), next
+	}
+	return false, time.Time{}, next
+}
@@ -0,0 +1,130 @@
+/*
+ *@Description     cron 计划上一次触发时间和窗口的测试
+ *@author          lirui
+ *@create          2021-06-20 15:10
+ */
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func mustTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("parse %q: %v", value, err)
+	}
+	return ts
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		timeZone string
+		wantErr  bool
+	}{
+		{"utc by default", "0 9 * * *", "", false},
+		{"iana time zone", "0 9 * * 1-5", "Asia/Shanghai", false},
+		{"descriptor", "@hourly", "", false},
+		{"unknown time zone", "0 9 * * *", "Mars/Olympus", true},
+		{"six fields", "0 0 9 * * *", "", true},
+		{"invalid field", "0 25 * * *", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSchedule(tt.expr, tt.timeZone)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSchedule(%q, %q) error = %v, want error %v", tt.expr, tt.timeZone, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronScheduleLast(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		timeZone string
+		now      string
+		// want 为空表示查找范围内没有触发过
+		want string
+	}{
+		{"earlier today", "0 9 * * *", "", "2021-06-20T10:00:00Z", "2021-06-20T09:00:00Z"},
+		{"exactly at the trigger", "0 9 * * *", "", "2021-06-20T09:00:00Z", "2021-06-20T09:00:00Z"},
+		{"yesterday", "0 9 * * *", "", "2021-06-20T08:59:59Z", "2021-06-19T09:00:00Z"},
+		{"every minute", "* * * * *", "", "2021-06-20T10:00:30Z", "2021-06-20T10:00:00Z"},
+		{"weekdays over a weekend", "0 9 * * 1-5", "", "2021-06-20T12:00:00Z", "2021-06-18T09:00:00Z"},
+		{"yearly", "0 0 1 1 *", "", "2021-06-20T10:00:00Z", "2021-01-01T00:00:00Z"},
+		{"never triggers", "0 0 30 2 *", "", "2021-06-20T10:00:00Z", ""},
+		{"time zone", "0 9 * * *", "Asia/Shanghai", "2021-06-20T02:00:00Z", "2021-06-20T01:00:00Z"},
+		{"time zone before the local trigger", "0 9 * * *", "Asia/Shanghai", "2021-06-20T00:30:00Z", "2021-06-19T01:00:00Z"},
+		// 夏令时开始后 9 点对应的 UTC 时间提前一小时
+		{"after spring forward", "0 9 * * *", "America/New_York", "2021-03-15T14:00:00Z", "2021-03-15T13:00:00Z"},
+		{"before spring forward", "0 9 * * *", "America/New_York", "2021-03-13T14:30:00Z", "2021-03-13T14:00:00Z"},
+		// 2:30 在夏令时开始当天不存在，这一天不触发
+		{"skipped local time", "30 2 * * *", "America/New_York", "2021-03-14T12:00:00Z", "2021-03-13T07:30:00Z"},
+		// 夏令时结束当天 1:30 出现两次，两次都会触发
+		{"first repeated local time", "30 1 * * *", "America/New_York", "2021-11-07T05:45:00Z", "2021-11-07T05:30:00Z"},
+		{"second repeated local time", "30 1 * * *", "America/New_York", "2021-11-07T12:00:00Z", "2021-11-07T06:30:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.expr, tt.timeZone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Last(mustTime(t, tt.now))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Last = %s, want zero", got.UTC())
+				}
+				return
+			}
+			if want := mustTime(t, tt.want); !got.Equal(want) {
+				t.Errorf("Last = %s, want %s", got.UTC(), want)
+			}
+		})
+	}
+}
+
+func TestCronScheduleWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		timeZone string
+		duration time.Duration
+		now      string
+		wantIn   bool
+		wantEnd  string
+		wantNext string
+	}{
+		{"inside", "0 9 * * *", "", 2 * time.Hour, "2021-06-20T10:00:00Z", true, "2021-06-20T11:00:00Z", "2021-06-21T09:00:00Z"},
+		{"at the start", "0 9 * * *", "", 2 * time.Hour, "2021-06-20T09:00:00Z", true, "2021-06-20T11:00:00Z", "2021-06-21T09:00:00Z"},
+		{"at the end", "0 9 * * *", "", 2 * time.Hour, "2021-06-20T11:00:00Z", false, "", "2021-06-21T09:00:00Z"},
+		{"before the start", "0 9 * * *", "", 2 * time.Hour, "2021-06-20T08:00:00Z", false, "", "2021-06-20T09:00:00Z"},
+		{"window longer than the period", "0 * * * *", "", 90 * time.Minute, "2021-06-20T10:30:00Z", true, "2021-06-20T11:30:00Z", "2021-06-20T11:00:00Z"},
+		{"across midnight in a time zone", "0 22 * * *", "Asia/Shanghai", 4 * time.Hour, "2021-06-20T17:00:00Z", true, "2021-06-20T18:00:00Z", "2021-06-21T14:00:00Z"},
+		{"never triggers", "0 0 30 2 *", "", time.Hour, "2021-06-20T10:00:00Z", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.expr, tt.timeZone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			in, end, next := s.Window(mustTime(t, tt.now), tt.duration)
+			if in != tt.wantIn {
+				t.Errorf("in window = %v, want %v", in, tt.wantIn)
+			}
+			if tt.wantEnd == "" && !end.IsZero() || tt.wantEnd != "" && !end.Equal(mustTime(t, tt.wantEnd)) {
+				t.Errorf("end = %s, want %q", end.UTC(), tt.wantEnd)
+			}
+			if tt.wantNext == "" && !next.IsZero() || tt.wantNext != "" && !next.Equal(mustTime(t, tt.wantNext)) {
+				t.Errorf("next = %s, want %q", next.UTC(), tt.wantNext)
+			}
+		})
+	}
+}
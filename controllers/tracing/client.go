@@ -0,0 +1,125 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// NewClient 包装 manager 的 client，每一次 api 调用都会在 ctx 中的 span 下产生一个子 span，
+// span 名称形如 "Get MacBook"、"Create Deployment"、"Status.Update MacBook"
+func NewClient(c client.Client) client.Client {
+	return &tracingClient{Client: c}
+}
+
+type tracingClient struct {
+	client.Client
+}
+
+func (c *tracingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	ctx, span := c.start(ctx, "Get", obj, attribute.String("k8s.namespace", key.Namespace), attribute.String("k8s.name", key.Name))
+	return end(span, c.Client.Get(ctx, key, obj))
+}
+
+func (c *tracingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	ctx, span := c.start(ctx, "List", list)
+	return end(span, c.Client.List(ctx, list, opts...))
+}
+
+func (c *tracingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	ctx, span := c.start(ctx, "Create", obj, objectAttributes(obj)...)
+	return end(span, c.Client.Create(ctx, obj, opts...))
+}
+
+func (c *tracingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	ctx, span := c.start(ctx, "Delete", obj, objectAttributes(obj)...)
+	return end(span, c.Client.Delete(ctx, obj, opts...))
+}
+
+func (c *tracingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	ctx, span := c.start(ctx, "Update", obj, objectAttributes(obj)...)
+	return end(span, c.Client.Update(ctx, obj, opts...))
+}
+
+func (c *tracingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	ctx, span := c.start(ctx, "Patch", obj, objectAttributes(obj)...)
+	return end(span, c.Client.Patch(ctx, obj, patch, opts...))
+}
+
+func (c *tracingClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	ctx, span := c.start(ctx, "DeleteAllOf", obj)
+	return end(span, c.Client.DeleteAllOf(ctx, obj, opts...))
+}
+
+func (c *tracingClient) Status() client.StatusWriter {
+	return &tracingStatusWriter{StatusWriter: c.Client.Status(), c: c}
+}
+
+type tracingStatusWriter struct {
+	client.StatusWriter
+	c *tracingClient
+}
+
+func (w *tracingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	ctx, span := w.c.start(ctx, "Status.Update", obj, objectAttributes(obj)...)
+	return end(span, w.StatusWriter.Update(ctx, obj, opts...))
+}
+
+func (w *tracingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	ctx, span := w.c.start(ctx, "Status.Patch", obj, objectAttributes(obj)...)
+	return end(span, w.StatusWriter.Patch(ctx, obj, patch, opts...))
+}
+
+func (c *tracingClient) start(ctx context.Context, op string, obj runtime.Object, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	kind := c.kindOf(obj)
+	attrs = append(attrs, attribute.String("k8s.kind", kind))
+	return Tracer().Start(ctx, op+" "+kind, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// kindOf 通过 scheme 找到对象的 Kind，列表类型去掉 List 后缀
+func (c *tracingClient) kindOf(obj runtime.Object) string {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return "Unknown"
+	}
+	return strings.TrimSuffix(gvk.Kind, "List")
+}
+
+func objectAttributes(obj client.Object) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("k8s.namespace", obj.GetNamespace()),
+		attribute.String("k8s.name", obj.GetName()),
+	}
+}
+
+// end 在 span 上记录错误并结束 span，原样返回 err
+func end(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
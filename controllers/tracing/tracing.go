@@ -0,0 +1,161 @@
+/*
+Copyright 2021 lirui.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 支持的导出器类型
+const (
+	ExporterNone     = "none"
+	ExporterOTLP     = "otlp"
+	ExporterOTLPHTTP = "otlp-http"
+	ExporterStdout   = "stdout"
+	ExporterFile     = "file"
+)
+
+// instrumentationName 是所有 span 使用的 tracer 名称
+const instrumentationName = "alex-opr/controllers"
+
+// Options 描述 trace 的导出方式，由 main 中的命令行参数填充
+type Options struct {
+	// Exporter 取值 none、otlp、otlp-http、stdout、file
+	Exporter string
+	// Endpoint 是 otlp 导出器的 collector 地址，例如 otel-collector:4317
+	Endpoint string
+	// Insecure 表示连接 collector 时不使用 TLS
+	Insecure bool
+	// File 是 file 导出器写入的文件路径，方便离线调试
+	File string
+	// SampleRatio 采样比例，1 表示全部采样
+	SampleRatio float64
+	// ServiceName 写入 resource 的 service.name
+	ServiceName string
+}
+
+// BindFlags 注册 trace 相关的命令行参数
+func (o *Options) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Exporter, "trace-exporter", ExporterNone,
+		"The exporter used for reconcile traces, one of none, otlp, otlp-http, stdout or file.")
+	fs.StringVar(&o.Endpoint, "trace-otlp-endpoint", "localhost:4317", "The collector endpoint used by the otlp exporters.")
+	fs.BoolVar(&o.Insecure, "trace-otlp-insecure", false, "Disable TLS when talking to the otlp collector.")
+	fs.StringVar(&o.File, "trace-file", "traces.json", "The file the file exporter writes spans to.")
+	fs.Float64Var(&o.SampleRatio, "trace-sample-ratio", 1, "The ratio of reconciles that are traced.")
+	fs.StringVar(&o.ServiceName, "trace-service-name", "alex-opr", "The service.name attached to every span.")
+}
+
+// Setup 根据 Options 安装全局的 TracerProvider，返回的函数用于退出前刷新并关闭导出器。
+// Exporter 为 none 时保持 otel 默认的 noop 实现，不产生任何开销。
+func Setup(ctx context.Context, o Options) (func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		closer   io.Closer
+		err      error
+	)
+
+	switch o.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		opts := []otlpgrpc.Option{otlpgrpc.WithEndpoint(o.Endpoint)}
+		if o.Insecure {
+			opts = append(opts, otlpgrpc.WithInsecure())
+		}
+		exporter, err = otlp.NewExporter(ctx, otlpgrpc.NewDriver(opts...))
+	case ExporterOTLPHTTP:
+		opts := []otlphttp.Option{otlphttp.WithEndpoint(o.Endpoint)}
+		if o.Insecure {
+			opts = append(opts, otlphttp.WithInsecure())
+		}
+		exporter, err = otlp.NewExporter(ctx, otlphttp.NewDriver(opts...))
+	case ExporterStdout:
+		exporter, err = stdout.NewExporter(stdout.WithPrettyPrint(), stdout.WithoutMetricExport())
+	case ExporterFile:
+		f, ferr := os.OpenFile(o.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if ferr != nil {
+			return nil, ferr
+		}
+		closer = f
+		exporter, err = stdout.NewExporter(stdout.WithWriter(f), stdout.WithoutMetricExport())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", o.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.SampleRatio))),
+		sdktrace.WithResource(sdkresource.NewWithAttributes(semconv.ServiceNameKey.String(o.ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Tracer 返回控制器使用的 tracer，未调用 Setup 时为 noop
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// LogValues 返回当前 span 的 trace id 和 span id，用于 logr 的 WithValues
+func LogValues(ctx context.Context) []interface{} {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []interface{}{"traceID", sc.TraceID().String(), "spanID", sc.SpanID().String()}
+}
+
+// EventAnnotations 返回写入 Event annotations 的 trace 信息，
+// 通过 kubectl get event -o yaml 就能拿到对应的 trace id
+func EventAnnotations(ctx context.Context) map[string]string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return map[string]string{
+		"dong.com/trace-id": sc.TraceID().String(),
+		"dong.com/span-id":  sc.SpanID().String(),
+	}
+}
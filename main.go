@@ -17,22 +17,31 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
+	// 镜像中可能没有时区数据，扩缩容计划的 timeZone 依赖它
+	_ "time/tzdata"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	mockv1beta1 "alex-opr/api/v1beta1"
 	"alex-opr/controllers"
+	"alex-opr/controllers/tracing"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -49,11 +58,26 @@ func init() {
 }
 
 func main() {
+	// os.Exit 不会执行 defer，所有工作放在 run 中，返回后 trace 已经刷新
+	if err := run(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run 启动 manager，出错时已经记录日志，返回的错误只用于决定退出码
+func run() error {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var wakeAddr string
+	var wakeTimeout time.Duration
+	var maintenanceConfig string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	flag.StringVar(&wakeAddr, "wake-bind-address", ":8082", "The address the wake-up endpoint for hibernated MacBooks binds to. Set to 0 to disable it.")
+	flag.DurationVar(&wakeTimeout, "wake-timeout", 2*time.Minute, "How long a wake-up request waits for the MacBook's pods to become ready.")
+	flag.StringVar(&maintenanceConfig, "maintenance-config", "", "The namespace/name of a ConfigMap whose \"windows\" key lists the cluster-wide maintenance windows. "+
+		"MacBooks without spec.maintenanceWindows only roll pods inside these windows.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -61,10 +85,38 @@ func main() {
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
+	var traceOpts tracing.Options
+	traceOpts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// 初始化 trace 导出器，默认 none 不导出
+	shutdownTracing, err := tracing.Setup(context.Background(), traceOpts)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			setupLog.Error(err, "problem shutting down tracing")
+		}
+	}()
+
+	// 全局维护窗口的 ConfigMap，格式为 namespace/name
+	var maintenanceKey types.NamespacedName
+	if maintenanceConfig != "" {
+		parts := strings.SplitN(maintenanceConfig, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			err := fmt.Errorf("invalid --maintenance-config %q, expected namespace/name", maintenanceConfig)
+			setupLog.Error(err, "unable to configure maintenance windows")
+			return err
+		}
+		maintenanceKey = types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+	}
+
 	// 1、初始化manager
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
@@ -76,34 +128,87 @@ func main() {
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
-		os.Exit(1)
+		return err
 	}
 
 	// 用manager启动controller
 	if err = (&controllers.MacBookReconciler{
-		Client: mgr.GetClient(),
+		// 包装 client，为每次 api 调用生成 span
+		Client: tracing.NewClient(mgr.GetClient()),
 		Log:    ctrl.Log.WithName("controllers").WithName("MacBook"),
 		Scheme: mgr.GetScheme(),
-		// 实例化事件记录
-		Recorder: mgr.GetEventRecorderFor("macbook"),
+		// 实例化事件记录，按对象去重限速
+		Recorder:          controllers.NewEventRecorder(mgr.GetEventRecorderFor("macbook")),
+		MaintenanceConfig: maintenanceKey,
+		// spec.waitFor 的对象直接从 apiserver 读取，不建立缓存
+		APIReader: mgr.GetAPIReader(),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "MacBook")
-		os.Exit(1)
+		return err
+	}
+	if err = (&controllers.TenantReconciler{
+		Client:   tracing.NewClient(mgr.GetClient()),
+		Log:      ctrl.Log.WithName("controllers").WithName("Tenant"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: controllers.NewEventRecorder(mgr.GetEventRecorderFor("tenant")),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Tenant")
+		return err
+	}
+	if err = (&controllers.MacBookSetReconciler{
+		Client:   tracing.NewClient(mgr.GetClient()),
+		Log:      ctrl.Log.WithName("controllers").WithName("MacBookSet"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: controllers.NewEventRecorder(mgr.GetEventRecorderFor("macbookset")),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "MacBookSet")
+		return err
+	}
+	if err = (&controllers.MacBookQuotaReconciler{
+		Client: tracing.NewClient(mgr.GetClient()),
+		Log:    ctrl.Log.WithName("controllers").WithName("MacBookQuota"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "MacBookQuota")
+		return err
+	}
+	// 本地运行没有证书时设置 ENABLE_WEBHOOKS=false 关闭 admission webhook
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		mgr.GetWebhookServer().Register(controllers.MacBookQuotaWebhookPath, &webhook.Admission{
+			Handler: &controllers.MacBookQuotaValidator{Client: mgr.GetClient()},
+		})
+		mgr.GetWebhookServer().Register(controllers.MacBookRevisionWebhookPath, &webhook.Admission{
+			Handler: &controllers.MacBookRevisionValidator{},
+		})
 	}
 	//+kubebuilder:scaffold:builder
 
+	// 唤醒休眠 MacBook 的接口，不需要 leader 选举，每个副本都可以处理
+	if wakeAddr != "0" {
+		if err := mgr.Add(&controllers.WakeUpServer{
+			Client:  mgr.GetClient(),
+			Log:     ctrl.Log.WithName("wakeup"),
+			Addr:    wakeAddr,
+			Timeout: wakeTimeout,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up wake-up server")
+			return err
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
-		os.Exit(1)
+		return err
 	}
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
-		os.Exit(1)
+		return err
 	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
-		os.Exit(1)
+		return err
 	}
+	return nil
 }